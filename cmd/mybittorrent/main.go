@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"sync"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"my-bittorrent/decoder"
@@ -15,7 +20,35 @@ import (
 )
 
 func main() {
-	relFilepath := os.Args[1]
+	if len(os.Args) < 2 {
+		log.Println("usage: mybittorrent [-files <index-or-glob>,...] <path-to-torrent-file>")
+		log.Println("       mybittorrent scrape <tracker-url> <info-hash-hex>...")
+		log.Println("       mybittorrent verify <path-to-torrent-file>")
+		return
+	}
+
+	if os.Args[1] == "scrape" {
+		if err := scrape(os.Args[2:]); err != nil {
+			log.Printf("error scraping: %v", err)
+		}
+		return
+	}
+
+	if os.Args[1] == "verify" {
+		if err := verify(os.Args[2:]); err != nil {
+			log.Printf("error verifying: %v", err)
+		}
+		return
+	}
+
+	// Files to download, all the files if not set
+	flags := flag.NewFlagSet("mybittorrent", flag.ContinueOnError)
+	selectFiles := flags.String("files", "", "comma separated indices or globs of the files to download")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return
+	}
+
+	relFilepath := flags.Arg(0)
 
 	// Generate Peer ID
 	_, err := peer.GetPeerID()
@@ -42,180 +75,246 @@ func main() {
 	}
 
 	// create a new torrent instance
-	t, err := torrent.NewTorrent(decoded)
+	t, err := torrent.NewTorrent(decoded, torrent.DefaultStorage)
 	if err != nil {
 		log.Printf("Error creating New Torrent: %v", err)
 		return
 	}
+	defer t.Downloader.Close()
+
+	if *selectFiles != "" {
+		if err := t.SelectFiles(strings.Split(*selectFiles, ",")); err != nil {
+			log.Printf("Error selecting files: %v", err)
+			return
+		}
+	}
 	t.Downloader.Start()
 
-	// return
+	// ctx is cancelled on interrupt, which stops downloading/seeding
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-	// get peers
-	peers, err := tracker.GetPeers(t)
+	// announce to trackers for as long as the torrent is active
+	announcer, err := tracker.NewAnnouncer(t)
 	if err != nil {
-		log.Printf("Error in getting peers: %v", err)
+		log.Printf("Error creating announcer: %v", err)
 		return
 	}
-	// peers := peer.GetCachedPeers()
-	// _ = peers
 
-	log.Printf("successfully received peers\n")
-	for i, p := range peers {
-		fmt.Printf("i: %d, IP: %s, port: %d\n", i, p.IPAddress, p.Port)
-	}
+	announcerDone := make(chan struct{})
+	go func() {
+		defer close(announcerDone)
+		announcer.Run(ctx)
+	}()
 
-	// Peers which our client is successfully connected to
-	connectedPeers := Connect(peers)
+	// Connected peers are choked and unchoked by the choker
+	swarm := peer.NewSwarm()
+	choker := peer.NewChoker(swarm, t, peer.NewTitForTat(peer.DefaultUnchokeSlots))
 
-	if len(connectedPeers) == 0 {
-		log.Printf("stopping as 0 connected peers\n")
-		return
-	}
+	chokerDone := make(chan struct{})
+	go func() {
+		defer close(chokerDone)
+		choker.Run(ctx)
+	}()
 
-	handshakeMsg, err := peer.BuildHandshakeMessage(t.InfoHash)
+	// Announce verified pieces to the connected peers
+	go swarm.BroadcastHaves(ctx, t)
+
+	// Connections to peers, both dialed and accepted, are kept by the
+	// connection manager
+	manager, err := peer.NewConnManager(swarm, t)
 	if err != nil {
-		log.Printf("error building handshake msg: %v", err)
+		log.Printf("Error creating connection manager: %v", err)
 		return
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(connectedPeers))
+	managerDone := make(chan struct{})
+	go func() {
+		defer close(managerDone)
+		manager.Run(ctx)
+	}()
 
-	// Send handshake and start receiving messages
-	for _, p := range connectedPeers {
-		ctx, cancel := context.WithCancel(context.Background())
+	// Accept connections from peers on the port announced to trackers
+	listenerDone := make(chan struct{})
+	listener, err := peer.Listen(int(tracker.AnnounceReqPort), func(p *peer.Peer, t *torrent.Torrent) {
+		manager.Accept(ctx, p)
+	})
+	if err != nil {
+		log.Printf("error listening for peers, only connecting to peers: %v", err)
+		close(listenerDone)
+	} else {
+		listener.LimitHalfOpen(manager.ReserveHalfOpen, manager.ReleaseHalfOpen)
+		listener.AddTorrent(t)
 
-		go func(p *peer.Peer) {
-			defer wg.Done()
+		go func() {
+			defer close(listenerDone)
+			listener.Serve(ctx)
+		}()
+	}
 
-			fmt.Println("START: to receive messages ", p.Conn.RemoteAddr().String())
-			peer.ReceiveMessages(ctx, p, t)
-			fmt.Println("END: receive messages", p.Conn.RemoteAddr().String())
-		}(p)
+	// Peers received on every announce are candidates to connect to
+	peersDone := make(chan struct{})
+	go func() {
+		defer close(peersDone)
 
-		fmt.Println("START: sending handshake message", p.Conn.RemoteAddr().String())
-		sendErr := peer.SendMessage(p.Conn, handshakeMsg)
-		if sendErr != nil {
-			fmt.Printf("Error in sending handshake msg to: %s, error: %v\n", p.Conn.RemoteAddr().String(), sendErr)
-			cancel()
+		for peers := range announcer.Peers() {
+			log.Printf("successfully received peers: %d\n", len(peers))
+			manager.AddCandidates(peers)
 		}
-		fmt.Println("END: sending handshake", p.Conn.RemoteAddr().String())
-	}
+	}()
 
 	// Print stats
-	PrintStats(t.Downloader)
+	if PrintStats(ctx, t.Downloader) {
+		// Wait for the last pieces to be written to the files
+		t.Downloader.WaitForWrites()
+
+		fmt.Println("--------- File Ready ---------")
+
+		// Keep seeding to the peers until interrupted
+		fmt.Println("seeding, press Ctrl+C to stop")
+		<-ctx.Done()
+	}
+
+	// Stop announcing, accepting and connecting to new peers
+	<-announcerDone
+	<-peersDone
+	<-listenerDone
+	<-chokerDone
 
 	// Wait for all the connections to be closed
-	wg.Wait()
+	<-managerDone
 
 	fmt.Println("All connections closed.")
+}
 
-	if err := t.SplitTorrentDataIntoFiles(); err != nil {
-		log.Printf("error splitting torrent data into files: %v\n", err)
+// scrape prints the swarm stats of the info hashes reported by the tracker
+// args: <tracker-url> <info-hash-hex>...
+func scrape(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: scrape <tracker-url> <info-hash-hex>...")
 	}
 
-	fmt.Println("--------- File Ready ---------")
-}
+	trackerUrl := args[0]
 
-func readFile(relFilepath string) ([]byte, error) {
-	// read complete file into memory at once
-	data, err := os.ReadFile(relFilepath)
-	if err != nil {
-		return nil, err
+	var infoHashes [][20]byte
+	for _, arg := range args[1:] {
+		b, err := hex.DecodeString(arg)
+		if err != nil || len(b) != 20 {
+			return fmt.Errorf("invalid info hash %q, expected 40 hex characters", arg)
+		}
+		infoHashes = append(infoHashes, [20]byte(b))
 	}
 
-	return data, nil
-}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	results, err := tracker.ScrapeTracker(ctx, trackerUrl, infoHashes)
+	if err != nil {
+		return err
+	}
 
-// Connect establishes connection with each peer
-func Connect(peers []*peer.Peer) []*peer.Peer {
-	isConnected := make([]bool, len(peers))
-	retryTimes := 2
-	delay := 5 * time.Second
+	fmt.Printf("%-40s %8s %9s %8s\n", "info_hash", "seeders", "completed", "leechers")
+	for _, res := range results {
+		fmt.Printf("%-40s %8d %9d %8d\n", hex.EncodeToString(res.InfoHash[:]), res.Seeders, res.Completed, res.Leechers)
+	}
 
-	var wg sync.WaitGroup
+	return nil
+}
 
-	remaining := len(peers) // peers which are yet to be connected
-	for i := 0; i < retryTimes; i++ {
-		if i > 0 {
-			// delay before retrying
-			fmt.Println("waiting before retry")
-			time.Sleep(delay)
-		}
+// verify hash checks the data on disk of the torrent, and prints how much
+// of each of the files is complete
+// args: <path-to-torrent-file>
+func verify(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: verify <path-to-torrent-file>")
+	}
 
-		wg.Add(remaining)
-		go tryConnecting(peers, &wg, isConnected)
-		wg.Wait()
+	bencoded, err := readFile(args[0])
+	if err != nil {
+		return fmt.Errorf("error reading torrent file: %v", err)
+	}
 
-		connected := countConnected(isConnected)
-		remaining = remaining - connected
-		fmt.Println("connected: ", connected)
+	decoded, err := decoder.DecodeBencode(bencoded)
+	if err != nil {
+		return fmt.Errorf("error decoding bencode: %v", err)
 	}
 
-	var connectedPeers []*peer.Peer
-	for i, peer := range peers {
-		if isConnected[i] {
-			connectedPeers = append(connectedPeers, peer)
+	t, err := torrent.NewTorrent(decoded, torrent.DefaultStorage)
+	if err != nil {
+		return fmt.Errorf("error creating New Torrent: %v", err)
+	}
+	// Result of the check is saved for the next download
+	defer t.Downloader.Close()
+
+	// Data is checked while resuming if there is no valid resume file, it is
+	// not hashed again
+	verified := t.Downloader.Bitfield().Count()
+	if !t.Downloader.Checked() {
+		// Print progress at every 10 percent
+		var lastPercent int
+		verified, err = t.Downloader.Recheck(func(checked, total int) {
+			if percent := 100 * checked / total; percent/10 > lastPercent/10 {
+				lastPercent = percent
+				fmt.Printf("checked: %d / %d pieces (%d%%)\n", checked, total, percent)
+			}
+		})
+		if err != nil {
+			return err
 		}
 	}
 
-	return connectedPeers
-}
+	fmt.Printf("verified: %d / %d pieces\n", verified, t.PiecesCount)
 
-func tryConnecting(peers []*peer.Peer, wg *sync.WaitGroup, isConnected []bool) {
-	for i, p := range peers {
-		if isConnected[i] {
-			continue
+	fmt.Printf("%8s %14s  %s\n", "complete", "bytes", "file")
+	for _, fp := range t.FileProgress() {
+		path := t.Name
+		if len(fp.File.Path) > 0 {
+			path = filepath.Join(fp.File.Path...)
 		}
 
-		go func() {
-			defer wg.Done()
-			conn, err := peer.ConnectTCP(p)
-			if err != nil {
-				log.Println(err)
-				return
-			}
+		percent := 100.0
+		if fp.File.Length > 0 {
+			percent = 100 * float64(fp.Verified) / float64(fp.File.Length)
+		}
 
-			log.Printf("Connected to peer %s", conn.RemoteAddr().String())
-			isConnected[i] = true
-			p.Conn = conn // update connection
-		}()
+		fmt.Printf("%7.2f%% %14d  %s\n", percent, fp.File.Length, path)
 	}
+
+	return nil
 }
 
-func countConnected(isConnected []bool) int {
-	var c int
-	for _, val := range isConnected {
-		if val {
-			c++
-		}
+func readFile(relFilepath string) ([]byte, error) {
+	// read complete file into memory at once
+	data, err := os.ReadFile(relFilepath)
+	if err != nil {
+		return nil, err
 	}
-	return c
+
+	return data, nil
 }
 
 func Download(t *torrent.Torrent, peer *peer.Peer) {
 
 }
 
-func PrintStats(d *torrent.Downloader) {
-	done := make(chan struct{})
-
+// PrintStats prints download progress periodically until the download is
+// complete or ctx is cancelled. Returns true if the download is complete
+func PrintStats(ctx context.Context, d *torrent.Downloader) bool {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
-	go func() {
-		for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println("--------- Download Stopped ---------")
+			return false
+		case <-ticker.C:
 			d.PrintProgress()
 
 			if d.IsDownloadComplete() {
-				// Exit the loop if download is complete
-				done <- struct{}{}
-				break
+				fmt.Println("--------- Download Complete ---------")
+				return true
 			}
 		}
-	}()
-
-	<-done
-	fmt.Println("--------- Download Complete ---------")
+	}
 }
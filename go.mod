@@ -3,5 +3,3 @@ module my-bittorrent
 go 1.22.5
 
 require github.com/jackpal/bencode-go v1.0.2
-
-require github.com/gammazero/deque v1.0.0
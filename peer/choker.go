@@ -0,0 +1,240 @@
+package peer
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"my-bittorrent/torrent"
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultUnchokeSlots is the number of peers unchoked based on their rate,
+	// besides the optimistic unchoke
+	DefaultUnchokeSlots = 4
+
+	rechokeInterval           = 10 * time.Second
+	optimisticUnchokeInterval = 30 * time.Second
+
+	// snubTimeout is how long a peer which we are interested in can go
+	// without sending us a block before it is considered snubbing us
+	snubTimeout = 1 * time.Minute
+)
+
+// PeerStats is the view of a connected peer used by a choke policy
+type PeerStats struct {
+	Addr         string  // identifies the peer, see Peer.String
+	Interested   bool    // peer is interested in pieces client has
+	Choked       bool    // peer is currently choked by client
+	Snubbed      bool    // peer has not sent a block for snubTimeout
+	DownloadRate float64 // bytes/sec received from the peer
+	UploadRate   float64 // bytes/sec sent to the peer
+}
+
+// ChokePolicy decides which peers are unchoked on every rechoke.
+// seeding is true once the download is complete, rotate is true when
+// the optimistic unchoke should move to another peer.
+// Returns the addresses of the peers to unchoke, all others are choked
+type ChokePolicy interface {
+	Unchoke(peers []PeerStats, seeding bool, rotate bool) map[string]bool
+}
+
+// TitForTat unchokes the interested peers which upload to us the fastest,
+// or which we upload to the fastest when seeding, plus one optimistic
+// unchoke which rotates to give new peers a chance
+// https://www.bittorrent.org/beps/bep_0003.html#choking-and-optimistic-unchoking
+type TitForTat struct {
+	Slots int // number of peers unchoked based on their rate
+
+	optimistic string // peer holding the optimistic unchoke
+	rand       *rand.Rand
+}
+
+func NewTitForTat(slots int) *TitForTat {
+	return &TitForTat{
+		Slots: slots,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (c *TitForTat) Unchoke(peers []PeerStats, seeding bool, rotate bool) map[string]bool {
+	rate := func(ps PeerStats) float64 {
+		if seeding {
+			return ps.UploadRate
+		}
+		return ps.DownloadRate
+	}
+
+	// Snubbed peers lose their regular slot, they can only be
+	// unchoked optimistically
+	var candidates []PeerStats
+	for _, ps := range peers {
+		if ps.Interested && !ps.Snubbed {
+			candidates = append(candidates, ps)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return rate(candidates[i]) > rate(candidates[j])
+	})
+
+	unchoke := make(map[string]bool)
+	for i := 0; i < len(candidates) && i < c.Slots; i++ {
+		unchoke[candidates[i].Addr] = true
+	}
+
+	// Peers which can take the optimistic unchoke
+	var optimistic []string
+	current := false
+	for _, ps := range peers {
+		if !ps.Interested || unchoke[ps.Addr] {
+			continue
+		}
+		if ps.Addr == c.optimistic {
+			current = true
+			continue
+		}
+		optimistic = append(optimistic, ps.Addr)
+	}
+
+	// Keep the current optimistic unchoke until it is time to rotate,
+	// or it has nothing else to rotate to
+	switch {
+	case current && (!rotate || len(optimistic) == 0):
+	case len(optimistic) > 0:
+		c.optimistic = optimistic[c.rand.Intn(len(optimistic))]
+	default:
+		c.optimistic = ""
+	}
+
+	if c.optimistic != "" {
+		unchoke[c.optimistic] = true
+	}
+
+	return unchoke
+}
+
+// transferSample is the bytes transferred with a peer at the last rechoke
+type transferSample struct {
+	downloaded int64
+	uploaded   int64
+}
+
+// Choker periodically chokes and unchokes the peers in the swarm as
+// decided by the choke policy
+type Choker struct {
+	swarm  *Swarm
+	t      *torrent.Torrent
+	policy ChokePolicy
+
+	samples     map[*Peer]transferSample
+	lastRechoke time.Time
+}
+
+func NewChoker(s *Swarm, t *torrent.Torrent, policy ChokePolicy) *Choker {
+	return &Choker{
+		swarm:   s,
+		t:       t,
+		policy:  policy,
+		samples: make(map[*Peer]transferSample),
+	}
+}
+
+// Run rechokes every rechokeInterval and rotates the optimistic unchoke
+// every optimisticUnchokeInterval, until ctx is cancelled
+func (c *Choker) Run(ctx context.Context) {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+
+	roundsPerRotation := int(optimisticUnchokeInterval / rechokeInterval)
+	c.lastRechoke = time.Now()
+
+	for round := 0; ; round++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.rechoke(round%roundsPerRotation == 0)
+		}
+	}
+}
+
+// rechoke applies the decision of the policy to the peers in the swarm
+func (c *Choker) rechoke(rotate bool) {
+	peers := c.swarm.Peers()
+	seeding := c.isSeeding()
+
+	unchoke := c.policy.Unchoke(c.stats(peers, seeding), seeding, rotate)
+
+	for _, p := range peers {
+		var err error
+
+		switch {
+		case unchoke[p.String()] && p.AmChoking.Load():
+			err = p.send(BuildUnchokeMessage())
+			if err == nil {
+				p.AmChoking.Store(false)
+			}
+		case !unchoke[p.String()] && !p.AmChoking.Load():
+			err = p.send(BuildChokeMessage())
+			if err == nil {
+				p.AmChoking.Store(true)
+				// requests are discarded when choked, the peer has to
+				// request again once unchoked
+				p.clearRequests()
+			}
+		}
+
+		if err != nil {
+			log.Printf("error rechoking peer %s: %v\n", p, err)
+		}
+	}
+}
+
+// stats computes the transfer rates of the peers since the last rechoke
+func (c *Choker) stats(peers []*Peer, seeding bool) []PeerStats {
+	now := time.Now()
+	elapsed := now.Sub(c.lastRechoke).Seconds()
+	c.lastRechoke = now
+
+	samples := make(map[*Peer]transferSample, len(peers))
+	stats := make([]PeerStats, 0, len(peers))
+
+	for _, p := range peers {
+		cur := transferSample{
+			downloaded: p.Downloaded.Load(),
+			uploaded:   p.Uploaded.Load(),
+		}
+		prev := c.samples[p]
+		samples[p] = cur
+
+		ps := PeerStats{
+			Addr:       p.String(),
+			Interested: p.PeerInterested.Load(),
+			Choked:     p.AmChoking.Load(),
+			// no data is expected from peers once seeding
+			Snubbed: !seeding && p.isSnubbed(),
+		}
+		if elapsed > 0 {
+			ps.DownloadRate = float64(cur.downloaded-prev.downloaded) / elapsed
+			ps.UploadRate = float64(cur.uploaded-prev.uploaded) / elapsed
+		}
+
+		stats = append(stats, ps)
+	}
+
+	// drop samples of disconnected peers
+	c.samples = samples
+
+	return stats
+}
+
+func (c *Choker) isSeeding() bool {
+	select {
+	case <-c.t.Downloader.Completed():
+		return true
+	default:
+		return false
+	}
+}
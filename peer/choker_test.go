@@ -0,0 +1,149 @@
+package peer
+
+import (
+	"math/rand"
+	"net"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTitForTatUnchoke(t *testing.T) {
+	var testCases = map[string]struct {
+		peers    []PeerStats
+		seeding  bool
+		slots    int
+		expected []string // unchoked besides the optimistic unchoke
+		choked   []string // never unchoked, not even optimistically
+	}{
+		"fastest downloaders unchoked": {
+			peers: []PeerStats{
+				{Addr: "a", Interested: true, DownloadRate: 10},
+				{Addr: "b", Interested: true, DownloadRate: 30},
+				{Addr: "c", Interested: true, DownloadRate: 20},
+			},
+			slots:    2,
+			expected: []string{"b", "c"},
+		},
+		"fastest uploads when seeding": {
+			peers: []PeerStats{
+				{Addr: "a", Interested: true, DownloadRate: 50, UploadRate: 10},
+				{Addr: "b", Interested: true, UploadRate: 30},
+				{Addr: "c", Interested: true, UploadRate: 20},
+			},
+			seeding:  true,
+			slots:    2,
+			expected: []string{"b", "c"},
+		},
+		"uninterested peers stay choked": {
+			peers: []PeerStats{
+				{Addr: "a", DownloadRate: 100},
+				{Addr: "b", Interested: true, DownloadRate: 1},
+			},
+			slots:    1,
+			expected: []string{"b"},
+			choked:   []string{"a"},
+		},
+		"snubbed peers lose their slot": {
+			peers: []PeerStats{
+				{Addr: "a", Interested: true, Snubbed: true, DownloadRate: 100},
+				{Addr: "b", Interested: true, DownloadRate: 10},
+				{Addr: "c", Interested: true, DownloadRate: 5},
+			},
+			slots:    2,
+			expected: []string{"b", "c"},
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c := NewTitForTat(test.slots)
+
+			unchoke := c.Unchoke(test.peers, test.seeding, true)
+
+			for _, addr := range test.expected {
+				if !unchoke[addr] {
+					t.Errorf("expected %s to be unchoked, got: %v", addr, unchoke)
+				}
+			}
+
+			// at most one peer is unchoked optimistically
+			var optimistic []string
+			for addr := range unchoke {
+				if !slices.Contains(test.expected, addr) {
+					optimistic = append(optimistic, addr)
+				}
+			}
+			if len(optimistic) > 1 {
+				t.Errorf("expected at most one optimistic unchoke, got: %v", optimistic)
+			}
+			for _, addr := range test.choked {
+				if unchoke[addr] {
+					t.Errorf("expected %s to stay choked", addr)
+				}
+			}
+		})
+	}
+}
+
+func TestTitForTatOptimisticRotation(t *testing.T) {
+	c := NewTitForTat(1)
+	c.rand = rand.New(rand.NewSource(1))
+
+	peers := []PeerStats{
+		{Addr: "a", Interested: true, DownloadRate: 100},
+		{Addr: "b", Interested: true},
+		{Addr: "c", Interested: true},
+	}
+
+	first := c.Unchoke(peers, false, true)
+	if len(first) != 2 || !first["a"] {
+		t.Fatalf("expected fastest and one optimistic unchoke, got: %v", first)
+	}
+	optimistic := c.optimistic
+
+	// optimistic unchoke is kept between rotations
+	if got := c.Unchoke(peers, false, false); !reflect.DeepEqual(got, first) {
+		t.Errorf("expected unchoke to be kept, expected: %v, got: %v", first, got)
+	}
+
+	// and moves to another peer on rotation
+	c.Unchoke(peers, false, true)
+	if c.optimistic == optimistic {
+		t.Errorf("expected optimistic unchoke to rotate from %s", optimistic)
+	}
+}
+
+func TestChokerStats(t *testing.T) {
+	p := NewPeer(net.ParseIP("10.0.0.1"), 6881)
+	p.AmInterested.Store(true)
+	p.lastPieceAt.Store(time.Now().Add(-2 * snubTimeout).UnixNano())
+
+	c := NewChoker(NewSwarm(), nil, NewTitForTat(DefaultUnchokeSlots))
+	c.lastRechoke = time.Now().Add(-10 * time.Second)
+
+	p.Downloaded.Store(10000)
+	p.Uploaded.Store(5000)
+
+	stats := c.stats([]*Peer{p}, false)
+	if len(stats) != 1 {
+		t.Fatalf("expected stats for 1 peer, got: %d", len(stats))
+	}
+
+	// rates are bytes/sec since the last rechoke
+	if stats[0].DownloadRate < 900 || stats[0].DownloadRate > 1000 {
+		t.Errorf("download rate mismatch, expected ~1000, got: %f", stats[0].DownloadRate)
+	}
+	if stats[0].UploadRate < 450 || stats[0].UploadRate > 500 {
+		t.Errorf("upload rate mismatch, expected ~500, got: %f", stats[0].UploadRate)
+	}
+	if !stats[0].Snubbed {
+		t.Errorf("expected peer to be snubbed")
+	}
+
+	// not snubbed when seeding as no data is expected
+	if stats := c.stats([]*Peer{p}, true); stats[0].Snubbed {
+		t.Errorf("expected peer to not be snubbed when seeding")
+	}
+}
@@ -0,0 +1,85 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// idleCheckInterval is how often the connection is checked for being idle
+const idleCheckInterval = 5 * time.Second
+
+// Timeouts configures how idle connections to peers are kept alive or dropped
+type Timeouts struct {
+	// ReadIdle is how long to wait for a message from the peer, including
+	// keep-alives, before dropping it
+	ReadIdle time.Duration
+
+	// WriteIdle is how long the connection can go without us sending any
+	// message, before a keep-alive is sent
+	WriteIdle time.Duration
+
+	// Uninterested is how long neither side can be interested in the other,
+	// before the peer is dropped to make room for useful peers
+	Uninterested time.Duration
+}
+
+// DefaultTimeouts are used unless configured on the swarm. Peers commonly
+// drop connections which are silent for two minutes, so keep-alives are
+// sent well within that, and we wait a little longer for theirs
+var DefaultTimeouts = Timeouts{
+	ReadIdle:     3 * time.Minute,
+	WriteIdle:    1 * time.Minute,
+	Uninterested: 5 * time.Minute,
+}
+
+// idleWatcher keeps the connection to a peer alive while we have nothing
+// to send, and tells when the peer is of no use to either side
+type idleWatcher struct {
+	p                 *Peer
+	timeouts          Timeouts
+	uninterestedSince time.Time // zero while either side is interested
+}
+
+// watchIdle sends keep-alives to the peer, and cancels the connection once
+// neither side is interested for too long, until ctx is cancelled
+func watchIdle(ctx context.Context, cancel context.CancelFunc, p *Peer) {
+	w := &idleWatcher{p: p, timeouts: p.timeouts()}
+
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.check(); err != nil {
+				log.Printf("dropping peer %s: %v\n", p, err)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// check sends a keep-alive if nothing was sent for WriteIdle, and returns
+// an error if the peer should be dropped
+func (w *idleWatcher) check() error {
+	if w.p.AmInterested.Load() || w.p.PeerInterested.Load() {
+		w.uninterestedSince = time.Time{}
+	} else if w.uninterestedSince.IsZero() {
+		w.uninterestedSince = time.Now()
+	} else if time.Since(w.uninterestedSince) > w.timeouts.Uninterested {
+		return fmt.Errorf("not interested in each other for %v", w.timeouts.Uninterested)
+	}
+
+	if w.p.sinceLastWrite() >= w.timeouts.WriteIdle {
+		if err := w.p.send(BuildKeepAliveMessage()); err != nil {
+			return fmt.Errorf("error sending keep-alive: %w", err)
+		}
+	}
+
+	return nil
+}
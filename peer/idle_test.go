@@ -0,0 +1,97 @@
+package peer
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIdleWatcherCheck(t *testing.T) {
+	timeouts := Timeouts{
+		ReadIdle:     time.Minute,
+		WriteIdle:    time.Minute,
+		Uninterested: time.Minute,
+	}
+
+	var testCases = map[string]struct {
+		sinceLastWrite    time.Duration
+		interested        bool
+		uninterestedSince time.Duration // zero if not yet uninterested
+		expectedKeepAlive bool
+		expectedDrop      bool
+	}{
+		"recently written": {
+			sinceLastWrite: 10 * time.Second,
+			interested:     true,
+		},
+		"idle connection": {
+			sinceLastWrite:    2 * time.Minute,
+			interested:        true,
+			expectedKeepAlive: true,
+		},
+		"just uninterested": {
+			sinceLastWrite: 10 * time.Second,
+		},
+		"uninterested for too long": {
+			sinceLastWrite:    2 * time.Minute,
+			uninterestedSince: 2 * time.Minute,
+			expectedDrop:      true,
+		},
+		"interested again": {
+			sinceLastWrite:    10 * time.Second,
+			interested:        true,
+			uninterestedSince: 2 * time.Minute,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			p := NewPeer(net.ParseIP("10.0.0.1"), 6881)
+
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			p.Conn = c1
+			startWriter(t, p, nil)
+
+			p.lastWriteAt.Store(time.Now().Add(-test.sinceLastWrite).UnixNano())
+			p.AmInterested.Store(test.interested)
+
+			w := &idleWatcher{p: p, timeouts: timeouts}
+			if test.uninterestedSince > 0 {
+				w.uninterestedSince = time.Now().Add(-test.uninterestedSince)
+			}
+
+			// Read whatever is sent while checking
+			got := make(chan []byte, 1)
+			go func() {
+				msg := make([]byte, 4)
+				c2.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+				if _, err := io.ReadFull(c2, msg); err != nil {
+					got <- nil
+					return
+				}
+				got <- msg
+			}()
+
+			err := w.check()
+			if test.expectedDrop != (err != nil) {
+				t.Errorf("drop mismatch, expected: %v, got err: %v", test.expectedDrop, err)
+			}
+
+			msg := <-got
+			if test.expectedKeepAlive != (msg != nil) {
+				t.Fatalf("keep-alive mismatch, expected: %v, got: %v", test.expectedKeepAlive, msg)
+			}
+			if msg != nil && !bytes.Equal(msg, BuildKeepAliveMessage()) {
+				t.Errorf("keep-alive message mismatch, expected: %v, got: %v", BuildKeepAliveMessage(), msg)
+			}
+
+			if test.interested && !w.uninterestedSince.IsZero() {
+				t.Errorf("expected uninterested time to be reset")
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"my-bittorrent/torrent"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Listener accepts connections initiated by peers, performs the responder
+// side of the handshake and hands over the peer to onPeer
+type Listener struct {
+	ln       net.Listener
+	mu       sync.Mutex                    // To synchronize access to torrents
+	torrents map[[20]byte]*torrent.Torrent // Active torrents by info hash
+	onPeer   func(p *Peer, t *torrent.Torrent)
+
+	// Half-open slot taken before the handshake of a connection, and
+	// released if the handshake fails. Connections are not limited if nil
+	reserve func() bool
+	release func()
+}
+
+// Listen starts listening for peers on the given port on all interfaces.
+// onPeer is called for every peer whose handshake succeeds, with the torrent
+// the peer asked for
+func Listen(port int, onPeer func(p *Peer, t *torrent.Torrent)) (*Listener, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %d: %w", port, err)
+	}
+
+	log.Printf("listening for peers on %s\n", ln.Addr().String())
+
+	return &Listener{
+		ln:       ln,
+		torrents: make(map[[20]byte]*torrent.Torrent),
+		onPeer:   onPeer,
+	}, nil
+}
+
+// LimitHalfOpen makes the connections wait for a half-open slot from reserve
+// before their handshake is read, connections are closed if there is none.
+// The slot is released with release if the handshake fails, it is handed
+// over to onPeer otherwise
+func (l *Listener) LimitHalfOpen(reserve func() bool, release func()) {
+	l.reserve = reserve
+	l.release = release
+}
+
+// Addr returns the address the listener is listening on
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// AddTorrent allows peers to connect for the torrent
+func (l *Listener) AddTorrent(t *torrent.Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.torrents[t.InfoHash] = t
+}
+
+// RemoveTorrent stops accepting peers for the torrent
+func (l *Listener) RemoveTorrent(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.torrents, infoHash)
+}
+
+func (l *Listener) getTorrent(infoHash [20]byte) (*torrent.Torrent, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	t, ok := l.torrents[infoHash]
+	return t, ok
+}
+
+// Serve accepts connections until ctx is cancelled. It returns once the
+// listener is closed and all pending handshakes are done
+func (l *Listener) Serve(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Close the listener to unblock Accept
+	go func() {
+		<-ctx.Done()
+		l.ln.Close()
+	}()
+
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Println("stopped listening for peers")
+				return
+			}
+
+			log.Printf("error accepting connection: %v\n", err)
+			continue
+		}
+
+		if l.reserve != nil && !l.reserve() {
+			log.Printf("refused connection from %s: too many half-open connections\n", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := l.handleConn(ctx, conn); err != nil {
+				log.Printf("error in handshake with %s: %v\n", conn.RemoteAddr().String(), err)
+				conn.Close()
+				if l.release != nil {
+					l.release()
+				}
+			}
+		}()
+	}
+}
+
+// handleConn reads the handshake of the peer, and replies with our handshake
+// if the info hash matches one of the active torrents
+func (l *Listener) handleConn(ctx context.Context, conn net.Conn) error {
+	msg, err := ReadHandshakeMessage(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	// handshake: <pstrlen><pstr><reserved><info_hash><peer_id>
+	pstrlen := len(ProtocolIdentifier)
+	infoHashStart := 1 + pstrlen + 8
+
+	var infoHash [20]byte
+	copy(infoHash[:], msg[infoHashStart:infoHashStart+20])
+
+	t, ok := l.getTorrent(infoHash)
+	if !ok {
+		return fmt.Errorf("unknown info_hash: %x", infoHash)
+	}
+
+	if err := IsHandshakeMessageValid(msg, t.InfoHash); err != nil {
+		return err
+	}
+
+	handshakeMsg, err := BuildHandshakeMessage(t.InfoHash)
+	if err != nil {
+		return fmt.Errorf("error building handshake msg: %w", err)
+	}
+
+	if err := SendMessage(conn, handshakeMsg); err != nil {
+		return err
+	}
+
+	addr := conn.RemoteAddr().(*net.TCPAddr)
+
+	p := NewPeer(addr.IP, uint16(addr.Port))
+	p.Conn = conn
+	p.Inbound = true
+	copy(p.ID[:], msg[infoHashStart+20:infoHashStart+40])
+
+	log.Printf("accepted connection from peer %s\n", p)
+
+	l.onPeer(p, t)
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"my-bittorrent/torrent"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListenerHandshake(t *testing.T) {
+	infoHash := [20]byte{0xc9, 0xe1, 0x57, 0x63}
+	remoteID := [20]byte{'-', 'T', 'R', '3', '0', '0', '0', '-'}
+
+	peersCh := make(chan *Peer, 1)
+
+	l, err := Listen(0, func(p *Peer, tr *torrent.Torrent) {
+		if tr.InfoHash != infoHash {
+			t.Errorf("torrent mismatch, got info_hash: %x", tr.InfoHash)
+		}
+		peersCh <- p
+	})
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	l.AddTorrent(&torrent.Torrent{InfoHash: infoHash})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.Serve(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	// remote peer sends its handshake first
+	handshakeMsg, _ := BuildHandshakeMessage(infoHash)
+	copy(handshakeMsg[len(handshakeMsg)-20:], remoteID[:])
+	if _, err := conn.Write(handshakeMsg); err != nil {
+		t.Fatalf("error sending handshake: %v", err)
+	}
+
+	// and receives ours in reply
+	reply := make([]byte, len(handshakeMsg))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("error reading handshake reply: %v", err)
+	}
+
+	if err := IsHandshakeMessageValid(reply, infoHash); err != nil {
+		t.Errorf("invalid handshake reply: %v", err)
+	}
+	if !bytes.Equal(reply[len(reply)-20:], PeerID[:]) {
+		t.Errorf("peer ID mismatch in reply, expected: %x, got: %x", PeerID, reply[len(reply)-20:])
+	}
+
+	select {
+	case p := <-peersCh:
+		if !p.Inbound {
+			t.Errorf("expected inbound peer")
+		}
+		if p.ID != remoteID {
+			t.Errorf("remote peer ID mismatch, expected: %x, got: %x", remoteID, p.ID)
+		}
+		p.Conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("peer not handed over")
+	}
+}
+
+func TestListenerUnknownInfoHash(t *testing.T) {
+	l, err := Listen(0, func(p *Peer, tr *torrent.Torrent) {
+		t.Errorf("unexpected peer for unknown torrent")
+	})
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	l.AddTorrent(&torrent.Torrent{InfoHash: [20]byte{1}})
+
+	var halfOpen atomic.Int32
+	l.LimitHalfOpen(func() bool {
+		halfOpen.Add(1)
+		return true
+	}, func() {
+		halfOpen.Add(-1)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.Serve(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	handshakeMsg, _ := BuildHandshakeMessage([20]byte{2})
+	if _, err := conn.Write(handshakeMsg); err != nil {
+		t.Fatalf("error sending handshake: %v", err)
+	}
+
+	// connection is closed without a reply
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected connection to be closed, got: %v", err)
+	}
+
+	// half-open slot is released once the handshake failed
+	cancel()
+	<-done
+	if got := halfOpen.Load(); got != 0 {
+		t.Errorf("half-open mismatch, expected: 0, got: %d", got)
+	}
+}
+
+func TestListenerHalfOpenLimit(t *testing.T) {
+	l, err := Listen(0, func(p *Peer, tr *torrent.Torrent) {
+		t.Errorf("unexpected peer beyond the half-open limit")
+	})
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	l.AddTorrent(&torrent.Torrent{InfoHash: [20]byte{1}})
+	l.LimitHalfOpen(func() bool { return false }, func() {
+		t.Errorf("unexpected release of a slot which was not reserved")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.Serve(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	// connection is closed before the handshake is read
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected connection to be closed, got: %v", err)
+	}
+}
@@ -0,0 +1,412 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"my-bittorrent/torrent"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMaxConns is the default cap on the connections to peers, half-open
+// connections included
+const DefaultMaxConns = 50
+
+// DefaultMaxHalfOpen is the default cap on the connections which are being
+// dialed or handshaken
+const DefaultMaxHalfOpen = 8
+
+// maxCandidates is the number of peers kept to connect to, peers received
+// beyond it are dropped
+const maxCandidates = 1000
+
+// dialInterval is how often the candidates are dialed, when not woken up
+// by new candidates or dropped connections
+const dialInterval = 1 * time.Second
+
+// dialBackoff is how long to wait before dialing a candidate again after a
+// failure, doubled on every consecutive failure up to maxDialBackoff. The
+// candidate is dropped after maxDialFailures consecutive failures
+const (
+	dialBackoff     = 30 * time.Second
+	maxDialBackoff  = 10 * time.Minute
+	maxDialFailures = 5
+)
+
+// reconnectDelay is how long to wait before connecting again to a peer which
+// sent us blocks and dropped
+const reconnectDelay = 10 * time.Second
+
+// banThreshold is the number of protocol violations after which the IP
+// address is banned
+const banThreshold = 3
+
+var (
+	errBanned       = errors.New("address is banned")
+	errSelf         = errors.New("connected to ourselves")
+	errDuplicate    = errors.New("already connected")
+	errTooManyConns = errors.New("too many connections")
+	errClosed       = errors.New("connection manager is closed")
+)
+
+// ConnManager keeps the connections to the peers of a torrent. It dials the
+// candidate peers received from trackers with backoff, reconnects to good
+// peers which drop, and accepts peers which connect to us, within the
+// connection limits. Addresses which repeatedly violate the protocol are
+// banned
+type ConnManager struct {
+	MaxConns    int // MaxConns caps the connections to peers, half-open included
+	MaxHalfOpen int // MaxHalfOpen caps the connections being dialed or handshaken
+
+	swarm        *Swarm
+	t            *torrent.Torrent
+	handshakeMsg []byte
+	dial         func(p *Peer) (net.Conn, error)
+
+	mu         sync.Mutex            // To synchronize access to the fields below
+	candidates map[string]*candidate // peers to connect to, by address
+	conns      map[string]*Peer      // connected peers, by address
+	ids        map[[20]byte]*Peer    // connected peers, by peer ID
+	halfOpen   int                   // connections being dialed or handshaken
+	strikes    map[string]int        // protocol violations, by IP address
+	banned     map[string]bool       // banned IP addresses
+	self       map[string]bool       // addresses which turned out to be us
+	closed     bool                  // no connections are made once closed
+
+	wakeCh chan struct{} // To wake up dialing
+	wg     sync.WaitGroup
+}
+
+// candidate is a peer to connect to
+type candidate struct {
+	ip       net.IP
+	port     uint16
+	failures int       // consecutive failures to connect or to be useful
+	nextDial time.Time // candidate is not dialed before nextDial
+	busy     bool      // true while being dialed or connected
+}
+
+func NewConnManager(swarm *Swarm, t *torrent.Torrent) (*ConnManager, error) {
+	handshakeMsg, err := BuildHandshakeMessage(t.InfoHash)
+	if err != nil {
+		return nil, fmt.Errorf("error building handshake msg: %w", err)
+	}
+
+	return &ConnManager{
+		MaxConns:     DefaultMaxConns,
+		MaxHalfOpen:  DefaultMaxHalfOpen,
+		swarm:        swarm,
+		t:            t,
+		handshakeMsg: handshakeMsg,
+		dial:         ConnectTCP,
+		candidates:   make(map[string]*candidate),
+		conns:        make(map[string]*Peer),
+		ids:          make(map[[20]byte]*Peer),
+		strikes:      make(map[string]int),
+		banned:       make(map[string]bool),
+		self:         make(map[string]bool),
+		wakeCh:       make(chan struct{}, 1),
+	}, nil
+}
+
+// AddCandidates adds peers to connect to, peers which are already known,
+// banned or ourselves are skipped
+func (m *ConnManager) AddCandidates(peers []*Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	added := 0
+	for _, p := range peers {
+		addr := p.String()
+
+		if len(m.candidates) >= maxCandidates {
+			break
+		}
+		if m.candidates[addr] != nil || m.self[addr] || m.banned[p.IPAddress.String()] {
+			continue
+		}
+
+		m.candidates[addr] = &candidate{ip: p.IPAddress, port: p.Port}
+		added++
+	}
+
+	log.Printf("added %d new candidate peers, total: %d\n", added, len(m.candidates))
+
+	m.wake()
+}
+
+// ReserveHalfOpen takes a half-open slot for a connection initiated by a
+// peer, before its handshake is read. It returns false if there is no room
+// for the connection. The slot is handed over to Accept once the handshake
+// is complete, it must be released with ReleaseHalfOpen otherwise
+func (m *ConnManager) ReserveHalfOpen() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed || m.halfOpen >= m.MaxHalfOpen || m.halfOpen+len(m.conns) >= m.MaxConns {
+		return false
+	}
+	m.halfOpen++
+
+	return true
+}
+
+// ReleaseHalfOpen releases a half-open slot taken with ReserveHalfOpen, for
+// a connection whose handshake failed
+func (m *ConnManager) ReleaseHalfOpen() {
+	m.mu.Lock()
+	m.halfOpen--
+	m.mu.Unlock()
+
+	m.wake()
+}
+
+// Accept serves a peer which connected to us and completed the handshake,
+// the connection is closed if the peer is refused. The peer holds the
+// half-open slot taken with ReserveHalfOpen, which is released
+func (m *ConnManager) Accept(ctx context.Context, p *Peer) {
+	m.mu.Lock()
+	m.halfOpen--
+	err := m.register(p)
+	if err == nil {
+		m.wg.Add(1)
+	}
+	m.mu.Unlock()
+
+	if err != nil {
+		log.Printf("refused connection from %s: %v\n", p, err)
+		p.Conn.Close()
+		m.wake()
+		return
+	}
+
+	go func() {
+		defer m.wg.Done()
+		m.serve(ctx, p, nil)
+	}()
+}
+
+// Run dials the candidates until ctx is cancelled, it returns once all the
+// connections are closed
+func (m *ConnManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(dialInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			m.mu.Lock()
+			m.closed = true
+			m.mu.Unlock()
+
+			m.wg.Wait()
+			return
+		case <-ticker.C:
+		case <-m.wakeCh:
+		}
+
+		m.mu.Lock()
+		m.dialCandidates(ctx)
+		m.mu.Unlock()
+	}
+}
+
+// Banned returns true if the IP address is banned
+func (m *ConnManager) Banned(ip net.IP) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.banned[ip.String()]
+}
+
+// dialCandidates starts connecting to the candidates which are due, within
+// the connection limits. It must be called with mu held
+func (m *ConnManager) dialCandidates(ctx context.Context) {
+	now := time.Now()
+
+	for addr, c := range m.candidates {
+		if m.halfOpen >= m.MaxHalfOpen || m.halfOpen+len(m.conns) >= m.MaxConns {
+			return
+		}
+
+		if c.busy || now.Before(c.nextDial) || m.conns[addr] != nil {
+			continue
+		}
+
+		c.busy = true
+		m.halfOpen++
+		m.wg.Add(1)
+
+		go m.connect(ctx, addr, c)
+	}
+}
+
+// connect dials the candidate and exchanges handshakes, the peer is served
+// until disconnected
+func (m *ConnManager) connect(ctx context.Context, addr string, c *candidate) {
+	defer m.wg.Done()
+
+	p, err := m.handshake(ctx, c)
+
+	m.mu.Lock()
+	m.halfOpen--
+	if err == nil {
+		err = m.register(p)
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, errSelf):
+			m.self[addr] = true
+			delete(m.candidates, addr)
+		case errors.Is(err, errDuplicate), errors.Is(err, errBanned):
+			delete(m.candidates, addr)
+		default:
+			if errors.Is(err, errProtocol) {
+				m.strike(c.ip.String(), 1)
+			}
+			m.failed(addr, c)
+		}
+		m.mu.Unlock()
+
+		log.Printf("failed to connect to peer %s: %v\n", addr, err)
+		if p != nil {
+			p.Conn.Close()
+		}
+		m.wake()
+		return
+	}
+	m.mu.Unlock()
+
+	m.serve(ctx, p, c)
+}
+
+// handshake connects to the candidate and exchanges handshakes with it
+func (m *ConnManager) handshake(ctx context.Context, c *candidate) (*Peer, error) {
+	p := NewPeer(c.ip, c.port)
+
+	conn, err := m.dial(p)
+	if err != nil {
+		return nil, err
+	}
+	p.Conn = conn
+
+	if err := SendMessage(conn, m.handshakeMsg); err != nil {
+		return p, err
+	}
+
+	msg, err := ReadHandshakeMessage(ctx, conn)
+	if err != nil {
+		return p, err
+	}
+
+	if err := IsHandshakeMessageValid(msg, m.t.InfoHash); err != nil {
+		return p, fmt.Errorf("%w: %v", errProtocol, err)
+	}
+
+	copy(p.ID[:], msg[48:68])
+
+	return p, nil
+}
+
+// register adds a peer whose handshake is complete to the connected peers,
+// unless it is banned, ourselves, already connected or there is no room for
+// it. It must be called with mu held
+func (m *ConnManager) register(p *Peer) error {
+	switch {
+	case m.closed:
+		return errClosed
+	case m.banned[p.IPAddress.String()]:
+		return errBanned
+	case p.ID == PeerID:
+		return errSelf
+	case m.conns[p.String()] != nil, m.ids[p.ID] != nil:
+		return errDuplicate
+	case m.halfOpen+len(m.conns) >= m.MaxConns:
+		return errTooManyConns
+	}
+
+	m.conns[p.String()] = p
+	m.ids[p.ID] = p
+
+	return nil
+}
+
+// serve receives messages from the peer until it disconnects. Candidate is
+// nil for peers which connected to us, as they can't be connected to again
+func (m *ConnManager) serve(ctx context.Context, p *Peer, c *candidate) {
+	log.Printf("START: receive messages from %s\n", p)
+	m.swarm.ReceiveMessages(ctx, p, m.t)
+	log.Printf("END: receive messages from %s\n", p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.conns, p.String())
+	if m.ids[p.ID] == p {
+		delete(m.ids, p.ID)
+	}
+
+	if n := int(p.misbehaved.Load()); n > 0 {
+		m.strike(p.IPAddress.String(), n)
+	}
+
+	if c != nil && m.candidates[p.String()] == c {
+		// Good peers are reconnected to shortly, others are backed off
+		if m.banned[p.IPAddress.String()] {
+			delete(m.candidates, p.String())
+		} else if p.Downloaded.Load() > 0 && p.misbehaved.Load() == 0 {
+			c.failures = 0
+			c.busy = false
+			c.nextDial = time.Now().Add(reconnectDelay)
+		} else {
+			m.failed(p.String(), c)
+		}
+	}
+
+	m.wake()
+}
+
+// failed backs off the candidate after a failure, it is dropped after too
+// many consecutive failures. It must be called with mu held
+func (m *ConnManager) failed(addr string, c *candidate) {
+	c.busy = false
+	c.failures++
+
+	if c.failures >= maxDialFailures {
+		delete(m.candidates, addr)
+		return
+	}
+
+	backoff := min(dialBackoff<<(c.failures-1), maxDialBackoff)
+	c.nextDial = time.Now().Add(backoff)
+}
+
+// strike counts protocol violations of the IP address, which is banned once
+// they reach banThreshold. It must be called with mu held
+func (m *ConnManager) strike(ip string, n int) {
+	m.strikes[ip] += n
+	if m.strikes[ip] < banThreshold || m.banned[ip] {
+		return
+	}
+
+	log.Printf("banning %s after %d protocol violations\n", ip, m.strikes[ip])
+	m.banned[ip] = true
+
+	for addr, c := range m.candidates {
+		if c.ip.String() == ip && !c.busy {
+			delete(m.candidates, addr)
+		}
+	}
+}
+
+// wake wakes up dialing without blocking, a pending wake up is enough
+func (m *ConnManager) wake() {
+	select {
+	case m.wakeCh <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,268 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"my-bittorrent/torrent"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestConnManager(t *testing.T) *ConnManager {
+	m, err := NewConnManager(NewSwarm(), &torrent.Torrent{})
+	if err != nil {
+		t.Fatalf("error creating connection manager: %v", err)
+	}
+
+	return m
+}
+
+func TestConnManagerRegister(t *testing.T) {
+	// make sure our peer ID differs from the other peers
+	defer func(id [20]byte) { PeerID = id }(PeerID)
+	PeerID = [20]byte{0xff}
+
+	connected := NewPeer(net.ParseIP("10.0.0.1"), 6881)
+	connected.ID = [20]byte{1}
+
+	var testCases = map[string]struct {
+		ip            string
+		id            [20]byte
+		maxConns      int
+		expectedError error
+	}{
+		"new peer": {
+			ip:       "10.0.0.2",
+			id:       [20]byte{2},
+			maxConns: 2,
+		},
+		"banned": {
+			ip:            "10.0.0.9",
+			id:            [20]byte{2},
+			maxConns:      2,
+			expectedError: errBanned,
+		},
+		"ourselves": {
+			ip:            "10.0.0.2",
+			id:            PeerID,
+			maxConns:      2,
+			expectedError: errSelf,
+		},
+		"same address": {
+			ip:            "10.0.0.1",
+			id:            [20]byte{2},
+			maxConns:      2,
+			expectedError: errDuplicate,
+		},
+		"same peer ID": {
+			ip:            "10.0.0.2",
+			id:            [20]byte{1},
+			maxConns:      2,
+			expectedError: errDuplicate,
+		},
+		"too many connections": {
+			ip:            "10.0.0.2",
+			id:            [20]byte{2},
+			maxConns:      1,
+			expectedError: errTooManyConns,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := newTestConnManager(t)
+			m.MaxConns = test.maxConns
+			m.banned["10.0.0.9"] = true
+
+			if err := m.register(connected); err != nil {
+				t.Fatalf("error registering connected peer: %v", err)
+			}
+
+			p := NewPeer(net.ParseIP(test.ip), 6881)
+			p.ID = test.id
+
+			err := m.register(p)
+			if !errors.Is(err, test.expectedError) {
+				t.Errorf("expected error: %v, got: %v", test.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestConnManagerAddCandidates(t *testing.T) {
+	m := newTestConnManager(t)
+	m.banned["10.0.0.9"] = true
+	m.self["10.0.0.8:6881"] = true
+
+	m.AddCandidates([]*Peer{
+		NewPeer(net.ParseIP("10.0.0.1"), 6881),
+		NewPeer(net.ParseIP("10.0.0.1"), 6881),
+		NewPeer(net.ParseIP("10.0.0.1"), 6882),
+		NewPeer(net.ParseIP("10.0.0.8"), 6881),
+		NewPeer(net.ParseIP("10.0.0.9"), 6881),
+	})
+
+	if len(m.candidates) != 2 {
+		t.Errorf("candidates mismatch, expected: 2, got: %d", len(m.candidates))
+	}
+}
+
+func TestConnManagerFailed(t *testing.T) {
+	m := newTestConnManager(t)
+	m.AddCandidates([]*Peer{NewPeer(net.ParseIP("10.0.0.1"), 6881)})
+
+	addr := "10.0.0.1:6881"
+	c := m.candidates[addr]
+
+	// backoff doubles on every consecutive failure
+	expected := dialBackoff
+	for i := 1; i < maxDialFailures; i++ {
+		c.busy = true
+		m.failed(addr, c)
+
+		if c.busy {
+			t.Errorf("expected candidate to be available after failure")
+		}
+
+		backoff := time.Until(c.nextDial)
+		if backoff > expected || backoff < expected-time.Second {
+			t.Errorf("failure %d: backoff mismatch, expected: %v, got: %v", i, expected, backoff)
+		}
+
+		expected = min(expected*2, maxDialBackoff)
+	}
+
+	// dropped after too many failures
+	m.failed(addr, c)
+	if m.candidates[addr] != nil {
+		t.Errorf("expected candidate to be dropped after %d failures", maxDialFailures)
+	}
+}
+
+func TestConnManagerStrike(t *testing.T) {
+	m := newTestConnManager(t)
+	m.AddCandidates([]*Peer{
+		NewPeer(net.ParseIP("10.0.0.1"), 6881),
+		NewPeer(net.ParseIP("10.0.0.1"), 6882),
+		NewPeer(net.ParseIP("10.0.0.2"), 6881),
+	})
+
+	for i := 0; i < banThreshold-1; i++ {
+		m.strike("10.0.0.1", 1)
+	}
+	if m.Banned(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("expected address not to be banned before %d violations", banThreshold)
+	}
+
+	m.strike("10.0.0.1", 1)
+	if !m.Banned(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("expected address to be banned after %d violations", banThreshold)
+	}
+
+	// candidates of the banned address are dropped
+	if len(m.candidates) != 1 || m.candidates["10.0.0.2:6881"] == nil {
+		t.Errorf("expected only the candidate of the other address, got: %v", m.candidates)
+	}
+}
+
+func TestConnManagerDialLimits(t *testing.T) {
+	m := newTestConnManager(t)
+	m.MaxHalfOpen = 2
+
+	// dials block until released, and then fail
+	dialing := make(chan struct{}, 10)
+	release := make(chan struct{})
+	m.dial = func(p *Peer) (net.Conn, error) {
+		dialing <- struct{}{}
+		<-release
+		return nil, errors.New("connection refused")
+	}
+
+	for i := 1; i <= 5; i++ {
+		m.AddCandidates([]*Peer{NewPeer(net.IPv4(10, 0, 0, byte(i)), 6881)})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m.mu.Lock()
+	m.dialCandidates(ctx)
+	m.mu.Unlock()
+
+	for i := 0; i < 2; i++ {
+		<-dialing
+	}
+
+	m.mu.Lock()
+	if m.halfOpen != 2 {
+		t.Errorf("half-open mismatch, expected: 2, got: %d", m.halfOpen)
+	}
+	m.mu.Unlock()
+
+	// no more dials while at the limit
+	select {
+	case <-dialing:
+		t.Errorf("expected no more than %d dials", m.MaxHalfOpen)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	m.wg.Wait()
+
+	// failed candidates are backed off
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	failed := 0
+	for _, c := range m.candidates {
+		if c.failures == 1 {
+			failed++
+		}
+	}
+
+	if m.halfOpen != 0 || failed != 2 {
+		t.Errorf("expected 2 failed candidates and no half-open, got: %d failed, %d half-open", failed, m.halfOpen)
+	}
+}
+
+func TestConnManagerReserveHalfOpen(t *testing.T) {
+	m := newTestConnManager(t)
+	m.MaxHalfOpen = 2
+	m.banned["10.0.0.9"] = true
+
+	for i := 0; i < m.MaxHalfOpen; i++ {
+		if !m.ReserveHalfOpen() {
+			t.Fatalf("expected half-open slot %d to be reserved", i)
+		}
+	}
+	if m.ReserveHalfOpen() {
+		t.Errorf("expected no more than %d half-open slots", m.MaxHalfOpen)
+	}
+
+	// inbound handshakes count towards the dials too
+	m.AddCandidates([]*Peer{NewPeer(net.ParseIP("10.0.0.1"), 6881)})
+	m.mu.Lock()
+	m.dialCandidates(context.Background())
+	busy := m.candidates["10.0.0.1:6881"].busy
+	m.mu.Unlock()
+	if busy {
+		t.Errorf("expected no dial while inbound connections are half-open")
+	}
+
+	// slot is released when the handshake fails
+	m.ReleaseHalfOpen()
+
+	// and when the peer is accepted, even if it is refused
+	p := NewPeer(net.ParseIP("10.0.0.9"), 6881)
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p.Conn = c1
+	m.Accept(context.Background(), p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.halfOpen != 0 {
+		t.Errorf("half-open mismatch, expected: 0, got: %d", m.halfOpen)
+	}
+}
@@ -1,6 +1,7 @@
 package peer
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"log"
@@ -8,58 +9,32 @@ import (
 	"my-bittorrent/torrent"
 )
 
-func chokeMsgHandler(p *Peer) error {
+func chokeMsgHandler(p *Peer, t *torrent.Torrent) error {
 	fmt.Printf("CHOKE message received from: %s\n", p.Conn.RemoteAddr().String())
-	// close the connection
-	// return p.Conn.Close()
-	p.AmChoked = true
-	return nil
-}
-
-func unchokeMsgHandler(p *Peer, t *torrent.Torrent) error {
-	log.Printf("UNCHOKE message received from: %s\n", p.Conn.RemoteAddr().String())
 
-	p.AmChoked = false
+	p.PeerChoking.Store(true)
 
-	// Request a piece upon unchoking
-	// It is possible that TaskQueue is filled with blocks but the client
-	// was choked before it could request for all the blocks,
-	// hence when client gets unchoked again, request for blocks
-	err := requestOnePiece(p, t.Downloader)
-	if err != nil {
-		return fmt.Errorf("error requesting one piece: %w", err)
+	// Peer discards our pending requests when it chokes us, the blocks
+	// are requested again from other peers
+	released := t.Downloader.ReleasePeer(p.String())
+	if len(released) > 0 {
+		log.Printf("released %d blocks in flight to %s\n", len(released), p)
+		wakePeers(p, t)
 	}
 
 	return nil
 }
 
-func requestOnePiece(p *Peer, d *torrent.Downloader) error {
-	if p.AmChoked {
-		return fmt.Errorf("cannot request for piece as peer choking: %s", p.Conn.RemoteAddr().String())
-	}
-
-	// Among pieces that the peer has, find a piece which is needed
-	// and request for it
-	for !p.TaskQueue.IsEmpty() {
-		var b *queue.Block = p.TaskQueue.Pop()
-
-		if !d.IsNeeded(b) {
-			continue
-		}
-
-		err := SendMessage(p.Conn, BuildRequestMessage(b.PieceIdx, b.BlockOffset, b.BlockLength))
-		if err != nil {
-			return fmt.Errorf("error sending message: %w", err)
-		}
-
-		d.Requested(b)
+func unchokeMsgHandler(p *Peer, t *torrent.Torrent) error {
+	log.Printf("UNCHOKE message received from: %s\n", p.Conn.RemoteAddr().String())
 
-		fmt.Printf("requested [piece][block] [%d][%d] from: %s\n", b.PieceIdx, d.BlockIdx(b), p.Conn.RemoteAddr().String())
+	p.PeerChoking.Store(false)
 
-		// break since we are requesting for only one piece
-		// Following strategy to request pieces from peer with highest upload rate,
-		// rest of the pieces will be requested when response for this piece is received
-		break
+	// Start requesting upon unchoking, blocks which were in flight when
+	// the peer choked us are picked again
+	err := fillPipeline(p, t)
+	if err != nil {
+		return fmt.Errorf("error requesting blocks: %w", err)
 	}
 
 	return nil
@@ -69,25 +44,28 @@ func haveMsgHandler(payload []byte, p *Peer, t *torrent.Torrent) error {
 	fmt.Printf("HAVE message received from %s\n", p.Conn.RemoteAddr().String())
 
 	if len(payload) != 4 {
-		return fmt.Errorf("payload for have message should be 4 bytes, got %d", payload)
+		return fmt.Errorf("%w: payload for have message should be 4 bytes, got %d", errProtocol, len(payload))
 	}
 
 	// payload contains the piece index
 	pi := binary.BigEndian.Uint32(payload)
 	pieceIdx := int(pi)
 
+	if pieceIdx >= t.PiecesCount {
+		return fmt.Errorf("%w: invalid piece index in have message: %d", errProtocol, pieceIdx)
+	}
+
 	fmt.Println("HAVE: ", pieceIdx)
 
-	e := p.TaskQueue.IsEmpty()
+	addPiece(pieceIdx, p, t)
 
-	err := enqueueBlocksForPiece(pieceIdx, p, t)
-	if err != nil {
-		return fmt.Errorf("error enqueuing blocks for piece: %d, error: %w", pieceIdx, err)
+	if err := updateInterest(p, t); err != nil {
+		return err
 	}
 
-	// if Task queue was empty, request a piece to start receiving pieces
-	if e {
-		return requestOnePiece(p, t.Downloader)
+	// Fill the pipeline with the blocks of the new pieces
+	if !p.PeerChoking.Load() {
+		return fillPipeline(p, t)
 	}
 
 	return nil
@@ -96,87 +74,101 @@ func haveMsgHandler(payload []byte, p *Peer, t *torrent.Torrent) error {
 func bitfieldMsgHandler(payload []byte, p *Peer, t *torrent.Torrent) error {
 	log.Printf("BITFIELD message received, with len: %d, from peer: %s", len(payload), p.Conn.RemoteAddr().String())
 
-	var pieceIndices []int
-
-	// Process byte by byte
-	for i, b := range payload {
-		adder := i * 8
-		// Check all the 8 bits
-		for i := 0; i < 8; i++ {
-			// check if bit is set
-			if (1<<i)&b > 0 {
-				// index in current byte = 8 - i, since MSB denotes lower index
-				idx := 7 - i
-				pieceIndices = append(pieceIndices, adder+idx)
-			}
-		}
+	bf, err := torrent.DecodeBitfield(payload, t.PiecesCount)
+	if err != nil {
+		return fmt.Errorf("%w: invalid bitfield: %v", errProtocol, err)
 	}
 
-	// fmt.Println("BITFIELD decoded indices: ", pieceIndices)
+	bf.ForEach(func(pieceIdx int) {
+		addPiece(pieceIdx, p, t)
+	})
 
-	e := p.TaskQueue.IsEmpty()
-
-	// Enqueue all the blocks for the pieces received in bifield
-	for i := 0; i < len(pieceIndices); i++ {
-		err := enqueueBlocksForPiece(i, p, t)
-		if err != nil {
-			return fmt.Errorf("error pushing blocks in queue: %w", err)
-		}
+	if err := updateInterest(p, t); err != nil {
+		return err
 	}
 
-	// if Task queue was empty, request a piece to start receiving pieces
-	if e {
-		return requestOnePiece(p, t.Downloader)
+	// Fill the pipeline with the blocks of the new pieces
+	if !p.PeerChoking.Load() {
+		return fillPipeline(p, t)
 	}
 
 	return nil
 }
 
-// enqueueBlocksForPiece pushes all the blocks for a pieces in the queue for a peer
-// this function is triggered when have and bitfield messages are received
-func enqueueBlocksForPiece(pieceIdx int, p *Peer, t *torrent.Torrent) error {
-	// Enqueue all the blocks for this piece
-	blocks, err := t.GetBlocksCount(pieceIdx)
-	if err != nil {
-		return fmt.Errorf(
-			"error pushing blocks in queue, failed to get blocks count for piece: %d error: %w",
-			pieceIdx, err)
-	}
+func interestedMsgHandler(p *Peer) error {
+	fmt.Printf("INTERESTED message received from: %s\n", p.Conn.RemoteAddr().String())
+	p.PeerInterested.Store(true)
+	return nil
+}
+
+func notInterestedMsgHandler(p *Peer) error {
+	fmt.Printf("NOT INTERESTED message received from: %s\n", p.Conn.RemoteAddr().String())
+	p.PeerInterested.Store(false)
+	return nil
+}
+
+// updateInterest sends interested if the peer has any piece which client
+// needs, and not interested once it has none. Message is sent only when
+// the interest changes
+func updateInterest(p *Peer, t *torrent.Torrent) error {
+	p.imu.Lock()
+	defer p.imu.Unlock()
 
-	for i := 0; i < blocks; i++ {
-		blockOffset := i * torrent.DefaultBlockLength
-		blockLength, err := t.GetBlockLength(pieceIdx, i)
-		if err != nil {
-			return fmt.Errorf(
-				"error pushing blocks in queue, failed to get block length for piece: %d, blocks %d error: %w",
-				pieceIdx, i, err)
+	// Pieces the peer has which we don't
+	missing := p.piecesSnapshot().AndNot(t.Downloader.Bitfield())
+
+	interested := false
+	missing.ForEach(func(pieceIdx int) {
+		if !interested && t.Downloader.NeedsPiece(pieceIdx) {
+			interested = true
 		}
+	})
+
+	if p.AmInterested.Load() == interested {
+		return nil
+	}
 
-		p.TaskQueue.Push(
-			queue.NewBlock(
-				int(pieceIdx),
-				blockOffset,
-				blockLength,
-			))
+	msg := BuildNotInterestedMessage()
+	if interested {
+		msg = BuildInterestedMessage()
 	}
 
-	// fmt.Printf("Enqueued all pieces for pieceIdx: %d, for peer: %s\n", pieceIdx, p.Conn.RemoteAddr().String())
+	if err := p.send(msg); err != nil {
+		return fmt.Errorf("error sending interest: %w", err)
+	}
+
+	p.AmInterested.Store(interested)
 
 	return nil
 }
 
+// addPiece marks the piece as available with the peer, and counts the peer
+// towards the availability of the piece. It is called when have and bitfield
+// messages are received
+func addPiece(pieceIdx int, p *Peer, t *torrent.Torrent) {
+	if pieceIdx < 0 || pieceIdx >= t.PiecesCount || p.hasPiece(pieceIdx) {
+		return
+	}
+
+	p.setPiece(pieceIdx, t.PiecesCount)
+	t.Picker.PeerHas(pieceIdx)
+}
+
 func pieceMsgHandler(payload []byte, p *Peer, t *torrent.Torrent) error {
 	// log.Printf("PIECE message received, with len: %d, from peer: %s\n", len(payload), p.Conn.RemoteAddr().String())
 
-	b, blockData := parsePieceMsg(payload)
+	b, blockData, err := parsePieceMsg(payload)
+	if err != nil {
+		return err
+	}
 
 	// Validate block
 
 	// Validate indices (if such a block exists)
 	if !t.Downloader.IsValidBlock(b) {
 		return fmt.Errorf(
-			"invalid block received, [%d][%d]",
-			b.PieceIdx, t.Downloader.BlockIdx(b))
+			"%w: invalid block received, [%d][%d]",
+			errProtocol, b.PieceIdx, t.Downloader.BlockIdx(b))
 	}
 
 	blockLen, err := t.GetBlockLength(b.PieceIdx, t.Downloader.BlockIdx(b))
@@ -186,27 +178,88 @@ func pieceMsgHandler(payload []byte, p *Peer, t *torrent.Torrent) error {
 
 	// Validate length of the block data received
 	if blockLen != len(blockData) {
-		return fmt.Errorf("block len mismatch, expected:%d, got:%d", blockLen, len(blockData))
+		return fmt.Errorf("%w: block len mismatch, expected:%d, got:%d", errProtocol, blockLen, len(blockData))
 	}
 
 	fmt.Printf("PIECE message received for: [%d][%d], from peer:%s\n", b.PieceIdx, t.Downloader.BlockIdx(b), p.Conn.RemoteAddr().String())
 
-	// Mark as downloaded
-	t.Downloader.Downloaded(b, blockData)
+	p.Downloaded.Add(int64(len(blockData)))
+	p.downloadRate.add(len(blockData))
+	p.touchPiece()
+
+	// Mark as downloaded, the block is kept until the piece is complete
+	// while the payload buffer is reused for the next message
+	others := t.Downloader.Received(b, p.String())
+	cancelRequests(p, b, others)
+	t.Downloader.Downloaded(b, bytes.Clone(blockData))
 
 	if t.Downloader.IsDownloadComplete() {
-		// Close connection to the peer
-		return p.Conn.Close()
+		// Keep the connection open to seed to the peer
+		return updateInterest(p, t)
+	}
+
+	// Download incomplete, keep the pipeline full
+	if err := fillPipeline(p, t); err != nil {
+		return err
+	}
+
+	// Nothing left to request, peer may not have anything else we need
+	if t.Downloader.InFlight(p.String()) == 0 {
+		return updateInterest(p, t)
 	}
 
-	// Download incomplete
-	return requestOnePiece(p, t.Downloader)
+	return nil
 }
 
-func parsePieceMsg(payload []byte) (*queue.Block, []byte) {
+func requestMsgHandler(payload []byte, p *Peer, t *torrent.Torrent) error {
+	b, err := parseRequestMsg(payload)
+	if err != nil {
+		return fmt.Errorf("invalid request message: %w", err)
+	}
+
+	fmt.Printf("REQUEST message received for: [%d][%d], len: %d, from peer: %s\n", b.PieceIdx, b.BlockOffset, b.BlockLength, p.Conn.RemoteAddr().String())
+
+	// Requests are not served while choking the peer
+	if p.AmChoking.Load() {
+		return fmt.Errorf("request received while choking the peer")
+	}
+
+	if b.BlockLength > maxRequestLength {
+		return fmt.Errorf("requested block too large: %d bytes, max: %d", b.BlockLength, maxRequestLength)
+	}
+
+	// Only verified pieces are uploaded
+	if !t.Downloader.HasPiece(b.PieceIdx) {
+		return fmt.Errorf("requested piece not available: %d", b.PieceIdx)
+	}
+
+	return p.addRequest(b)
+}
+
+func cancelMsgHandler(payload []byte, p *Peer) error {
+	b, err := parseRequestMsg(payload)
+	if err != nil {
+		return fmt.Errorf("invalid cancel message: %w", err)
+	}
+
+	fmt.Printf("CANCEL message received for: [%d][%d], from peer: %s\n", b.PieceIdx, b.BlockOffset, p.Conn.RemoteAddr().String())
+
+	// The block might have already been sent, in which case there is nothing to cancel
+	p.cancelRequest(b)
+
+	return nil
+}
+
+// parsePieceMsg parses the payload of a piece message into the block and its data
+func parsePieceMsg(payload []byte) (*queue.Block, []byte, error) {
+	// <index><begin><block>
+	if len(payload) < 8 {
+		return nil, nil, fmt.Errorf("%w: payload for piece message should be at least 8 bytes, got %d", errProtocol, len(payload))
+	}
+
 	pieceIdx := binary.BigEndian.Uint32(payload[0:4])
 	blockOffset := binary.BigEndian.Uint32(payload[4:8])
 	blockData := payload[8:]
 
-	return queue.NewBlock(int(pieceIdx), int(blockOffset), len(blockData)), blockData
+	return queue.NewBlock(int(pieceIdx), int(blockOffset), len(blockData)), blockData, nil
 }
@@ -1,22 +1,146 @@
 package peer
 
-// func TestBitfieldMsgHandler(t *testing.T) {
-// 	var testCases = map[string]struct {
-// 		payload         []byte
-// 		expectedIndices []int
-// 	}{
-// 		"3 bytes bitfield": {
-// 			payload:         []byte{80, 48, 67},
-// 			expectedIndices: []int{3, 1, 11, 10, 23, 22, 17},
-// 		},
-// 	}
-
-// 	for name, test := range testCases {
-// 		t.Run(name, func(t *testing.T) {
-// 			gotIndices := bitfieldMsgHandler(test.payload)
-// 			if !reflect.DeepEqual(gotIndices, test.expectedIndices) {
-// 				t.Errorf("expected: %v, got: %v", test.expectedIndices, gotIndices)
-// 			}
-// 		})
-// 	}
-// }
+import (
+	"bytes"
+	"errors"
+	"io"
+	"my-bittorrent/queue"
+	"my-bittorrent/torrent"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestBitfieldMsgHandler(t *testing.T) {
+	var testCases = map[string]struct {
+		payload         []byte
+		piecesCount     int
+		expectedIndices []int
+		expectedError   bool
+	}{
+		"3 bytes bitfield": {
+			payload:         []byte{80, 48, 67},
+			piecesCount:     24,
+			expectedIndices: []int{1, 3, 10, 11, 17, 22, 23},
+		},
+		"spare bits set": {
+			payload:       []byte{80, 48, 67},
+			piecesCount:   20,
+			expectedError: true,
+		},
+		"too short": {
+			payload:       []byte{80},
+			piecesCount:   24,
+			expectedError: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tr := &torrent.Torrent{
+				Name:        name,
+				PiecesCount: test.piecesCount,
+				PieceLength: torrent.DefaultBlockLength,
+				FileLength:  int64(test.piecesCount * torrent.DefaultBlockLength),
+				Storage:     torrent.MemoryStorage,
+			}
+			var err error
+			tr.Downloader, err = torrent.NewDownloader(tr)
+			if err != nil {
+				t.Fatalf("error creating downloader: %v", err)
+			}
+			defer tr.Downloader.Close()
+			tr.Picker = torrent.NewPicker(tr.Downloader, tr.PiecesCount)
+
+			p := NewPeer(net.ParseIP("10.0.0.1"), 6881)
+
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			p.Conn = c1
+
+			// drain interested message
+			go io.Copy(io.Discard, c2)
+
+			err = bitfieldMsgHandler(test.payload, p, tr)
+			if (err != nil) != test.expectedError {
+				t.Fatalf("expected error: %v, got: %v", test.expectedError, err)
+			}
+			if err != nil {
+				return
+			}
+
+			var gotIndices []int
+			p.piecesSnapshot().ForEach(func(pieceIdx int) {
+				gotIndices = append(gotIndices, pieceIdx)
+
+				if tr.Picker.Availability(pieceIdx) != 1 {
+					t.Errorf("expected availability of piece %d to be counted", pieceIdx)
+				}
+			})
+
+			if !reflect.DeepEqual(gotIndices, test.expectedIndices) {
+				t.Errorf("expected: %v, got: %v", test.expectedIndices, gotIndices)
+			}
+			if !p.AmInterested.Load() {
+				t.Errorf("expected to be interested in the peer")
+			}
+		})
+	}
+}
+
+func TestParsePieceMsg(t *testing.T) {
+	block := []byte{1, 2, 3, 4}
+	msg := BuildPieceMessage(2, 16384, block)
+
+	// skip length prefix and message ID
+	b, data, err := parsePieceMsg(msg[5:])
+	if err != nil {
+		t.Fatalf("error parsing piece: %v", err)
+	}
+
+	expected := queue.Block{PieceIdx: 2, BlockOffset: 16384, BlockLength: len(block)}
+	if *b != expected {
+		t.Errorf("block mismatch, expected: %+v, got: %+v", expected, *b)
+	}
+	if !bytes.Equal(data, block) {
+		t.Errorf("block data mismatch, expected: %v, got: %v", block, data)
+	}
+
+	if _, _, err := parsePieceMsg(msg[5:12]); !errors.Is(err, errProtocol) {
+		t.Errorf("expected protocol error for short payload, got: %v", err)
+	}
+}
+
+func TestConnectionStateFlags(t *testing.T) {
+	p := NewPeer(net.ParseIP("10.0.0.1"), 6881)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	p.Conn = c1
+
+	// connections start out choked and not interested
+	if !p.AmChoking.Load() || !p.PeerChoking.Load() {
+		t.Errorf("expected connection to start choked")
+	}
+	if p.AmInterested.Load() || p.PeerInterested.Load() {
+		t.Errorf("expected connection to start not interested")
+	}
+
+	messageRouter(&Message{ID: Interested}, p, nil)
+	if !p.PeerInterested.Load() {
+		t.Errorf("expected peer to be interested")
+	}
+
+	messageRouter(&Message{ID: NotInterested}, p, nil)
+	if p.PeerInterested.Load() {
+		t.Errorf("expected peer to be not interested")
+	}
+
+	tr := &torrent.Torrent{Downloader: &torrent.Downloader{}}
+	messageRouter(&Message{ID: Choke}, p, tr)
+	if !p.PeerChoking.Load() {
+		t.Errorf("expected peer to be choking")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"log"
+	"my-bittorrent/torrent"
 )
 
 // messageID defines message IDs for peer to peer message exchange
@@ -66,8 +67,6 @@ func BuildChokeMessage() []byte {
 	copy(msg[0:4], intToBytes(msgLen, 4))
 	copy(msg[4:5], intToBytes(msgID, 1))
 
-	fmt.Printf("choke msg in hex: %x", msg)
-
 	return msg
 }
 
@@ -80,8 +79,6 @@ func BuildUnchokeMessage() []byte {
 	copy(msg[0:4], intToBytes(msgLen, 4))
 	copy(msg[4:5], intToBytes(msgID, 1))
 
-	fmt.Printf("un-choke msg in hex: %x", msg)
-
 	return msg
 }
 
@@ -94,13 +91,11 @@ func BuildInterestedMessage() []byte {
 	copy(msg[0:4], intToBytes(msgLen, 4))
 	copy(msg[4:5], intToBytes(msgID, 1))
 
-	fmt.Printf("interested msg in hex: %x", msg)
-
 	return msg
 }
 
 func BuildNotInterestedMessage() []byte {
-	// <len=0001><id=2>
+	// <len=0001><id=3>
 	// bytes: 4 + 1 = 5
 	msg := make([]byte, 5)
 	var msgLen, msgID int = 1, int(NotInterested)
@@ -108,8 +103,6 @@ func BuildNotInterestedMessage() []byte {
 	copy(msg[0:4], intToBytes(msgLen, 4))
 	copy(msg[4:5], intToBytes(msgID, 1))
 
-	fmt.Printf("not interested msg in hex: %x", msg)
-
 	return msg
 }
 
@@ -117,41 +110,27 @@ func BuildHaveMessage(pieceIdx int) []byte {
 	// <len=0005><id=4><piece index>
 	// bytes: 4 + 1 + 4 = 9
 	msg := make([]byte, 9)
-	var msgLen, msgID int = 1, int(Have)
+	var msgLen, msgID int = 5, int(Have)
 
 	copy(msg[0:4], intToBytes(msgLen, 4))
 	copy(msg[4:5], intToBytes(msgID, 1))
 	copy(msg[5:9], intToBytes(pieceIdx, 4))
 
-	fmt.Printf("have msg in hex: %x", msg)
-
 	return msg
 }
 
-func BuildBitFieldMessage(pieces []bool) ([]byte, error) {
+func BuildBitFieldMessage(pieces *torrent.Bitfield) ([]byte, error) {
 	// <len=0001+X><id=5><bitfield>, where X is bytes required for bitfield
 	// bytes: 4 + 1 + X
 
 	// MSB refers to the lowest index i.e. 0
-	// Calculate bytes needed to represent bitfield
 	// Ecxample - If peices = 4, bitfield can be reperesented using 1 bytes
 	// If we have pieces 0, 2, then bitfield will look like
 	// [1 0 1 0 0 0 0 0]
 	// Example - If pieces = 10, bitfield can be reperesented using 2 bytes
 	// If we have pieces 3, 5, 8, 9
 	// [0 0 0 1 0 1 0 0] [1 1 0 0 0 0 0 0]
-	bytesForBitfield := (len(pieces) + 7) / 8 // Round up to nearest byte
-
-	// Create the bitfield
-	bitfield := make([]byte, bytesForBitfield)
-
-	for i, hasPiece := range pieces {
-		if hasPiece {
-			byteIdx := i / 8
-			bitIdx := 7 - (i % 8) // High bit corresponds to piece 0
-			bitfield[byteIdx] |= (1 << bitIdx)
-		}
-	}
+	bitfield := pieces.Bytes()
 
 	buf := new(bytes.Buffer)
 
@@ -206,8 +185,6 @@ func BuildPieceMessage(pieceIdx, blockOffset int, block []byte) []byte {
 	copy(msg[9:13], intToBytes(blockOffset, 4))
 	copy(msg[13:], block)
 
-	fmt.Printf("piece msg in hex: %x", msg)
-
 	return msg
 }
 
@@ -224,8 +201,6 @@ func BuildCancelMessage(pieceIdx, blockOffset, reqLen int) []byte {
 	copy(msg[9:13], intToBytes(blockOffset, 4))
 	copy(msg[13:17], intToBytes(reqLen, 4))
 
-	fmt.Printf("cancel msg in hex: %x", msg)
-
 	return msg
 }
 
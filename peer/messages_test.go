@@ -3,6 +3,7 @@ package peer
 import (
 	"encoding/binary"
 	"fmt"
+	"my-bittorrent/torrent"
 	"reflect"
 	"testing"
 )
@@ -50,7 +51,14 @@ func TestBuildBitFieldMessage(t *testing.T) {
 
 	for name, test := range testCases {
 		t.Run(name, func(t *testing.T) {
-			msg, err := BuildBitFieldMessage(test.pieces)
+			pieces := torrent.NewBitfield(len(test.pieces))
+			for i, has := range test.pieces {
+				if has {
+					pieces.Set(i)
+				}
+			}
+
+			msg, err := BuildBitFieldMessage(pieces)
 			fmt.Println("msg: ", msg)
 
 			if err != nil {
@@ -133,3 +141,23 @@ func TestBuildRequestMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildHaveMessage(t *testing.T) {
+	msg := BuildHaveMessage(258)
+
+	if len(msg) != 9 {
+		t.Fatalf("msg len mismatch, expected: 9, got: %d", len(msg))
+	}
+
+	if l := binary.BigEndian.Uint32(msg[0:4]); l != 5 {
+		t.Errorf("message length mismatch, expected: 5, got: %d", l)
+	}
+
+	if msg[4] != byte(Have) {
+		t.Errorf("messageID mismatch, expected: %d, got: %d", Have, msg[4])
+	}
+
+	if pieceIdx := binary.BigEndian.Uint32(msg[5:9]); pieceIdx != 258 {
+		t.Errorf("piece index mismatch, expected: 258, got: %d", pieceIdx)
+	}
+}
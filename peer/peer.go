@@ -4,26 +4,136 @@ import (
 	cryptoRand "crypto/rand"
 	"fmt"
 	"my-bittorrent/queue"
+	"my-bittorrent/torrent"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Peer represents a single node participating in a torrent network
 type Peer struct {
-	ID        [20]byte // Received in handshake response
-	IPAddress net.IP
-	Port      uint16
-	Conn      net.Conn     // TCP connection
-	TaskQueue *queue.Queue // TaskQueue is used store the pieces a peer has until they are requested
-	AmChoked  bool         // AmChoked is used to indicate if client is choked by peer
+	ID         [20]byte // Received in handshake response
+	IPAddress  net.IP
+	Port       uint16
+	Conn       net.Conn     // TCP connection
+	Uploaded   atomic.Int64 // Uploaded is bytes of blocks sent to the peer
+	Downloaded atomic.Int64 // Downloaded is bytes of blocks received from the peer
+	Inbound    bool         // Inbound is true if the peer connected to us, handshake is already exchanged
+
+	// Connection state - https://wiki.theory.org/BitTorrentSpecification#Overview
+	AmChoking      atomic.Bool // AmChoking is true if client is choking the peer
+	AmInterested   atomic.Bool // AmInterested is true if client is interested in pieces the peer has
+	PeerChoking    atomic.Bool // PeerChoking is true if client is choked by peer
+	PeerInterested atomic.Bool // PeerInterested is true if peer is interested in pieces client has
+	imu            sync.Mutex  // To synchronize updates of AmInterested
+
+	pieces     *torrent.Bitfield // pieces the peer has, received in bitfield and have messages
+	pmu        sync.RWMutex      // To synchronize access to pieces
+	requests   []*queue.Block    // requests received from the peer which are yet to be served
+	rqmu       sync.Mutex        // To synchronize access to requests
+	requestsCh chan struct{}     // To notify that a request is received
+
+	lastPieceAt  atomic.Int64 // unix nano time of the last block received, used to detect snubbing
+	lastWriteAt  atomic.Int64 // unix nano time of the last message sent, used to send keep-alives
+	downloadRate rateMeter    // rate at which blocks are received, used to size the request window
+	swarm        *Swarm       // swarm the peer is part of, nil if none
+	misbehaved   atomic.Int32 // protocol violations by the peer, counted towards banning it
+
+	outbox     chan []byte   // messages queued to be sent by the writer
+	writerDone chan struct{} // closed once the writer has stopped
 }
 
 func NewPeer(ip net.IP, port uint16) *Peer {
-	return &Peer{
-		IPAddress: ip,
-		Port:      port,
-		TaskQueue: queue.NewQueue(),
-		AmChoked:  true,
+	p := &Peer{
+		IPAddress:  ip,
+		Port:       port,
+		requestsCh: make(chan struct{}, 1),
+		outbox:     make(chan []byte, outboxSize),
+		writerDone: make(chan struct{}),
+	}
+
+	// Connections start out choked and not interested
+	p.AmChoking.Store(true)
+	p.PeerChoking.Store(true)
+
+	return p
+}
+
+// setPiece marks the piece at pieceIdx as available with the peer
+func (p *Peer) setPiece(pieceIdx, piecesCount int) {
+	p.pmu.Lock()
+	defer p.pmu.Unlock()
+
+	if p.pieces == nil || p.pieces.Len() != piecesCount {
+		p.pieces = torrent.NewBitfield(piecesCount)
+	}
+
+	p.pieces.Set(pieceIdx)
+}
+
+// hasPiece returns true if the peer has the piece at pieceIdx
+func (p *Peer) hasPiece(pieceIdx int) bool {
+	p.pmu.RLock()
+	defer p.pmu.RUnlock()
+
+	return p.pieces != nil && p.pieces.Has(pieceIdx)
+}
+
+// piecesSnapshot returns a copy of the pieces the peer has
+func (p *Peer) piecesSnapshot() *torrent.Bitfield {
+	p.pmu.RLock()
+	defer p.pmu.RUnlock()
+
+	if p.pieces == nil {
+		return torrent.NewBitfield(0)
 	}
+
+	return p.pieces.Clone()
+}
+
+// touchPiece records that a block was just received from the peer
+func (p *Peer) touchPiece() {
+	p.lastPieceAt.Store(time.Now().UnixNano())
+}
+
+// sinceLastPiece returns the time elapsed since the last block was received
+// from the peer, or since the connection was started
+func (p *Peer) sinceLastPiece() time.Duration {
+	return time.Since(time.Unix(0, p.lastPieceAt.Load()))
+}
+
+// touchWrite records that messages were just written to the peer
+func (p *Peer) touchWrite() {
+	p.lastWriteAt.Store(time.Now().UnixNano())
+}
+
+// sinceLastWrite returns the time elapsed since the last message was sent
+// to the peer, or since the connection was started
+func (p *Peer) sinceLastWrite() time.Duration {
+	return time.Since(time.Unix(0, p.lastWriteAt.Load()))
+}
+
+// timeouts returns the idle timeouts of the swarm the peer is part of, or
+// the defaults if it is not part of any
+func (p *Peer) timeouts() Timeouts {
+	if p.swarm == nil {
+		return DefaultTimeouts
+	}
+
+	return p.swarm.Timeouts
+}
+
+// isSnubbed returns true if we are interested in the peer, but it has
+// not sent us a block for snubTimeout
+func (p *Peer) isSnubbed() bool {
+	return p.AmInterested.Load() && p.sinceLastPiece() > snubTimeout
+}
+
+// String returns the address of the peer in the form "host:port"
+func (p *Peer) String() string {
+	return net.JoinHostPort(p.IPAddress.String(), strconv.Itoa(int(p.Port)))
 }
 
 var PeerID [20]byte
@@ -0,0 +1,197 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"my-bittorrent/queue"
+	"my-bittorrent/torrent"
+	"sync"
+	"time"
+)
+
+const (
+	// Bounds of the number of requests kept outstanding to a peer
+	minRequestWindow = 5
+	maxRequestWindow = 250
+
+	// requestQueueTime is the time it should take a peer to send all the
+	// outstanding requests at its download rate. It is a few round trips
+	// long, so that the peer always has requests queued while ours are
+	// in transit
+	requestQueueTime = 3 * time.Second
+
+	// requestCheckInterval is how often the requests in flight to a peer
+	// are checked for timeouts
+	requestCheckInterval = 5 * time.Second
+
+	rateSampleInterval = 1 * time.Second
+	rateSmoothing      = 0.5 // weight of the latest sample in the moving average
+)
+
+// requestWindow returns the number of requests to keep outstanding to a
+// peer which sends rate bytes/sec, similar to libtorrent's request queue sizing
+func requestWindow(rate float64) int {
+	window := int(rate * requestQueueTime.Seconds() / float64(torrent.DefaultBlockLength))
+
+	return min(max(window, minRequestWindow), maxRequestWindow)
+}
+
+// fillPipeline requests blocks from the peer until the number of outstanding
+// requests reaches the request window of the peer
+func fillPipeline(p *Peer, t *torrent.Torrent) error {
+	d := t.Downloader
+
+	if p.PeerChoking.Load() {
+		return fmt.Errorf("cannot request for piece as peer choking: %s", p.Conn.RemoteAddr().String())
+	}
+
+	window := requestWindow(p.downloadRate.Rate())
+
+	// A snubbed peer is only trusted with a single request
+	if p.isSnubbed() {
+		window = 1
+	}
+
+	for d.InFlight(p.String()) < window {
+		// Picked block is marked as requested from the peer
+		b := t.Picker.Pick(p.String(), p.hasPiece)
+		if b == nil {
+			break
+		}
+
+		err := p.send(BuildRequestMessage(b.PieceIdx, b.BlockOffset, b.BlockLength))
+		if err != nil {
+			return fmt.Errorf("error sending message: %w", err)
+		}
+
+		fmt.Printf("requested [piece][block] [%d][%d] from: %s\n", b.PieceIdx, d.BlockIdx(b), p.Conn.RemoteAddr().String())
+	}
+
+	return nil
+}
+
+// watchRequests periodically releases the blocks in flight to the peer
+// which have timed out, and all the blocks in flight if the peer is snubbing
+// us, until ctx is cancelled. Released blocks are cancelled and handed to
+// other peers
+func watchRequests(ctx context.Context, p *Peer, t *torrent.Torrent) {
+	ticker := time.NewTicker(requestCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var released []queue.Block
+		if p.isSnubbed() {
+			released = t.Downloader.ReleasePeer(p.String())
+		} else {
+			released = t.Downloader.ReleaseExpired(p.String())
+		}
+
+		if len(released) == 0 {
+			continue
+		}
+
+		log.Printf("released %d blocks timed out on %s\n", len(released), p)
+
+		for _, b := range released {
+			err := p.send(BuildCancelMessage(b.PieceIdx, b.BlockOffset, b.BlockLength))
+			if err != nil {
+				log.Printf("error cancelling block [%d][%d] to %s: %v\n", b.PieceIdx, b.BlockOffset, p, err)
+				break
+			}
+		}
+
+		wakePeers(p, t)
+	}
+}
+
+// wakePeers fills the pipeline of the other unchoked peers in the swarm,
+// so that blocks released by p are picked right away
+func wakePeers(p *Peer, t *torrent.Torrent) {
+	if p.swarm == nil {
+		return
+	}
+
+	for _, other := range p.swarm.Peers() {
+		if other == p || other.PeerChoking.Load() {
+			continue
+		}
+
+		if err := fillPipeline(other, t); err != nil {
+			log.Printf("error requesting blocks from %s: %v\n", other, err)
+		}
+	}
+}
+
+// cancelRequests sends cancel for the block to the other peers in the swarm
+// which it was requested from in endgame, once p has sent it
+func cancelRequests(p *Peer, b *queue.Block, others []string) {
+	if p.swarm == nil {
+		return
+	}
+
+	for _, addr := range others {
+		other := p.swarm.Get(addr)
+		if other == nil {
+			continue
+		}
+
+		err := other.send(BuildCancelMessage(b.PieceIdx, b.BlockOffset, b.BlockLength))
+		if err != nil {
+			log.Printf("error cancelling block [%d][%d] to %s: %v\n", b.PieceIdx, b.BlockOffset, other, err)
+		}
+	}
+}
+
+// rateMeter measures a transfer rate as a moving average of the rate
+// sampled every rateSampleInterval
+type rateMeter struct {
+	mu    sync.Mutex
+	rate  float64   // bytes/sec
+	bytes int64     // bytes transferred in the current sample
+	start time.Time // start of the current sample
+}
+
+// add records n bytes transferred
+func (m *rateMeter) add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.update(time.Now())
+	m.bytes += int64(n)
+}
+
+// Rate returns the transfer rate in bytes/sec
+func (m *rateMeter) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.update(time.Now())
+	return m.rate
+}
+
+// update completes the current sample once it is rateSampleInterval long,
+// an idle period ends up as a single sample with a low rate
+func (m *rateMeter) update(now time.Time) {
+	if m.start.IsZero() {
+		m.start = now
+		return
+	}
+
+	elapsed := now.Sub(m.start)
+	if elapsed < rateSampleInterval {
+		return
+	}
+
+	sample := float64(m.bytes) / elapsed.Seconds()
+	m.rate = rateSmoothing*sample + (1-rateSmoothing)*m.rate
+
+	m.bytes = 0
+	m.start = now
+}
@@ -0,0 +1,83 @@
+package peer
+
+import (
+	"bytes"
+	"io"
+	"my-bittorrent/queue"
+	"my-bittorrent/torrent"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRequestWindow(t *testing.T) {
+	var testCases = map[string]struct {
+		rate     float64
+		expected int
+	}{
+		"no rate yet":    {rate: 0, expected: minRequestWindow},
+		"slow peer":      {rate: 10 * 1024, expected: minRequestWindow},
+		"fast peer":      {rate: 1024 * 1024, expected: 192},
+		"very fast peer": {rate: 100 * 1024 * 1024, expected: maxRequestWindow},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if got := requestWindow(test.rate); got != test.expected {
+				t.Errorf("window mismatch, expected: %d, got: %d", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	// a full sample of 32 KB received over 2 seconds
+	m := &rateMeter{
+		start: time.Now().Add(-2 * time.Second),
+		bytes: int64(2 * torrent.DefaultBlockLength),
+	}
+
+	expected := rateSmoothing * float64(2*torrent.DefaultBlockLength) / 2
+
+	rate := m.Rate()
+	if rate < expected*0.9 || rate > expected*1.1 {
+		t.Errorf("rate mismatch, expected: ~%f, got: %f", expected, rate)
+	}
+
+	// rate is unchanged until the next sample is complete
+	m.add(torrent.DefaultBlockLength)
+	if got := m.Rate(); got != rate {
+		t.Errorf("rate changed mid sample, expected: %f, got: %f", rate, got)
+	}
+}
+
+func TestCancelRequests(t *testing.T) {
+	s := NewSwarm()
+
+	p := NewPeer(net.ParseIP("10.0.0.1"), 6881)
+	other := NewPeer(net.ParseIP("10.0.0.2"), 6881)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	other.Conn = c1
+	startWriter(t, other, nil)
+
+	s.Add(p)
+	s.Add(other)
+
+	b := queue.NewBlock(3, torrent.DefaultBlockLength, torrent.DefaultBlockLength)
+
+	go cancelRequests(p, b, []string{other.String(), "10.0.0.3:6881"})
+
+	expected := BuildCancelMessage(b.PieceIdx, b.BlockOffset, b.BlockLength)
+	got := make([]byte, len(expected))
+
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c2, got); err != nil {
+		t.Fatalf("error reading cancel: %v", err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("cancel mismatch, expected: %v, got: %v", expected, got)
+	}
+}
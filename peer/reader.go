@@ -0,0 +1,127 @@
+package peer
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"my-bittorrent/torrent"
+	"net"
+	"sync"
+	"time"
+)
+
+// readBufferSize is the size of the buffer the connection is read through,
+// it fits a couple of piece messages
+const readBufferSize = 64 * 1024 // 64 KB
+
+// pooledPayloadSize fits the payload of a piece message with a block of
+// the default length, which is most of the messages received. Larger
+// messages are allocated
+// <id=7><index><begin><block>
+const pooledPayloadSize = 9 + torrent.DefaultBlockLength
+
+var payloadPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, pooledPayloadSize)
+		return &buf
+	},
+}
+
+// maxMessageLength returns the length of the largest message a peer can
+// send, the larger of a piece message with the largest block and the
+// bitfield of the torrent
+func maxMessageLength(piecesCount int) int {
+	pieceMsgLen := 9 + maxRequestLength
+	bitfieldMsgLen := 1 + (piecesCount+7)/8
+
+	return max(pieceMsgLen, bitfieldMsgLen)
+}
+
+// cancelReads unblocks the reads from the connection once ctx is cancelled,
+// by moving the read deadline to the past. Returned function stops it
+func cancelReads(ctx context.Context, conn net.Conn) func() bool {
+	return context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Unix(1, 0))
+	})
+}
+
+// messageReader reads the messages from the connection to a peer through a
+// buffer, payloads are read into pooled buffers. It is not safe for
+// concurrent use
+type messageReader struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	maxLen int // messages longer than maxLen are rejected
+
+	header [4]byte
+	buf    *[]byte // pooled buffer of the last message read
+}
+
+func newMessageReader(conn net.Conn, maxLen int) *messageReader {
+	return &messageReader{
+		conn:   conn,
+		br:     bufio.NewReaderSize(conn, readBufferSize),
+		maxLen: maxLen,
+	}
+}
+
+// readMessage reads length prefix message such as choke, unchoke, request,
+// piece, etc. Returned value is message without the length prefix, which is
+// empty for keep-alives. It is only valid until the next read, as the
+// buffer is reused. Reading fails if no message is received within timeout
+// or ctx is cancelled
+func (r *messageReader) readMessage(ctx context.Context, timeout time.Duration) ([]byte, error) {
+	r.release()
+
+	if err := r.setDeadline(ctx, timeout); err != nil {
+		return nil, fmt.Errorf("failed to read message header as ctx cancelled or timeout %w", err)
+	}
+
+	if _, err := io.ReadFull(r.br, r.header[:]); err != nil {
+		return nil, fmt.Errorf("error reading message header %w", readError(ctx, err))
+	}
+
+	// Decode message length
+	msgLen := int(binary.BigEndian.Uint32(r.header[:]))
+
+	if msgLen == 0 {
+		return []byte{}, nil
+	}
+
+	if msgLen > r.maxLen {
+		return nil, fmt.Errorf("%w: message too long: %d bytes, max: %d", errProtocol, msgLen, r.maxLen)
+	}
+
+	var msg []byte
+	if msgLen <= pooledPayloadSize {
+		r.buf = payloadPool.Get().(*[]byte)
+		msg = (*r.buf)[:msgLen]
+	} else {
+		msg = make([]byte, msgLen)
+	}
+
+	if _, err := io.ReadFull(r.br, msg); err != nil {
+		return nil, fmt.Errorf("error reading message %w", readError(ctx, err))
+	}
+
+	return msg, nil
+}
+
+// release returns the buffer of the last message read to the pool
+func (r *messageReader) release() {
+	if r.buf != nil {
+		payloadPool.Put(r.buf)
+		r.buf = nil
+	}
+}
+
+// setDeadline sets the read deadline for the next read. Deadline is checked
+// against ctx after it is set, as it would otherwise override the deadline
+// set on cancellation
+func (r *messageReader) setDeadline(ctx context.Context, timeout time.Duration) error {
+	r.conn.SetReadDeadline(time.Now().Add(timeout))
+
+	return ctx.Err()
+}
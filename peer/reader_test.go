@@ -0,0 +1,243 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadMessage(t *testing.T) {
+	block := bytes.Repeat([]byte{7}, 16384)
+
+	var testCases = map[string]struct {
+		data          []byte
+		maxLen        int
+		expected      [][]byte
+		expectedError bool
+	}{
+		"keep-alive": {
+			data:     BuildKeepAliveMessage(),
+			maxLen:   1024,
+			expected: [][]byte{{}},
+		},
+		"messages in one read": {
+			data:     append(BuildHaveMessage(3), BuildInterestedMessage()...),
+			maxLen:   1024,
+			expected: [][]byte{BuildHaveMessage(3)[4:], BuildInterestedMessage()[4:]},
+		},
+		"piece": {
+			data:     BuildPieceMessage(1, 0, block),
+			maxLen:   maxMessageLength(10),
+			expected: [][]byte{BuildPieceMessage(1, 0, block)[4:]},
+		},
+		"larger than pooled buffer": {
+			data:     append([]byte{0, 0, 0x80, 0x01}, make([]byte, 0x8001)...),
+			maxLen:   maxMessageLength(10),
+			expected: [][]byte{make([]byte, 0x8001)},
+		},
+		"too long": {
+			data:          []byte{0xff, 0xff, 0xff, 0xff, 7},
+			maxLen:        maxMessageLength(10),
+			expectedError: true,
+		},
+		"truncated": {
+			data:          BuildHaveMessage(3)[:6],
+			maxLen:        1024,
+			expectedError: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+
+			go func() {
+				c2.Write(test.data)
+				c2.Close()
+			}()
+
+			r := newMessageReader(c1, test.maxLen)
+			defer r.release()
+
+			for _, expected := range test.expected {
+				msg, err := r.readMessage(context.Background(), time.Second)
+				if err != nil {
+					t.Fatalf("error reading message: %v", err)
+				}
+				if !bytes.Equal(msg, expected) {
+					t.Errorf("message mismatch, expected: %v, got: %v", expected, msg)
+				}
+			}
+
+			if test.expectedError {
+				if _, err := r.readMessage(context.Background(), time.Second); err == nil {
+					t.Errorf("expected error")
+				}
+			}
+		})
+	}
+}
+
+func TestReadMessageCancel(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stop := cancelReads(ctx, c1)
+	defer stop()
+
+	r := newMessageReader(c1, 1024)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.readMessage(ctx, time.Minute)
+		done <- err
+	}()
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected error once cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected read to be unblocked once cancelled")
+	}
+
+	// reading after cancellation fails without blocking
+	if _, err := r.readMessage(ctx, time.Minute); err == nil {
+		t.Errorf("expected error reading after cancellation")
+	}
+}
+
+// loopConn is a connection which endlessly repeats the same data
+type loopConn struct {
+	net.Conn
+	data []byte
+	off  int
+}
+
+func (c *loopConn) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		m := copy(b[n:], c.data[c.off:])
+		n += m
+		c.off = (c.off + m) % len(c.data)
+	}
+	return n, nil
+}
+
+func (c *loopConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// readMessageGoroutine reads a message the way it was done before the
+// message reader, a goroutine and fresh buffers for every read, to compare
+// against in the benchmarks
+func readMessageGoroutine(ctx context.Context, conn net.Conn) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(time.Minute))
+	defer conn.SetReadDeadline(time.Time{})
+
+	done := make(chan error, 1)
+
+	var header []byte
+	go func() {
+		header = make([]byte, 4)
+		_, err := io.ReadFull(conn, header)
+		done <- err
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	msgLen := binary.BigEndian.Uint32(header)
+
+	done = make(chan error, 1)
+
+	var msg []byte
+	go func() {
+		msg = make([]byte, msgLen)
+		_, err := io.ReadFull(conn, msg)
+		done <- err
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	ctx := context.Background()
+	pieceMsg := BuildPieceMessage(1, 0, make([]byte, 16384))
+
+	b.Run("reader", func(b *testing.B) {
+		r := newMessageReader(&loopConn{data: pieceMsg}, maxMessageLength(10))
+		defer r.release()
+
+		b.SetBytes(int64(len(pieceMsg)))
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := r.readMessage(ctx, time.Minute); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("goroutine", func(b *testing.B) {
+		conn := &loopConn{data: pieceMsg}
+
+		b.SetBytes(int64(len(pieceMsg)))
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := readMessageGoroutine(ctx, conn); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkReadAndParseMessage(b *testing.B) {
+	ctx := context.Background()
+	haveMsgs := make([]byte, 0, 9*100)
+	for i := 0; i < 100; i++ {
+		haveMsgs = append(haveMsgs, BuildHaveMessage(i)...)
+	}
+
+	r := newMessageReader(&loopConn{data: haveMsgs}, maxMessageLength(10))
+	defer r.release()
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		msg, err := r.readMessage(ctx, time.Minute)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ParseMessage(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package peer
+
+import (
+	"context"
+	"log"
+	"my-bittorrent/torrent"
+	"sync"
+)
+
+// Swarm is the set of peers a torrent is currently connected to
+type Swarm struct {
+	mu    sync.Mutex // To synchronize access to peers
+	peers map[*Peer]struct{}
+
+	// SuppressHaves skips sending have messages to peers which already
+	// have the piece
+	SuppressHaves bool
+
+	// Timeouts of the idle connections to the peers in the swarm
+	Timeouts Timeouts
+}
+
+func NewSwarm() *Swarm {
+	return &Swarm{
+		peers:    make(map[*Peer]struct{}),
+		Timeouts: DefaultTimeouts,
+	}
+}
+
+// Add adds a connected peer to the swarm
+func (s *Swarm) Add(p *Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.peers[p] = struct{}{}
+	p.swarm = s
+}
+
+// join queues the bitfield to the peer and adds the peer to the swarm at
+// once, so that haves broadcast to the swarm are only sent after the bitfield
+func (s *Swarm) join(p *Peer, t *torrent.Torrent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := sendBitfield(p, t); err != nil {
+		return err
+	}
+
+	s.peers[p] = struct{}{}
+	p.swarm = s
+
+	return nil
+}
+
+// Remove removes a peer from the swarm once it is disconnected
+func (s *Swarm) Remove(p *Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.peers, p)
+}
+
+// Peers returns a snapshot of the peers in the swarm
+func (s *Swarm) Peers() []*Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make([]*Peer, 0, len(s.peers))
+	for p := range s.peers {
+		peers = append(peers, p)
+	}
+
+	return peers
+}
+
+// Get returns the peer with the given address, nil if it is not connected
+func (s *Swarm) Get(addr string) *Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for p := range s.peers {
+		if p.String() == addr {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// BroadcastHaves announces every piece which becomes available for upload
+// to all the peers in the swarm, until all the pieces are written or ctx
+// is cancelled. Interest in the peers is updated along, as they may no
+// longer have any piece we need
+func (s *Swarm) BroadcastHaves(ctx context.Context, t *torrent.Torrent) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pieceIdx, ok := <-t.Downloader.Haves():
+			if !ok {
+				return
+			}
+
+			s.broadcastHave(pieceIdx)
+			s.updateInterest(t)
+		}
+	}
+}
+
+// updateInterest sends not interested to the peers we were interested in,
+// which no longer have any piece we need
+func (s *Swarm) updateInterest(t *torrent.Torrent) {
+	for _, p := range s.Peers() {
+		if !p.AmInterested.Load() {
+			continue
+		}
+
+		if err := updateInterest(p, t); err != nil {
+			log.Printf("error updating interest in %s: %v\n", p, err)
+		}
+	}
+}
+
+// broadcastHave sends have message for the piece to all the peers in the swarm
+func (s *Swarm) broadcastHave(pieceIdx int) {
+	msg := BuildHaveMessage(pieceIdx)
+
+	for _, p := range s.Peers() {
+		if s.SuppressHaves && p.hasPiece(pieceIdx) {
+			continue
+		}
+
+		if err := p.send(msg); err != nil {
+			log.Printf("error sending have for piece %d to %s: %v\n", pieceIdx, p, err)
+		}
+	}
+}
+
+// ReceiveMessages keeps the peer in the swarm for as long as messages are
+// received from it
+func (s *Swarm) ReceiveMessages(ctx context.Context, p *Peer, t *torrent.Torrent) {
+	if err := s.join(p, t); err != nil {
+		log.Println(err)
+		p.Conn.Close()
+		return
+	}
+	defer s.Remove(p)
+
+	receiveMessages(ctx, p, t)
+}
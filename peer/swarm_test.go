@@ -0,0 +1,195 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"my-bittorrent/torrent"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBroadcastHave(t *testing.T) {
+	var testCases = map[string]struct {
+		suppress bool
+		expected []bool // whether each peer receives the have
+	}{
+		"all peers": {
+			expected: []bool{true, true},
+		},
+		"suppressed for peers with the piece": {
+			suppress: true,
+			expected: []bool{true, false},
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			s := NewSwarm()
+			s.SuppressHaves = test.suppress
+
+			var remotes []net.Conn
+			for i := range test.expected {
+				p := NewPeer(net.IPv4(10, 0, 0, byte(i+1)), 6881)
+
+				c1, c2 := net.Pipe()
+				defer c1.Close()
+				defer c2.Close()
+				p.Conn = c1
+				startWriter(t, p, nil)
+
+				// second peer already has the piece
+				if i == 1 {
+					p.setPiece(3, 8)
+				}
+
+				s.Add(p)
+				remotes = append(remotes, c2)
+			}
+
+			expectedMsg := BuildHaveMessage(3)
+
+			// Haves are sent one peer at a time, so all the remotes are
+			// read concurrently
+			got := make([][]byte, len(remotes))
+			errs := make([]error, len(remotes))
+			var wg sync.WaitGroup
+			for i, remote := range remotes {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					got[i] = make([]byte, len(expectedMsg))
+					remote.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+					_, errs[i] = io.ReadFull(remote, got[i])
+				}()
+			}
+
+			s.broadcastHave(3)
+			wg.Wait()
+
+			for i := range remotes {
+				if test.expected[i] {
+					if errs[i] != nil {
+						t.Fatalf("peer %d: error reading have: %v", i, errs[i])
+					}
+					if !bytes.Equal(got[i], expectedMsg) {
+						t.Errorf("peer %d: have mismatch, expected: %v, got: %v", i, expectedMsg, got[i])
+					}
+				} else if errs[i] == nil {
+					t.Errorf("peer %d: expected no have, got: %v", i, got[i])
+				}
+			}
+		})
+	}
+}
+
+// newSwarmTestTorrent returns a torrent of 2 pieces, of which piece 0 is
+// verified on disk
+func newSwarmTestTorrent(t *testing.T) *torrent.Torrent {
+	data := []byte("aaaabbbb")
+	tr := &torrent.Torrent{
+		Name:        "swarm",
+		PiecesCount: 2,
+		PieceLength: 4,
+		FileLength:  int64(len(data)),
+		PieceHash:   [][20]byte{sha1.Sum(data[:4]), sha1.Sum(data[4:])},
+	}
+
+	storage, err := torrent.MemoryStorage(tr)
+	if err != nil {
+		t.Fatalf("error opening storage: %v", err)
+	}
+	if err := storage.WriteBlock(data[:4], 0, 0); err != nil {
+		t.Fatalf("error writing piece: %v", err)
+	}
+	tr.Storage = func(*torrent.Torrent) (torrent.Storage, error) {
+		return storage, nil
+	}
+
+	tr.Downloader, err = torrent.NewDownloader(tr)
+	if err != nil {
+		t.Fatalf("error creating downloader: %v", err)
+	}
+	t.Cleanup(func() { tr.Downloader.Close() })
+	if _, err := tr.Downloader.Recheck(nil); err != nil {
+		t.Fatalf("error checking data: %v", err)
+	}
+
+	return tr
+}
+
+func TestSwarmJoin(t *testing.T) {
+	tr := newSwarmTestTorrent(t)
+
+	s := NewSwarm()
+	p := NewPeer(net.ParseIP("10.0.0.1"), 6881)
+	if err := s.join(p, tr); err != nil {
+		t.Fatalf("error joining swarm: %v", err)
+	}
+	s.broadcastHave(1)
+
+	// bitfield is queued before any have broadcast to the swarm
+	bitfield, err := BuildBitFieldMessage(tr.Downloader.Bitfield())
+	if err != nil {
+		t.Fatalf("error building bitfield: %v", err)
+	}
+	for _, expected := range [][]byte{bitfield, BuildHaveMessage(1)} {
+		select {
+		case msg := <-p.outbox:
+			if !bytes.Equal(msg, expected) {
+				t.Errorf("message mismatch, expected: %v, got: %v", expected, msg)
+			}
+		default:
+			t.Fatalf("expected message %v to be queued", expected)
+		}
+	}
+}
+
+func TestSwarmUpdateInterest(t *testing.T) {
+	var testCases = map[string]struct {
+		peerHas            []int
+		expectedInterested bool
+	}{
+		"peer has only pieces we have": {
+			peerHas:            []int{0},
+			expectedInterested: false,
+		},
+		"peer has pieces we need": {
+			peerHas:            []int{0, 1},
+			expectedInterested: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tr := newSwarmTestTorrent(t)
+
+			s := NewSwarm()
+			p := NewPeer(net.ParseIP("10.0.0.1"), 6881)
+			for _, pieceIdx := range test.peerHas {
+				p.setPiece(pieceIdx, tr.PiecesCount)
+			}
+			p.AmInterested.Store(true)
+			s.Add(p)
+
+			s.updateInterest(tr)
+
+			if p.AmInterested.Load() != test.expectedInterested {
+				t.Errorf("interested mismatch, expected: %v, got: %v", test.expectedInterested, p.AmInterested.Load())
+			}
+
+			select {
+			case msg := <-p.outbox:
+				if test.expectedInterested || !bytes.Equal(msg, BuildNotInterestedMessage()) {
+					t.Errorf("unexpected message: %v", msg)
+				}
+			default:
+				if !test.expectedInterested {
+					t.Errorf("expected not interested to be queued")
+				}
+			}
+		})
+	}
+}
@@ -3,12 +3,10 @@ package peer
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"my-bittorrent/torrent"
 	"net"
 	"time"
@@ -17,11 +15,11 @@ import (
 
 const connTimeout = 5 * time.Second
 const handshakeReadTimeout = 20 * time.Second
-const messageReadTimeout = 1 * time.Minute
 
 func ConnectTCP(peer *Peer) (net.Conn, error) {
-	// Create the address string in the format "IP:Port"
-	addr := fmt.Sprintf("%s:%d", peer.IPAddress.String(), peer.Port)
+	// Create the address string in the format "IP:Port", IPv6 addresses
+	// are enclosed in brackets e.g. "[::1]:6881"
+	addr := peer.String()
 	conn, err := net.DialTimeout("tcp", addr, connTimeout)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to peer %s: %w", addr, err)
@@ -48,9 +46,65 @@ func SendMessage(conn net.Conn, message []byte) error {
 	return nil
 }
 
+// ReceiveMessages serves the connection to the peer until it is closed or
+// ctx is cancelled, the handshake must already be exchanged
 func ReceiveMessages(ctx context.Context, p *Peer, t *torrent.Torrent) {
+	// Handshake is already exchanged, bitfield is the first message
+	if err := sendBitfield(p, t); err != nil {
+		log.Println(err)
+		p.Conn.Close()
+		return
+	}
+
+	receiveMessages(ctx, p, t)
+}
+
+// receiveMessages serves the connection to the peer once the bitfield is
+// queued to be sent
+func receiveMessages(ctx context.Context, p *Peer, t *torrent.Torrent) {
 	defer p.Conn.Close()
-	isHandshake := true // first message is handshake message
+
+	// To stop the goroutines serving the connection once reading stops
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Blocks still in flight are requested from other peers, and the
+	// pieces of the peer are no longer available
+	defer func() {
+		t.Downloader.ReleasePeer(p.String())
+		t.Picker.PeerGone(p.piecesSnapshot())
+	}()
+
+	// Snubbing and idleness are measured from the start of the connection
+	p.touchPiece()
+	p.touchWrite()
+
+	readIdle := p.timeouts().ReadIdle
+
+	// Messages are read through a buffer, reads are unblocked once ctx is
+	// cancelled
+	r := newMessageReader(p.Conn, maxMessageLength(t.PiecesCount))
+	defer r.release()
+
+	stopReads := cancelReads(ctx, p.Conn)
+	defer stopReads()
+
+	// All messages to the peer are written by its writer, which flushes the
+	// queued messages before the connection is closed
+	go writeMessages(ctx, cancel, p, t)
+	defer func() {
+		cancel()
+		<-p.writerDone
+	}()
+
+	// Upload blocks requested by the peer
+	go serveRequests(ctx, p, t)
+
+	// Release blocks which the peer is too slow to send
+	go watchRequests(ctx, p, t)
+
+	// Keep the connection alive, and drop it once it is of no use
+	go watchIdle(ctx, cancel, p)
 
 	for {
 		select {
@@ -61,39 +115,22 @@ func ReceiveMessages(ctx context.Context, p *Peer, t *torrent.Torrent) {
 		default:
 			// fmt.Printf("waiting for message from peer: %s\n", p.Conn.RemoteAddr().String())
 
-			if isHandshake {
-				msg, err := ReadHandshakeMessage(ctx, p.Conn)
-				if err != nil {
-					log.Printf("error reading message: %v\n", err)
-					return
-				}
-
-				hloglen := math.Min(float64(len(msg)), 10)
-				hloglen2 := int(hloglen)
-				fmt.Printf("handshake message received from %s , message[:%d]: %v\n", p.Conn.RemoteAddr().String(), hloglen2, msg[:hloglen2])
-
-				// validate message
-				if valErr := IsHandshakeMessageValid(msg, t.InfoHash); valErr != nil {
-					// stop receiving messages
-					log.Println(valErr)
-					return
-				}
-
-				// copy(peer.ID, msg[48:68])
-
-				// Handshake received and validated, now we are ready to
-				// receive other messages
-				isHandshake = false
-				continue
-			}
-
 			// Read messages from the connection
-			msg, err := ReadMessage(ctx, p.Conn)
+			// Message is only valid until the next read
+			msg, err := r.readMessage(ctx, readIdle)
 			if err != nil {
 				log.Printf("error reading message: %v\n", err)
+				if errors.Is(err, errProtocol) {
+					p.misbehaved.Add(1)
+				}
 				return
 			}
 
+			// Keep-alive only resets the read deadline
+			if len(msg) == 0 {
+				continue
+			}
+
 			// Print message
 			// fmt.Printf("message received: %v\n", msg)
 
@@ -101,6 +138,7 @@ func ReceiveMessages(ctx context.Context, p *Peer, t *torrent.Torrent) {
 			parsedMsg, err := ParseMessage(msg)
 			if err != nil {
 				log.Printf("error parsing message: %v\n", err)
+				p.misbehaved.Add(1)
 				continue
 			}
 
@@ -110,33 +148,47 @@ func ReceiveMessages(ctx context.Context, p *Peer, t *torrent.Torrent) {
 	}
 }
 
+// sendBitfield sends the pieces we have to the peer, it should be the first
+// message after the handshake. Nothing is sent if we have no pieces
+func sendBitfield(p *Peer, t *torrent.Torrent) error {
+	have := t.Downloader.Bitfield()
+	if have.Count() == 0 {
+		return nil
+	}
+
+	msg, err := BuildBitFieldMessage(have)
+	if err != nil {
+		return fmt.Errorf("error building bitfield msg: %w", err)
+	}
+
+	if err := p.send(msg); err != nil {
+		return fmt.Errorf("error sending bitfield: %w", err)
+	}
+
+	return nil
+}
+
+// ReadHandshakeMessage reads the handshake message from the connection, it
+// fails if the handshake is not received within handshakeReadTimeout or ctx
+// is cancelled
 func ReadHandshakeMessage(ctx context.Context, conn net.Conn) ([]byte, error) {
-	// Set a deadline
+	stop := cancelReads(ctx, conn)
+	defer stop()
+
+	// Deadline is checked against ctx after it is set, as it would
+	// otherwise override the deadline set on cancellation
 	conn.SetReadDeadline(time.Now().Add(handshakeReadTimeout))
 	defer conn.SetReadDeadline(time.Time{})
 
-	// Decode message length
-	msgLen := 49 + utf8.RuneCountInString(ProtocolIdentifier)
-
-	// Channel for reading the message body
-	done := make(chan error, 1)
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read handshake message as ctx cancelled or timeout %w", err)
+	}
 
-	// Read message
-	var msg []byte
-	go func() {
-		msg = make([]byte, msgLen)
-		_, err := io.ReadFull(conn, msg)
-		done <- err
-	}()
+	// Read directly, nothing must be buffered beyond the handshake
 
-	// Wait for read to complete or context done
-	select {
-	case <-ctx.Done():
-		return nil, fmt.Errorf("failed to read handshake message as ctx cancelled or timeout %w", ctx.Err())
-	case err := <-done:
-		if err != nil {
-			return nil, fmt.Errorf("error reading handshake message %w", readError(err))
-		}
+	msg := make([]byte, 49+utf8.RuneCountInString(ProtocolIdentifier))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, fmt.Errorf("error reading handshake message %w", readError(ctx, err))
 	}
 
 	return msg, nil
@@ -174,82 +226,16 @@ func IsHandshakeMessageValid(responseMsg []byte, expectedInfoHash [20]byte) erro
 	return nil
 }
 
-// ReadMessage reads length prefix message from connection to peers
-// such as choke, unchoke, request, piece, etc
-// Returned value is message without the length prefix
-func ReadMessage(ctx context.Context, conn net.Conn) ([]byte, error) {
-	// Set a deadline
-	conn.SetReadDeadline(time.Now().Add(messageReadTimeout))
-	defer conn.SetReadDeadline(time.Time{})
-
-	const headerLen = 4 // 4 bytes for the length prefix
-
-	// Channel to signal completion or error
-	done := make(chan error, 1)
-
-	// Read header
-	var header []byte
-	go func() {
-		header = make([]byte, headerLen)
-		_, err := io.ReadFull(conn, header)
-		done <- err
-	}()
-
-	// Wait for read to complete or context done
-	select {
-	case <-ctx.Done():
-		return nil, fmt.Errorf("failed to read message header as ctx cancelled or timeout %v", ctx.Err())
-	case err := <-done:
-		if err != nil {
-			return nil, fmt.Errorf("error reading message header %v", readError(err))
-		}
-	}
-
-	// Decode message length
-	msgLen := binary.BigEndian.Uint32(header)
-
-	if msgLen == 0 {
-		fmt.Println("0 len msg", header)
-		return []byte{}, nil
-	}
-
-	// Create another channel for reading the message payload
-	done = make(chan error, 1)
-
-	// Read message
-	var msg []byte
-	go func() {
-		msg = make([]byte, msgLen)
-		_, err := io.ReadFull(conn, msg)
-		done <- err
-	}()
-
-	// Wait for read to complete or context done
-	select {
-	case <-ctx.Done():
-		return nil, fmt.Errorf("failed to read message as ctx cancelled or timeout %w", ctx.Err())
-	case err := <-done:
-		if err != nil {
-			return nil, fmt.Errorf("error reading message %w", readError(err))
-		}
-	}
-
-	// logging
-	// loglen := math.Min(float64(len(msg)), 10)
-	// loglen2 := int(loglen)
-	// log.Printf(
-	// 	"message read completed from: %s, message[:%d]: %v\n",
-	// 	conn.RemoteAddr().String(),
-	// 	loglen2,
-	// 	msg[:loglen2],
-	// )
-
-	return msg, nil
-}
+// errProtocol is wrapped by the errors caused by peers violating the
+// protocol, which count towards banning the peer
+var errProtocol = errors.New("protocol violation")
 
 // getReadErrorType returns the formatted the error message which is
 // more verbose and clear based for the error
-func readError(err error) error {
+func readError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("read cancelled: %w", ctx.Err())
+	}
 	if errors.Is(err, io.EOF) {
 		return fmt.Errorf("connection closed by peer: %w", err)
 	}
@@ -266,7 +252,7 @@ func messageRouter(m *Message, p *Peer, t *torrent.Torrent) {
 
 	switch m.ID {
 	case 0:
-		err = chokeMsgHandler(p)
+		err = chokeMsgHandler(p, t)
 		if err != nil {
 			log.Printf("error in choke msg handler: %v", err)
 		}
@@ -275,6 +261,16 @@ func messageRouter(m *Message, p *Peer, t *torrent.Torrent) {
 		if err != nil {
 			log.Printf("error in unchoke msg handler: %v", err)
 		}
+	case 2:
+		err = interestedMsgHandler(p)
+		if err != nil {
+			log.Printf("error in interested msg handler: %v", err)
+		}
+	case 3:
+		err = notInterestedMsgHandler(p)
+		if err != nil {
+			log.Printf("error in not interested msg handler: %v", err)
+		}
 	case 4:
 		err = haveMsgHandler(m.Payload, p, t)
 		if err != nil {
@@ -285,11 +281,26 @@ func messageRouter(m *Message, p *Peer, t *torrent.Torrent) {
 		if err != nil {
 			log.Printf("error in bitfield msg handler: %v", err)
 		}
+	case 6:
+		err = requestMsgHandler(m.Payload, p, t)
+		if err != nil {
+			log.Printf("error in request msg handler: %v", err)
+		}
 	case 7:
 		err = pieceMsgHandler(m.Payload, p, t)
 		if err != nil {
 			log.Printf("error in piece msg handler: %v", err)
 		}
+	case 8:
+		err = cancelMsgHandler(m.Payload, p)
+		if err != nil {
+			log.Printf("error in cancel msg handler: %v", err)
+		}
+	}
+
+	// Protocol violations count towards banning the peer
+	if errors.Is(err, errProtocol) {
+		p.misbehaved.Add(1)
 	}
 }
 
@@ -2,6 +2,7 @@ package peer
 
 import (
 	"encoding/hex"
+	"net"
 	"testing"
 )
 
@@ -35,3 +36,20 @@ func TestIsHandshakeMessageValid(t *testing.T) {
 		})
 	}
 }
+
+func TestConnectTCPIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 not available: %v", err)
+	}
+	defer ln.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	p := NewPeer(addr.IP, uint16(addr.Port))
+
+	conn, err := ConnectTCP(p)
+	if err != nil {
+		t.Fatalf("error connecting to IPv6 peer: %v", err)
+	}
+	conn.Close()
+}
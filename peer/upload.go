@@ -0,0 +1,126 @@
+package peer
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"my-bittorrent/queue"
+	"my-bittorrent/torrent"
+)
+
+// maxRequestLength is the largest block a peer is allowed to request,
+// requests for larger blocks are dropped
+const maxRequestLength = 128 * 1024 // 128 KB
+
+// maxPendingRequests is the number of requests from a peer which can be
+// queued, requests beyond it are dropped
+const maxPendingRequests = 250
+
+// addRequest queues a request received from the peer to be served
+func (p *Peer) addRequest(b *queue.Block) error {
+	p.rqmu.Lock()
+	defer p.rqmu.Unlock()
+
+	if len(p.requests) >= maxPendingRequests {
+		return fmt.Errorf("too many pending requests: %d", len(p.requests))
+	}
+
+	p.requests = append(p.requests, b)
+
+	// notify without blocking, a pending notification is enough
+	select {
+	case p.requestsCh <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// cancelRequest removes a queued request which has not been served yet
+func (p *Peer) cancelRequest(b *queue.Block) bool {
+	p.rqmu.Lock()
+	defer p.rqmu.Unlock()
+
+	for i, r := range p.requests {
+		if *r == *b {
+			p.requests = append(p.requests[:i], p.requests[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// clearRequests drops all the queued requests, pending requests are
+// discarded when the peer is choked
+func (p *Peer) clearRequests() {
+	p.rqmu.Lock()
+	defer p.rqmu.Unlock()
+
+	p.requests = nil
+}
+
+// nextRequest removes and returns the oldest queued request, nil if
+// there are none
+func (p *Peer) nextRequest() *queue.Block {
+	p.rqmu.Lock()
+	defer p.rqmu.Unlock()
+
+	if len(p.requests) == 0 {
+		return nil
+	}
+
+	b := p.requests[0]
+	p.requests = p.requests[1:]
+
+	return b
+}
+
+// serveRequests sends the blocks requested by the peer in the order they
+// were requested, until ctx is cancelled
+func serveRequests(ctx context.Context, p *Peer, t *torrent.Torrent) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.requestsCh:
+		}
+
+		for b := p.nextRequest(); b != nil; b = p.nextRequest() {
+			if err := uploadBlock(p, b, t); err != nil {
+				log.Printf("error uploading block [%d][%d] to %s: %v\n", b.PieceIdx, b.BlockOffset, p, err)
+			}
+		}
+	}
+}
+
+// uploadBlock reads a block from disk and queues it to be sent to the peer
+func uploadBlock(p *Peer, b *queue.Block, t *torrent.Torrent) error {
+	data, err := t.Downloader.ReadBlock(b.PieceIdx, b.BlockOffset, b.BlockLength)
+	if err != nil {
+		return fmt.Errorf("error reading block: %w", err)
+	}
+
+	// Uploaded bytes are accounted by the writer once the block is sent
+	err = p.send(BuildPieceMessage(b.PieceIdx, b.BlockOffset, data))
+	if err != nil {
+		return fmt.Errorf("error sending piece: %w", err)
+	}
+
+	return nil
+}
+
+// parseRequestMsg parses payload of request and cancel messages
+// <index><begin><length>
+func parseRequestMsg(payload []byte) (*queue.Block, error) {
+	if len(payload) != 12 {
+		return nil, fmt.Errorf("payload should be 12 bytes, got %d", len(payload))
+	}
+
+	pieceIdx := binary.BigEndian.Uint32(payload[0:4])
+	blockOffset := binary.BigEndian.Uint32(payload[4:8])
+	blockLength := binary.BigEndian.Uint32(payload[8:12])
+
+	return queue.NewBlock(int(pieceIdx), int(blockOffset), int(blockLength)), nil
+}
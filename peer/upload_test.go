@@ -0,0 +1,84 @@
+package peer
+
+import (
+	"my-bittorrent/queue"
+	"net"
+	"testing"
+)
+
+func TestParseRequestMsg(t *testing.T) {
+	msg := BuildRequestMessage(3, 16384, 16384)
+
+	// skip length prefix and message ID
+	b, err := parseRequestMsg(msg[5:])
+	if err != nil {
+		t.Fatalf("error parsing request: %v", err)
+	}
+
+	expected := queue.Block{PieceIdx: 3, BlockOffset: 16384, BlockLength: 16384}
+	if *b != expected {
+		t.Errorf("block mismatch, expected: %+v, got: %+v", expected, *b)
+	}
+
+	if _, err := parseRequestMsg(msg[5:16]); err == nil {
+		t.Errorf("expected error for short payload")
+	}
+}
+
+func TestRequestQueue(t *testing.T) {
+	p := NewPeer(net.ParseIP("10.0.0.1"), 6881)
+
+	blocks := []*queue.Block{
+		queue.NewBlock(0, 0, 16384),
+		queue.NewBlock(0, 16384, 16384),
+		queue.NewBlock(1, 0, 16384),
+	}
+
+	for _, b := range blocks {
+		if err := p.addRequest(b); err != nil {
+			t.Fatalf("error adding request: %v", err)
+		}
+	}
+
+	// request is notified
+	select {
+	case <-p.requestsCh:
+	default:
+		t.Errorf("expected request notification")
+	}
+
+	// cancel the second request
+	if !p.cancelRequest(queue.NewBlock(0, 16384, 16384)) {
+		t.Errorf("expected request to be cancelled")
+	}
+
+	if p.cancelRequest(queue.NewBlock(5, 0, 16384)) {
+		t.Errorf("expected no request to be cancelled")
+	}
+
+	// remaining requests are served in order
+	for _, expected := range []*queue.Block{blocks[0], blocks[2]} {
+		b := p.nextRequest()
+		if b == nil || *b != *expected {
+			t.Errorf("request mismatch, expected: %+v, got: %+v", expected, b)
+		}
+	}
+
+	if b := p.nextRequest(); b != nil {
+		t.Errorf("expected no more requests, got: %+v", b)
+	}
+}
+
+func TestRequestQueueLimit(t *testing.T) {
+	p := NewPeer(net.ParseIP("10.0.0.1"), 6881)
+
+	for i := 0; i < maxPendingRequests; i++ {
+		if err := p.addRequest(queue.NewBlock(i, 0, 16384)); err != nil {
+			t.Fatalf("error adding request: %v", err)
+		}
+	}
+
+	if err := p.addRequest(queue.NewBlock(0, 0, 16384)); err == nil {
+		t.Errorf("expected error when too many requests are pending")
+	}
+}
@@ -0,0 +1,142 @@
+package peer
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"my-bittorrent/torrent"
+	"time"
+)
+
+// outboxSize is the number of messages which can be queued to be sent to a
+// peer, senders block once it is full
+const outboxSize = 256
+
+// writeBufferSize is the size of the buffer messages are coalesced in
+// before being written to the connection, it fits a couple of blocks
+const writeBufferSize = 64 * 1024 // 64 KB
+
+// writeTimeout is how long a write to the peer can take before the
+// connection is considered dead
+const writeTimeout = 30 * time.Second
+
+// flushTimeout is how long the messages still queued are given to be
+// written once the connection is shutting down
+const flushTimeout = 1 * time.Second
+
+// send queues the message to be written to the peer by its writer. It
+// blocks while the queue is full, and fails once the writer has stopped
+func (p *Peer) send(msg []byte) error {
+	select {
+	case <-p.writerDone:
+		return fmt.Errorf("failed to send message to peer %s: connection closed", p)
+	default:
+	}
+
+	select {
+	case p.outbox <- msg:
+		return nil
+	case <-p.writerDone:
+		return fmt.Errorf("failed to send message to peer %s: connection closed", p)
+	}
+}
+
+// writeMessages is the only writer to the connection once messages are
+// being exchanged with the peer. Queued messages are coalesced and written
+// until ctx is cancelled, the messages still queued are then flushed. The
+// connection is cancelled if writing fails
+func writeMessages(ctx context.Context, cancel context.CancelFunc, p *Peer, t *torrent.Torrent) {
+	defer close(p.writerDone)
+
+	w := &messageWriter{
+		p:  p,
+		t:  t,
+		bw: bufio.NewWriterSize(p.Conn, writeBufferSize),
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Write whatever was queued before shutting down
+			if err := w.writeQueued(flushTimeout); err != nil {
+				log.Printf("error flushing messages to %s: %v\n", p, err)
+			}
+			return
+		case msg := <-p.outbox:
+			err := w.write(msg)
+			if err == nil {
+				err = w.writeQueued(writeTimeout)
+			}
+
+			if err != nil {
+				log.Printf("error writing messages to %s: %v\n", p, err)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// messageWriter buffers messages written to the peer, and accounts the
+// blocks uploaded once they are flushed
+type messageWriter struct {
+	p  *Peer
+	t  *torrent.Torrent
+	bw *bufio.Writer
+
+	uploaded int // bytes of blocks buffered but not yet flushed
+}
+
+// write buffers the message, the buffer is written to the connection
+// once it is full
+func (w *messageWriter) write(msg []byte) error {
+	w.p.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+	if _, err := w.bw.Write(msg); err != nil {
+		return err
+	}
+
+	w.uploaded += blockLength(msg)
+
+	return nil
+}
+
+// writeQueued buffers the messages already queued, and flushes the buffer
+// once the queue is empty, within timeout
+func (w *messageWriter) writeQueued(timeout time.Duration) error {
+	// writer is the only receiver, so a queued message is never missed
+	for len(w.p.outbox) > 0 {
+		if err := w.write(<-w.p.outbox); err != nil {
+			return err
+		}
+	}
+
+	w.p.Conn.SetWriteDeadline(time.Now().Add(timeout))
+
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+
+	w.p.touchWrite()
+
+	if w.uploaded > 0 {
+		w.p.Uploaded.Add(int64(w.uploaded))
+		w.t.Downloader.AddUploaded(w.uploaded)
+		w.uploaded = 0
+	}
+
+	return nil
+}
+
+// blockLength returns the length of the block in a piece message, zero for
+// other messages
+// <len=0009+X><id=7><index><begin><block>
+func blockLength(msg []byte) int {
+	if len(msg) < 13 || messageID(msg[4]) != Piece {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint32(msg[0:4])) - 9
+}
@@ -0,0 +1,134 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"my-bittorrent/torrent"
+	"net"
+	"testing"
+	"time"
+)
+
+// startWriter starts the writer of the peer until the test ends
+func startWriter(t *testing.T, p *Peer, tr *torrent.Torrent) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go writeMessages(ctx, cancel, p, tr)
+
+	t.Cleanup(func() {
+		cancel()
+		<-p.writerDone
+	})
+}
+
+func TestWriteMessages(t *testing.T) {
+	tr := &torrent.Torrent{Downloader: &torrent.Downloader{}}
+
+	p := NewPeer(net.ParseIP("10.0.0.1"), 6881)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	p.Conn = c1
+
+	block := bytes.Repeat([]byte{1}, 100)
+	msgs := [][]byte{
+		BuildUnchokeMessage(),
+		BuildHaveMessage(2),
+		BuildPieceMessage(2, 0, block),
+		BuildKeepAliveMessage(),
+	}
+
+	var expected []byte
+	for _, msg := range msgs {
+		if err := p.send(msg); err != nil {
+			t.Fatalf("error sending message: %v", err)
+		}
+		expected = append(expected, msg...)
+	}
+
+	startWriter(t, p, tr)
+
+	// messages are written in the order they are sent
+	got := make([]byte, len(expected))
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c2, got); err != nil {
+		t.Fatalf("error reading messages: %v", err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("messages mismatch, expected: %v, got: %v", expected, got)
+	}
+
+	// only the blocks are accounted as uploaded once flushed
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Uploaded.Load() != int64(len(block)) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if p.Uploaded.Load() != int64(len(block)) {
+		t.Errorf("uploaded mismatch, expected: %d, got: %d", len(block), p.Uploaded.Load())
+	}
+	if tr.Downloader.BytesUploaded() != int64(len(block)) {
+		t.Errorf("torrent uploaded mismatch, expected: %d, got: %d", len(block), tr.Downloader.BytesUploaded())
+	}
+}
+
+func TestWriteMessagesStop(t *testing.T) {
+	p := NewPeer(net.ParseIP("10.0.0.1"), 6881)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p.Conn = c1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go writeMessages(ctx, cancel, p, nil)
+
+	// writing fails once the connection is closed, which stops the writer
+	c1.Close()
+
+	if err := p.send(BuildInterestedMessage()); err != nil {
+		t.Fatalf("error queueing message: %v", err)
+	}
+
+	select {
+	case <-p.writerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected writer to stop")
+	}
+
+	if ctx.Err() == nil {
+		t.Errorf("expected connection to be cancelled")
+	}
+
+	if err := p.send(BuildInterestedMessage()); err == nil {
+		t.Errorf("expected error sending after the writer stopped")
+	}
+}
+
+func TestBlockLength(t *testing.T) {
+	var testCases = map[string]struct {
+		msg      []byte
+		expected int
+	}{
+		"piece": {
+			msg:      BuildPieceMessage(1, 0, make([]byte, 16384)),
+			expected: 16384,
+		},
+		"have": {
+			msg:      BuildHaveMessage(1),
+			expected: 0,
+		},
+		"keep-alive": {
+			msg:      BuildKeepAliveMessage(),
+			expected: 0,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if got := blockLength(test.msg); got != test.expected {
+				t.Errorf("expected: %d, got: %d", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package torrent
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Bitfield is a set of piece indices, stored in the format of the payload
+// of bitfield message. The high bit of the first byte is piece 0, spare
+// bits at the end of the last byte are always cleared
+type Bitfield struct {
+	bits []byte
+	n    int // number of pieces
+}
+
+// NewBitfield returns an empty bitfield for n pieces
+func NewBitfield(n int) *Bitfield {
+	return &Bitfield{
+		bits: make([]byte, (n+7)/8),
+		n:    n,
+	}
+}
+
+// DecodeBitfield decodes the payload of a bitfield message for a torrent
+// with n pieces. The payload should be exactly as long as needed for n pieces
+// and the spare bits should be cleared
+func DecodeBitfield(data []byte, n int) (*Bitfield, error) {
+	expectedLen := (n + 7) / 8
+	if len(data) != expectedLen {
+		return nil, fmt.Errorf("bitfield length mismatch, expected: %d bytes, got: %d", expectedLen, len(data))
+	}
+
+	if spare := n % 8; spare != 0 && data[len(data)-1]&(0xff>>spare) != 0 {
+		return nil, fmt.Errorf("bitfield spare bits are set: %08b", data[len(data)-1])
+	}
+
+	bf := NewBitfield(n)
+	copy(bf.bits, data)
+
+	return bf, nil
+}
+
+// Len returns the number of pieces the bitfield can hold
+func (bf *Bitfield) Len() int {
+	return bf.n
+}
+
+// Set adds the piece to the set, out of range indices are ignored
+func (bf *Bitfield) Set(pieceIdx int) {
+	if pieceIdx < 0 || pieceIdx >= bf.n {
+		return
+	}
+
+	bf.bits[pieceIdx/8] |= 1 << (7 - pieceIdx%8)
+}
+
+// Unset removes the piece from the set
+func (bf *Bitfield) Unset(pieceIdx int) {
+	if pieceIdx < 0 || pieceIdx >= bf.n {
+		return
+	}
+
+	bf.bits[pieceIdx/8] &^= 1 << (7 - pieceIdx%8)
+}
+
+// Has returns true if the piece is in the set
+func (bf *Bitfield) Has(pieceIdx int) bool {
+	if pieceIdx < 0 || pieceIdx >= bf.n {
+		return false
+	}
+
+	return bf.bits[pieceIdx/8]&(1<<(7-pieceIdx%8)) != 0
+}
+
+// Count returns the number of pieces in the set
+func (bf *Bitfield) Count() int {
+	var count int
+	for _, b := range bf.bits {
+		count += bits.OnesCount8(b)
+	}
+
+	return count
+}
+
+// ForEach calls fn for every piece in the set, in increasing order
+func (bf *Bitfield) ForEach(fn func(pieceIdx int)) {
+	for i, b := range bf.bits {
+		for b != 0 {
+			// high bit is the lowest index
+			bit := bits.LeadingZeros8(b)
+			fn(i*8 + bit)
+			b &^= 1 << (7 - bit)
+		}
+	}
+}
+
+// AndNot returns the pieces which are in bf but not in other, e.g. the
+// pieces a peer has which we don't
+func (bf *Bitfield) AndNot(other *Bitfield) *Bitfield {
+	res := bf.Clone()
+
+	for i := range res.bits {
+		if i < len(other.bits) {
+			res.bits[i] &^= other.bits[i]
+		}
+	}
+
+	return res
+}
+
+// Clone returns a copy of the bitfield
+func (bf *Bitfield) Clone() *Bitfield {
+	return &Bitfield{
+		bits: append([]byte(nil), bf.bits...),
+		n:    bf.n,
+	}
+}
+
+// Bytes returns the bitfield in the format of the payload of bitfield message
+func (bf *Bitfield) Bytes() []byte {
+	return append([]byte(nil), bf.bits...)
+}
@@ -0,0 +1,119 @@
+package torrent
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// bitfieldOf returns a bitfield for n pieces with the given pieces set
+func bitfieldOf(n int, pieces ...int) *Bitfield {
+	bf := NewBitfield(n)
+	for _, pieceIdx := range pieces {
+		bf.Set(pieceIdx)
+	}
+	return bf
+}
+
+func TestBitfield(t *testing.T) {
+	bf := bitfieldOf(12, 0, 3, 11, 12, -1)
+
+	if got := bf.Bytes(); !bytes.Equal(got, []byte{0b10010000, 0b00010000}) {
+		t.Errorf("bytes mismatch, got: %08b", got)
+	}
+
+	for pieceIdx, expected := range map[int]bool{0: true, 1: false, 3: true, 11: true, 12: false, -1: false} {
+		if got := bf.Has(pieceIdx); got != expected {
+			t.Errorf("has %d mismatch, expected: %v, got: %v", pieceIdx, expected, got)
+		}
+	}
+
+	if got := bf.Count(); got != 3 {
+		t.Errorf("count mismatch, expected: 3, got: %d", got)
+	}
+
+	var pieces []int
+	bf.ForEach(func(pieceIdx int) { pieces = append(pieces, pieceIdx) })
+	if !reflect.DeepEqual(pieces, []int{0, 3, 11}) {
+		t.Errorf("pieces mismatch, expected: [0 3 11], got: %v", pieces)
+	}
+
+	bf.Unset(3)
+	if bf.Has(3) || bf.Count() != 2 {
+		t.Errorf("expected piece 3 to be unset")
+	}
+}
+
+func TestBitfieldAndNot(t *testing.T) {
+	theirs := bitfieldOf(10, 1, 2, 8, 9)
+	ours := bitfieldOf(10, 2, 9)
+
+	var pieces []int
+	theirs.AndNot(ours).ForEach(func(pieceIdx int) { pieces = append(pieces, pieceIdx) })
+
+	if !reflect.DeepEqual(pieces, []int{1, 8}) {
+		t.Errorf("pieces mismatch, expected: [1 8], got: %v", pieces)
+	}
+
+	// operands are left untouched
+	if theirs.Count() != 4 || ours.Count() != 2 {
+		t.Errorf("operands modified by AndNot")
+	}
+}
+
+func TestDecodeBitfield(t *testing.T) {
+	var testCases = map[string]struct {
+		data          []byte
+		n             int
+		expected      []int
+		expectedError bool
+	}{
+		"full bytes": {
+			data:     []byte{0b10000001, 0b01000000},
+			n:        16,
+			expected: []int{0, 7, 9},
+		},
+		"spare bits cleared": {
+			data:     []byte{0b11111111, 0b11100000},
+			n:        11,
+			expected: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+		},
+		"spare bits set": {
+			data:          []byte{0b11111111, 0b11110000},
+			n:             11,
+			expectedError: true,
+		},
+		"too short": {
+			data:          []byte{0xff},
+			n:             11,
+			expectedError: true,
+		},
+		"too long": {
+			data:          []byte{0xff, 0x00, 0x00},
+			n:             11,
+			expectedError: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			bf, err := DecodeBitfield(test.data, test.n)
+			if (err != nil) != test.expectedError {
+				t.Fatalf("expected error: %v, got: %v", test.expectedError, err)
+			}
+			if err != nil {
+				return
+			}
+
+			var pieces []int
+			bf.ForEach(func(pieceIdx int) { pieces = append(pieces, pieceIdx) })
+
+			if !reflect.DeepEqual(pieces, test.expected) {
+				t.Errorf("pieces mismatch, expected: %v, got: %v", test.expected, pieces)
+			}
+			if !bytes.Equal(bf.Bytes(), test.data) {
+				t.Errorf("encoding mismatch, expected: %08b, got: %08b", test.data, bf.Bytes())
+			}
+		})
+	}
+}
@@ -8,27 +8,43 @@ import (
 	"io"
 	"log"
 	"my-bittorrent/queue"
-	"os"
-	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const defaultWriteChanBuffer int = 10
 const downloadFolder string = "./downloads"
-const torrentSparseFileName string = "torrent.data"
+
+// requestTimeout is how long a peer has to send a requested block, after
+// which the block can be picked for other peers
+const requestTimeout = 30 * time.Second
 
 type Downloader struct {
 	requestedBlocks      [][]bool
-	rbmu                 sync.Mutex // To synchronize access to requestedBlocks
+	rbmu                 sync.Mutex                           // To synchronize access to requestedBlocks and inflight
+	inflight             map[string]map[queue.Block]time.Time // Deadline of the blocks requested from each peer which are yet to be received
 	downloadedBlocks     [][]bool
 	downloadedBlocksData [][][]byte    // To hold block data until it's persisted
 	dbmu                 sync.Mutex    // To synchronize access to downloadedBlocks and downloadedBlocksData
-	persistedPieces      []bool        // Pieces which have been saved to sparse file on disk
-	f                    *os.File      // Torrent sparse file
+	persistedPieces      *Bitfield     // Pieces which have been saved to disk, guarded by dbmu
+	piecePriority        []Priority    // Priority of each piece, pieces of skipped files are not downloaded, guarded by dbmu
+	storage              Storage       // Torrent data
 	writesCh             chan *Piece   // To receive writes while making writes to file go-routine safe
 	once                 sync.Once     // To close writeCh
+	started              atomic.Bool   // Whether writes are being received
+	wmu                  sync.RWMutex  // To send to writesCh only while it is open
+	writesClosed         bool          // Whether writesCh is closed, guarded by wmu
 	writesCompletedCh    chan struct{} // To notify when all writes are completed
-	PieceHash            [][20]byte    // sha-1 hash for all the pieces
+	completedCh          chan struct{} // Closed when download is complete
+	havesCh              chan int      // To notify pieces which are persisted and can be announced to peers
+	bytesDownloaded      atomic.Int64  // Bytes of all the blocks received
+	bytesUploaded        atomic.Int64  // Bytes of all the blocks sent to peers
+	bytesVerified        atomic.Int64  // Bytes of the pieces whose hash is verified
+	checked              bool          // Whether the data on disk was hash checked while loading the resume file
+	fileLength           int64
+	infoHash             [20]byte   // To match the resume file with the torrent
+	PieceHash            [][20]byte // sha-1 hash for all the pieces
 	PieceLength          int
 }
 
@@ -39,22 +55,33 @@ type Piece struct {
 }
 
 func NewDownloader(t *Torrent) (*Downloader, error) {
-	f, err := createDownloadFile(t.Name)
+	openStorage := t.Storage
+	if openStorage == nil {
+		openStorage = DefaultStorage
+	}
+
+	storage, err := openStorage(t)
 	if err != nil {
-		return nil, fmt.Errorf("error creating new file: %w", err)
+		return nil, fmt.Errorf("error opening storage: %w", err)
 	}
 
 	d := &Downloader{
 		requestedBlocks:      make([][]bool, t.PiecesCount),
 		rbmu:                 sync.Mutex{},
+		inflight:             make(map[string]map[queue.Block]time.Time),
 		downloadedBlocks:     make([][]bool, t.PiecesCount),
 		downloadedBlocksData: make([][][]byte, t.PiecesCount),
 		dbmu:                 sync.Mutex{},
-		persistedPieces:      make([]bool, t.PiecesCount),
-		f:                    f,
+		persistedPieces:      NewBitfield(t.PiecesCount),
+		piecePriority:        t.piecePriorities(),
+		storage:              storage,
 		writesCh:             make(chan *Piece, defaultWriteChanBuffer),
 		once:                 sync.Once{},
 		writesCompletedCh:    make(chan struct{}),
+		completedCh:          make(chan struct{}),
+		havesCh:              make(chan int, t.PiecesCount),
+		fileLength:           t.FileLength,
+		infoHash:             t.InfoHash,
 		PieceHash:            t.PieceHash,
 		PieceLength:          t.PieceLength,
 	}
@@ -62,6 +89,7 @@ func NewDownloader(t *Torrent) (*Downloader, error) {
 	for i := 0; i < t.PiecesCount; i++ {
 		blocksCount, err := t.GetBlocksCount(i)
 		if err != nil {
+			storage.Close()
 			return nil, fmt.Errorf("error getting blocks count for piece idx: %d, error: %w", i, err)
 		}
 
@@ -70,6 +98,12 @@ func NewDownloader(t *Torrent) (*Downloader, error) {
 		d.requestedBlocks[i] = make([]bool, blocksCount)
 	}
 
+	// Continue from where the download stopped
+	if err := d.loadResume(); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("error resuming download: %w", err)
+	}
+
 	log.Printf("Downloader ready. blocks for first piece: %d, blocks for last: %d\n",
 		len(d.downloadedBlocks[0]),
 		len(d.downloadedBlocks[t.PiecesCount-1]),
@@ -80,50 +114,11 @@ func NewDownloader(t *Torrent) (*Downloader, error) {
 
 func (d *Downloader) Start() {
 	// Start receiving writes
-	go func() {
-		d.receiveWrites()
-	}()
-
-}
-
-// createDownloadFile creates a new sparse file or truncates existing file with same name
-// for saving pieces to disk
-func createDownloadFile(torrentName string) (*os.File, error) {
-	// Check if ./downloads folder exists, if not create one
-	if err := existsIfNotCreateOne(downloadFolder); err != nil {
-		return nil, fmt.Errorf("error creating download dir: %v", err)
+	if d.started.CompareAndSwap(false, true) {
+		go func() {
+			d.receiveWrites()
+		}()
 	}
-
-	// Check if folder for torrent exists inside download folder, if not create one
-	dir := filepath.Join(downloadFolder, torrentName)
-	if err := existsIfNotCreateOne(dir); err != nil {
-		return nil, fmt.Errorf("error creating torrent dir: %v", err)
-	}
-
-	// Create/truncate sparse file
-	path := filepath.Join(dir, torrentSparseFileName)
-	f, err := os.Create(path)
-	if err != nil {
-		return nil, fmt.Errorf("error creating torrent sparse file: %v", err)
-	}
-
-	return f, nil
-}
-
-// existsIfNotCreateOne checks if a directory exists, if not it creates one
-// returns nil error on success
-func existsIfNotCreateOne(dir string) error {
-	if _, err := os.Stat(dir); err != nil {
-		if os.IsNotExist(err) {
-			// Create dir
-			if creatDirErr := os.Mkdir(dir, 0755); creatDirErr != nil {
-				return creatDirErr
-			}
-			// Dir created successfully
-		}
-		// Dir exists
-	}
-	return nil
 }
 
 func (d *Downloader) receiveWrites() {
@@ -135,63 +130,172 @@ func (d *Downloader) receiveWrites() {
 
 		fmt.Printf("write received for piece offset: %d, idx: %d\n", p.Offset, pieceIdx)
 
-		if d.persistedPieces[pieceIdx] {
+		if d.HasPiece(int(pieceIdx)) {
 			fmt.Printf("skipping since already persisted: %d, idx: %d\n", p.Offset, pieceIdx)
 			continue
 		}
 
 		// Checking overwrite possible in range where we're going to write
-		if err := d.isOverwriting(p.Offset); err != nil {
+		if err := d.isOverwriting(int(pieceIdx), 0); err != nil {
 			log.Printf("cannot write piece due to overwrite, offset: %d, idx: %d, err:%v\n", p.Offset, pieceIdx, err)
 		}
-		if err := d.isOverwriting(p.Offset + int64(len(p.Data)-1)); err != nil {
+		if err := d.isOverwriting(int(pieceIdx), len(p.Data)-1); err != nil {
 			log.Printf("cannot write piece due to overwrite, offset: %d, idx: %d, err:%v\n", p.Offset+int64(len(p.Data)-1), pieceIdx, err)
 		}
 
 		// No overwrites
-		_, err := d.f.WriteAt(p.Data, p.Offset)
-		if err != nil {
-			log.Printf("error writing to file: %v", err)
+		if err := d.writePiece(int(pieceIdx), p.Data); err != nil {
+			log.Printf("error writing piece to storage, idx: %d, error: %v\n", pieceIdx, err)
+
+			// Piece is not persisted, its blocks are downloaded again
+			d.ResetPiece(int(pieceIdx))
+			d.bytesVerified.Add(-int64(len(p.Data)))
+			continue
 		}
 
 		piecesCount++
+		flushed := false
 
 		// Sync to disk after every 10 pieces received
 		if piecesCount == 10 {
-			// Flush to disk
-			if err := d.f.Sync(); err != nil {
-				log.Printf("error flushing file, idx: %d, error: %v", pieceIdx, err)
-				continue
-			}
-
-			log.Printf("flushed to disk at piece idx: %d\n", pieceIdx)
 			// Reset piece count
 			piecesCount = 0
+
+			// Flush to disk, the piece is written even if the flush fails
+			if err := d.storage.Flush(); err != nil {
+				log.Printf("error flushing storage, idx: %d, error: %v\n", pieceIdx, err)
+			} else {
+				log.Printf("flushed to disk at piece idx: %d\n", pieceIdx)
+				flushed = true
+			}
 		}
 
 		// Mark piece as persisted
-		d.persistedPieces[pieceIdx] = true
+		d.dbmu.Lock()
+		d.persistedPieces.Set(int(pieceIdx))
+		d.dbmu.Unlock()
+
+		// Save progress along with the flush to disk
+		if flushed {
+			if err := d.SaveResume(); err != nil {
+				log.Printf("error saving resume file: %v\n", err)
+			}
+		}
+
+		// Piece can now be uploaded, announce it to peers
+		d.havesCh <- int(pieceIdx)
 
 		fmt.Printf("write completed for piece offset: %d, idx: %d\n", p.Offset, pieceIdx)
 	}
 
 	// Notify that all the writes are completed
-	d.writesCompletedCh <- struct{}{}
+	close(d.havesCh)
+	close(d.writesCompletedCh)
+}
+
+// writePiece writes the verified piece to the storage
+func (d *Downloader) writePiece(pieceIdx int, data []byte) error {
+	if err := d.storage.WriteBlock(data, pieceIdx, 0); err != nil {
+		return err
+	}
+
+	return d.storage.MarkComplete(pieceIdx)
+}
+
+// WaitForWrites blocks until all the verified pieces are written to disk,
+// it should be called only after the download is complete
+func (d *Downloader) WaitForWrites() {
+	<-d.writesCompletedCh
+}
+
+// Checked returns true if the data on disk was already hash checked when the
+// downloader was created, as there was no valid resume file
+func (d *Downloader) Checked() bool {
+	return d.checked
+}
+
+// Haves returns a channel on which the index of every piece is sent once it
+// is verified and persisted. Channel is closed once all the writes are completed
+func (d *Downloader) Haves() <-chan int {
+	return d.havesCh
+}
+
+// HasPiece returns true if the piece is verified and persisted on disk,
+// only such pieces can be uploaded to peers
+func (d *Downloader) HasPiece(pieceIdx int) bool {
+	d.dbmu.Lock()
+	defer d.dbmu.Unlock()
+
+	return d.persistedPieces.Has(pieceIdx)
+}
+
+// Bitfield returns the pieces which can be uploaded to peers, i.e. the
+// pieces which are verified and persisted on disk
+func (d *Downloader) Bitfield() *Bitfield {
+	d.dbmu.Lock()
+	defer d.dbmu.Unlock()
+
+	return d.persistedPieces.Clone()
+}
+
+// ReadBlock reads a block of a persisted piece from disk
+func (d *Downloader) ReadBlock(pieceIdx, blockOffset, blockLength int) ([]byte, error) {
+	if !d.HasPiece(pieceIdx) {
+		return nil, fmt.Errorf("piece not available: %d", pieceIdx)
+	}
+
+	pieceOffset := int64(pieceIdx) * int64(d.PieceLength)
+	pieceLength := min(int64(d.PieceLength), d.fileLength-pieceOffset)
+
+	if blockOffset < 0 || blockLength <= 0 || int64(blockOffset+blockLength) > pieceLength {
+		return nil, fmt.Errorf("block out of range, piece: %d, offset: %d, length: %d", pieceIdx, blockOffset, blockLength)
+	}
+
+	data := make([]byte, blockLength)
+	if err := d.storage.ReadBlock(data, pieceIdx, blockOffset); err != nil {
+		return nil, fmt.Errorf("error reading block from storage: %v", err)
+	}
+
+	return data, nil
+}
+
+// Close writes the pieces which are verified but still queued, saves the
+// progress to the resume file and closes the storage
+func (d *Downloader) Close() error {
+	// Pieces verified from now on are dropped, they are downloaded again
+	// after a restart
+	d.closeWrites()
+	if d.started.CompareAndSwap(false, true) {
+		d.receiveWrites()
+	} else {
+		d.WaitForWrites()
+	}
+
+	if err := d.storage.Flush(); err != nil {
+		log.Printf("error flushing storage: %v\n", err)
+	}
+
+	if err := d.SaveResume(); err != nil {
+		log.Printf("error saving resume file: %v\n", err)
+	}
+
+	return d.storage.Close()
 }
 
 // isOverwriting checks if the current write is overwriting existing data
-func (d *Downloader) isOverwriting(offset int64) error {
+// at the offset within the piece
+func (d *Downloader) isOverwriting(pieceIdx, offset int) error {
 	// Read one byte at the offset
 	buf := make([]byte, 1)
-	_, err := d.f.ReadAt(buf, offset)
+	err := d.storage.ReadBlock(buf, pieceIdx, offset)
 
-	// If the offset is beyond EOF, the file will give io.EOF error, which
+	// If the data is not written yet, the storage may give io.EOF error, which
 	// we can ignore
 	if err != nil && !errors.Is(err, io.EOF) {
-		return fmt.Errorf("error reading at offset: %d, error: %v", offset, err)
+		return fmt.Errorf("error reading at piece: %d, offset: %d, error: %v", pieceIdx, offset, err)
 	}
 	if buf[0] != 0 {
-		return fmt.Errorf("data already present at offset: %d", offset)
+		return fmt.Errorf("data already present at piece: %d, offset: %d", pieceIdx, offset)
 	}
 
 	return nil
@@ -204,42 +308,67 @@ func (d *Downloader) Downloaded(b *queue.Block, blockData []byte) {
 		return
 	}
 
+	d.bytesDownloaded.Add(int64(len(blockData)))
+
+	piece := d.storeBlock(b, blockData)
+	if piece == nil {
+		return
+	}
+
+	// Piece download complete, verify piece hash for data integrity
+	expectedHash := d.PieceHash[b.PieceIdx]
+	gotHash := sha1.Sum(piece.Data)
+
+	if bytes.Equal(expectedHash[:], gotHash[:]) {
+		// Writes are closed before the piece is written if the piece is no
+		// longer wanted or the downloader is closed, it is dropped then
+		d.wmu.RLock()
+		if !d.writesClosed {
+			d.writesCh <- piece
+			d.bytesVerified.Add(int64(len(piece.Data)))
+		}
+		d.wmu.RUnlock()
+	} else {
+		log.Printf("Piece Hash mismatch for piece at idx: %d, expected: %v, got: %v\n", b.PieceIdx, expectedHash, gotHash)
+		// Piece is corrupted and hence the blocks need to be downloaded again
+		// Reset downloaded block data
+		d.ResetPiece(b.PieceIdx)
+	}
+}
+
+// storeBlock holds the block data until the piece is complete, and returns
+// the piece once all of its blocks are downloaded, nil otherwise
+func (d *Downloader) storeBlock(b *queue.Block, blockData []byte) *Piece {
 	d.dbmu.Lock()
 	defer d.dbmu.Unlock()
 
+	// Blocks requested before the piece was skipped are not needed
+	if d.priority(b.PieceIdx) == PrioritySkip {
+		return nil
+	}
+
+	// Duplicate blocks are expected in endgame, the first one is kept
+	if d.downloadedBlocks[b.PieceIdx][d.BlockIdx(b)] {
+		return nil
+	}
+
 	d.downloadedBlocks[b.PieceIdx][d.BlockIdx(b)] = true
 	d.downloadedBlocksData[b.PieceIdx][d.BlockIdx(b)] = blockData
 
-	// Todo: 1. Check if all the blocks for the pieces are downloaded, if yes
-	all := true
+	// Check if all the blocks for the pieces are downloaded
 	for _, val := range d.downloadedBlocks[b.PieceIdx] {
 		if !val {
-			all = false
-			break
+			return nil
 		}
 	}
 
-	if all {
-		// Piece download complete
-		piece, err := d.constructPiece(b.PieceIdx)
-		if err != nil {
-			log.Printf("Error constructing the piece at idx: %d, error: %v\n", b.PieceIdx, err)
-			return
-		}
-
-		// Verify piece hash for data integrity
-		expectedHash := d.PieceHash[b.PieceIdx]
-		gotHash := sha1.Sum(piece.Data)
-
-		if bytes.Equal(expectedHash[:], gotHash[:]) {
-			d.writesCh <- piece
-		} else {
-			log.Printf("Piece Hash mismatch for piece at idx: %d, expected: %v, got: %v\n", b.PieceIdx, expectedHash, gotHash)
-			// Piece is corrupted and hence the blocks need to be downloaded again
-			// Reset downloaded block data
-			d.ResetPiece(b.PieceIdx)
-		}
+	piece, err := d.constructPiece(b.PieceIdx)
+	if err != nil {
+		log.Printf("Error constructing the piece at idx: %d, error: %v\n", b.PieceIdx, err)
+		return nil
 	}
+
+	return piece
 }
 
 func (d *Downloader) constructPiece(pieceIdx int) (*Piece, error) {
@@ -259,23 +388,25 @@ func (d *Downloader) constructPiece(pieceIdx int) (*Piece, error) {
 	}, nil
 }
 
-// Resets the downloaded data for the piece
+// Resets the downloaded data for the piece, its blocks can be picked
+// again to be downloaded from peers
 func (d *Downloader) ResetPiece(pieceIdx int) {
+	d.rbmu.Lock()
 	d.dbmu.Lock()
-	// d.rbmu.Lock()
+	defer d.rbmu.Unlock()
 	defer d.dbmu.Unlock()
-	// defer d.rbmu.Unlock()
 
-	d.persistedPieces[pieceIdx] = false
+	d.persistedPieces.Unset(pieceIdx)
 	for i := 0; i < len(d.downloadedBlocks[pieceIdx]); i++ {
 		d.downloadedBlocks[pieceIdx][i] = false
 		d.downloadedBlocksData[pieceIdx][i] = nil
-		// d.requestedBlocks[pieceIdx][i] = false
+		d.requestedBlocks[pieceIdx][i] = false
 	}
 }
 
-// Requested should be called when a block is requested
-func (d *Downloader) Requested(b *queue.Block) {
+// Requested should be called when a block is requested from a peer, peer
+// is the address of the peer
+func (d *Downloader) Requested(b *queue.Block, peer string) {
 	if !d.IsValidBlock(b) {
 		log.Printf("Invalid block: requestedBlocks[%d][%d]", b.PieceIdx, d.BlockIdx(b))
 		return
@@ -284,33 +415,242 @@ func (d *Downloader) Requested(b *queue.Block) {
 	d.rbmu.Lock()
 	defer d.rbmu.Unlock()
 
+	d.markRequested(b, peer)
+}
+
+// markRequested marks the block as in flight to the peer, d.rbmu must be held
+func (d *Downloader) markRequested(b *queue.Block, peer string) {
 	d.requestedBlocks[b.PieceIdx][d.BlockIdx(b)] = true
+
+	if d.inflight == nil {
+		d.inflight = make(map[string]map[queue.Block]time.Time)
+	}
+	if d.inflight[peer] == nil {
+		d.inflight[peer] = make(map[queue.Block]time.Time)
+	}
+	d.inflight[peer][*b] = time.Now().Add(requestTimeout)
 }
 
-func (d *Downloader) IsNeeded(b *queue.Block) bool {
-	if !d.IsValidBlock(b) {
-		log.Printf("Invalid block: requestedBlocks[%d][%d]", b.PieceIdx, d.BlockIdx(b))
-		return false // todo: sending false is not proper way to handle error
+// pieceState returns whether the piece has blocks which are yet to be
+// requested, whether some of its blocks are requested or downloaded, and
+// whether all of its blocks are downloaded. d.rbmu and d.dbmu must be held
+func (d *Downloader) pieceState(pieceIdx int) (pending, partial, complete bool) {
+	complete = true
+
+	for blockIdx, downloaded := range d.downloadedBlocks[pieceIdx] {
+		requested := d.requestedBlocks[pieceIdx][blockIdx]
+
+		if downloaded || requested {
+			partial = true
+		}
+		if !downloaded {
+			complete = false
+			if !requested {
+				pending = true
+			}
+		}
+	}
+
+	return pending, partial && pending, complete
+}
+
+// requestNextBlock marks the first block of the piece which is yet to be
+// requested as requested from the peer and returns it, nil if there is no
+// such block. d.rbmu and d.dbmu must be held
+func (d *Downloader) requestNextBlock(pieceIdx int, peer string) *queue.Block {
+	for blockIdx, downloaded := range d.downloadedBlocks[pieceIdx] {
+		if downloaded || d.requestedBlocks[pieceIdx][blockIdx] {
+			continue
+		}
+
+		blockOffset := blockIdx * DefaultBlockLength
+		pieceLength := min(int64(d.PieceLength), d.fileLength-int64(pieceIdx)*int64(d.PieceLength))
+		blockLength := min(DefaultBlockLength, int(pieceLength)-blockOffset)
+
+		b := queue.NewBlock(pieceIdx, blockOffset, blockLength)
+		d.markRequested(b, peer)
+
+		return b
 	}
 
-	// check if all the pieces are requested
-	_, req, tot := d.progressReport()
+	return nil
+}
 
+// Received should be called when a block is received from a peer, the block
+// is no longer in flight to any peer. Returns the other peers the block was
+// requested from in endgame, the requests to them should be cancelled
+func (d *Downloader) Received(b *queue.Block, peer string) []string {
 	d.rbmu.Lock()
 	defer d.rbmu.Unlock()
 
-	if req == tot {
-		d.dbmu.Lock()
-		// we need to re-request the pieces which are not downloaded yet
-		for i := 0; i < len(d.requestedBlocks); i++ {
-			for j := 0; j < len(d.requestedBlocks[i]); j++ {
-				d.requestedBlocks = d.downloadedBlocks
-			}
+	delete(d.inflight[peer], *b)
+
+	var others []string
+	for other, blocks := range d.inflight {
+		if _, ok := blocks[*b]; ok {
+			delete(blocks, *b)
+			others = append(others, other)
 		}
-		d.dbmu.Unlock()
 	}
 
-	return !d.requestedBlocks[b.PieceIdx][d.BlockIdx(b)]
+	return others
+}
+
+// InFlight returns the number of blocks requested from the peer which are
+// yet to be received
+func (d *Downloader) InFlight(peer string) int {
+	d.rbmu.Lock()
+	defer d.rbmu.Unlock()
+
+	return len(d.inflight[peer])
+}
+
+// isInFlight returns true if the block is requested from any peer,
+// d.rbmu must be held
+func (d *Downloader) isInFlight(b queue.Block) bool {
+	for _, blocks := range d.inflight {
+		if _, ok := blocks[b]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inEndgame returns true once every block which is yet to be downloaded
+// is requested from some peer. d.rbmu and d.dbmu must be held
+func (d *Downloader) inEndgame() bool {
+	remaining := false
+
+	for pieceIdx := range d.downloadedBlocks {
+		if d.priority(pieceIdx) == PrioritySkip {
+			continue
+		}
+
+		pending, _, complete := d.pieceState(pieceIdx)
+		if pending {
+			return false
+		}
+		if !complete {
+			remaining = true
+		}
+	}
+
+	return remaining
+}
+
+// InEndgame returns true if the download is in endgame, where the
+// remaining blocks are requested from every peer which has them
+func (d *Downloader) InEndgame() bool {
+	d.rbmu.Lock()
+	d.dbmu.Lock()
+	defer d.rbmu.Unlock()
+	defer d.dbmu.Unlock()
+
+	return d.inEndgame()
+}
+
+// requestEndgameBlock marks a block which is in flight to other peers as
+// requested from the peer too, and returns it. Blocks requested from the
+// fewest peers are picked first. Returns nil if there is no such block.
+// d.rbmu and d.dbmu must be held
+func (d *Downloader) requestEndgameBlock(peer string, has func(pieceIdx int) bool) *queue.Block {
+	requests := make(map[queue.Block]int)
+	for _, blocks := range d.inflight {
+		for b := range blocks {
+			requests[b]++
+		}
+	}
+
+	var best *queue.Block
+	for b, count := range requests {
+		if _, ok := d.inflight[peer][b]; ok || !has(b.PieceIdx) {
+			continue
+		}
+		if d.downloadedBlocks[b.PieceIdx][d.BlockIdx(&b)] {
+			continue
+		}
+
+		if best == nil || count < requests[*best] {
+			best = queue.NewBlock(b.PieceIdx, b.BlockOffset, b.BlockLength)
+		}
+	}
+
+	if best != nil {
+		d.markRequested(best, peer)
+	}
+
+	return best
+}
+
+// ReleasePeer releases the blocks in flight to the peer, so that they can be
+// picked for other peers. It should be called when the peer chokes us,
+// disconnects or is snubbing us. Returns the blocks which were in flight
+func (d *Downloader) ReleasePeer(peer string) []queue.Block {
+	return d.release(peer, func(deadline time.Time) bool { return true })
+}
+
+// ReleaseExpired releases the blocks in flight to the peer whose deadline
+// has passed, so that they can be picked for other peers. Returns the
+// released blocks
+func (d *Downloader) ReleaseExpired(peer string) []queue.Block {
+	now := time.Now()
+	return d.release(peer, func(deadline time.Time) bool { return now.After(deadline) })
+}
+
+// release removes the blocks in flight to the peer for which expired returns
+// true, blocks which are not in flight to any other peer are marked as not
+// requested
+func (d *Downloader) release(peer string, expired func(deadline time.Time) bool) []queue.Block {
+	d.rbmu.Lock()
+	d.dbmu.Lock()
+	defer d.rbmu.Unlock()
+	defer d.dbmu.Unlock()
+
+	var released []queue.Block
+	for b, deadline := range d.inflight[peer] {
+		if !expired(deadline) {
+			continue
+		}
+
+		delete(d.inflight[peer], b)
+
+		blockIdx := d.BlockIdx(&b)
+		if d.downloadedBlocks[b.PieceIdx][blockIdx] {
+			continue
+		}
+
+		released = append(released, b)
+
+		if !d.isInFlight(b) {
+			d.requestedBlocks[b.PieceIdx][blockIdx] = false
+		}
+	}
+
+	if len(d.inflight[peer]) == 0 {
+		delete(d.inflight, peer)
+	}
+
+	return released
+}
+
+// NeedsPiece returns true if any block of the piece is yet to be downloaded,
+// pieces of skipped files are not needed
+func (d *Downloader) NeedsPiece(pieceIdx int) bool {
+	d.dbmu.Lock()
+	defer d.dbmu.Unlock()
+
+	if pieceIdx < 0 || pieceIdx >= len(d.downloadedBlocks) || d.priority(pieceIdx) == PrioritySkip {
+		return false
+	}
+
+	for _, downloaded := range d.downloadedBlocks[pieceIdx] {
+		if !downloaded {
+			return true
+		}
+	}
+
+	return false
 }
 
 // IsValidBlock checks if indices for a block are out of bounds
@@ -336,35 +676,116 @@ func (d *Downloader) PrintProgress() {
 	fmt.Println("--------- Download Progress ---------")
 	fmt.Printf("downloaded: %d / %d (%.2f)\n", down, tot, downPercent)
 	fmt.Printf("requested: %d / %d (%.2f)\n", req, tot, reqPercent)
+	if d.InEndgame() {
+		fmt.Printf("endgame: %d blocks in flight\n", d.inFlightCount())
+	}
 	fmt.Println("-------------------------------------")
 }
 
+// IsDownloadComplete returns true once every piece of the wanted files is
+// verified and persisted, the files which are skipped are not waited for
 func (d *Downloader) IsDownloadComplete() bool {
-	down, _, tot := d.progressReport()
-	comp := down == tot
+	comp := d.wantedPersisted()
 
 	if comp {
-		// Sync file to disk
-		if err := d.f.Sync(); err != nil {
-			log.Printf("error saving the file after download complete: %v\n", err)
-		}
-
 		d.closeWriteCh()
 	}
 
 	return comp
 }
 
-// closeWriteCh prevents a panic from closing a closed channel
+// wantedPersisted returns true if every piece which is not skipped is
+// persisted on disk
+func (d *Downloader) wantedPersisted() bool {
+	d.dbmu.Lock()
+	defer d.dbmu.Unlock()
+
+	for pieceIdx := range d.downloadedBlocks {
+		if d.priority(pieceIdx) != PrioritySkip && !d.persistedPieces.Has(pieceIdx) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// closeWriteCh flushes the storage once the download is complete, once
+// prevents a panic from closing a closed channel
 func (d *Downloader) closeWriteCh() {
 	d.once.Do(func() {
-		close(d.writesCh)
+		// Flush storage to disk
+		if err := d.storage.Flush(); err != nil {
+			log.Printf("error saving the file after download complete: %v\n", err)
+		}
+
+		d.closeWrites()
+		close(d.completedCh)
 		fmt.Println("writesCh closed safely.")
 	})
 }
 
+// closeWrites closes writesCh, the pieces queued before are still written
+func (d *Downloader) closeWrites() {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+
+	if !d.writesClosed {
+		d.writesClosed = true
+		close(d.writesCh)
+	}
+}
+
+// Completed returns a channel which is closed once the download is complete
+func (d *Downloader) Completed() <-chan struct{} {
+	return d.completedCh
+}
+
+// AddUploaded should be called when a block is sent to a peer
+func (d *Downloader) AddUploaded(n int) {
+	d.bytesUploaded.Add(int64(n))
+}
+
+// BytesDownloaded returns the bytes of all the blocks received from peers
+func (d *Downloader) BytesDownloaded() int64 {
+	return d.bytesDownloaded.Load()
+}
+
+// BytesUploaded returns the bytes of all the blocks sent to peers
+func (d *Downloader) BytesUploaded() int64 {
+	return d.bytesUploaded.Load()
+}
+
+// BytesLeft returns the bytes which are yet to be downloaded and verified,
+// the pieces of skipped files are not counted
+func (d *Downloader) BytesLeft() int64 {
+	d.dbmu.Lock()
+	defer d.dbmu.Unlock()
+
+	left := d.fileLength - d.bytesVerified.Load()
+	for pieceIdx := range d.downloadedBlocks {
+		if d.priority(pieceIdx) == PrioritySkip && !d.persistedPieces.Has(pieceIdx) {
+			left -= min(int64(d.PieceLength), d.fileLength-int64(pieceIdx)*int64(d.PieceLength))
+		}
+	}
+
+	return max(left, 0)
+}
+
+// inFlightCount returns the number of requests in flight to all the peers
+func (d *Downloader) inFlightCount() int {
+	d.rbmu.Lock()
+	defer d.rbmu.Unlock()
+
+	var count int
+	for _, blocks := range d.inflight {
+		count += len(blocks)
+	}
+
+	return count
+}
+
 // progressReport is helper function which returns
-// downloaded, requested and total blocks
+// downloaded, requested and total blocks of the pieces which are not skipped
 func (d *Downloader) progressReport() (int, int, int) {
 	var tot, req, down int
 
@@ -374,6 +795,10 @@ func (d *Downloader) progressReport() (int, int, int) {
 	defer d.dbmu.Unlock()
 
 	for i := 0; i < len(d.downloadedBlocks); i++ {
+		if d.priority(i) == PrioritySkip {
+			continue
+		}
+
 		for j := 0; j < len(d.downloadedBlocks[i]); j++ {
 			tot++
 
@@ -389,3 +814,20 @@ func (d *Downloader) progressReport() (int, int, int) {
 
 	return down, req, tot
 }
+
+// priority returns the priority of the piece, d.dbmu must be held
+func (d *Downloader) priority(pieceIdx int) Priority {
+	if pieceIdx < 0 || pieceIdx >= len(d.piecePriority) {
+		return PriorityNormal
+	}
+
+	return d.piecePriority[pieceIdx]
+}
+
+// setPiecePriorities sets the priority of each piece
+func (d *Downloader) setPiecePriorities(priorities []Priority) {
+	d.dbmu.Lock()
+	defer d.dbmu.Unlock()
+
+	d.piecePriority = priorities
+}
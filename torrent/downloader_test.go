@@ -2,8 +2,14 @@ package torrent
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"errors"
+	"my-bittorrent/queue"
+	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestNewDowloader(t *testing.T) {
@@ -12,6 +18,7 @@ func TestNewDowloader(t *testing.T) {
 	}{
 		"first": {
 			torrent: &Torrent{
+				Name:        "new downloader",
 				PiecesCount: 11,
 				FileLength:  int64(10*256*1024 + 14*DefaultBlockLength + 10), // 10 pieces and 15 blocks
 				PieceLength: 256 * 1024,                                      // 256 KB
@@ -21,10 +28,16 @@ func TestNewDowloader(t *testing.T) {
 
 	for name, test := range testCases {
 		t.Run(name, func(t *testing.T) {
+			t.Cleanup(func() {
+				os.RemoveAll(filepath.Join(downloadFolder, test.torrent.Name))
+				os.Remove(filepath.Join(downloadFolder, test.torrent.Name+resumeFileExt))
+			})
+
 			d, err := NewDownloader(test.torrent)
 			if err != nil {
-				t.Errorf("error creating new downloader: %v", err)
+				t.Fatalf("error creating new downloader: %v", err)
 			}
+			defer d.Close()
 
 			// validate d
 			if len(d.downloadedBlocks) != test.torrent.PiecesCount {
@@ -56,30 +69,6 @@ func TestNewDowloader(t *testing.T) {
 	}
 }
 
-func TestCreateDownloadFile(t *testing.T) {
-	var testCases = map[string]struct {
-		torrent *Torrent
-	}{
-		"first": {
-			torrent: &Torrent{
-				Name: "Puppy Torrent",
-			},
-		},
-	}
-
-	for name, test := range testCases {
-		t.Run(name, func(t *testing.T) {
-			f, err := createDownloadFile(test.torrent.Name)
-			if err != nil {
-				t.Error(err)
-			}
-			if f.Name() != filepath.Join(downloadFolder, test.torrent.Name, torrentSparseFileName) {
-				t.Errorf("filename mismatch, expected: %s, got: %s", torrentSparseFileName, f.Name())
-			}
-		})
-	}
-}
-
 func TestConstructPiece(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -155,3 +144,371 @@ func TestConstructPiece(t *testing.T) {
 		})
 	}
 }
+
+func TestReadBlock(t *testing.T) {
+	// 2 pieces of 8 bytes and a last piece of 4 bytes, piece 1 spans both files
+	data := []byte("piece000piece111last")
+	storage, err := FileTreeStorage(t.TempDir())(&Torrent{
+		Name: "read block",
+		Files: []*FileMeta{
+			{Path: []string{"a"}, Length: 12},
+			{Path: []string{"b"}, Length: 8},
+		},
+		FileLength:  int64(len(data)),
+		PieceLength: 8,
+	})
+	if err != nil {
+		t.Fatalf("error opening storage: %v", err)
+	}
+	defer storage.Close()
+
+	if err := storage.WriteBlock(data, 0, 0); err != nil {
+		t.Fatalf("error writing data: %v", err)
+	}
+
+	d := &Downloader{
+		storage:         storage,
+		fileLength:      int64(len(data)),
+		PieceLength:     8,
+		persistedPieces: bitfieldOf(3, 1, 2),
+	}
+
+	var testCases = map[string]struct {
+		pieceIdx      int
+		blockOffset   int
+		blockLength   int
+		expectedData  []byte
+		expectedError bool
+	}{
+		"piece across files": {
+			pieceIdx:     1,
+			blockOffset:  0,
+			blockLength:  8,
+			expectedData: []byte("piece111"),
+		},
+		"block of last piece": {
+			pieceIdx:     2,
+			blockOffset:  2,
+			blockLength:  2,
+			expectedData: []byte("st"),
+		},
+		"piece not persisted": {
+			pieceIdx:      0,
+			blockOffset:   0,
+			blockLength:   8,
+			expectedError: true,
+		},
+		"block beyond last piece": {
+			pieceIdx:      2,
+			blockOffset:   0,
+			blockLength:   8,
+			expectedError: true,
+		},
+		"invalid piece": {
+			pieceIdx:      3,
+			blockOffset:   0,
+			blockLength:   1,
+			expectedError: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := d.ReadBlock(test.pieceIdx, test.blockOffset, test.blockLength)
+			if (err != nil) != test.expectedError {
+				t.Fatalf("expected error: %v, got: %v", test.expectedError, err)
+			}
+
+			if !bytes.Equal(got, test.expectedData) {
+				t.Errorf("data mismatch, expected: %s, got: %s", test.expectedData, got)
+			}
+		})
+	}
+}
+
+func TestNeedsPiece(t *testing.T) {
+	d := &Downloader{
+		downloadedBlocks: [][]bool{
+			{true, true},
+			{true, false},
+		},
+	}
+
+	var testCases = map[string]struct {
+		pieceIdx int
+		expected bool
+	}{
+		"all blocks downloaded": {pieceIdx: 0, expected: false},
+		"block missing":         {pieceIdx: 1, expected: true},
+		"invalid piece":         {pieceIdx: 2, expected: false},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if got := d.NeedsPiece(test.pieceIdx); got != test.expected {
+				t.Errorf("expected: %v, got: %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestReleasePeer(t *testing.T) {
+	d := &Downloader{
+		requestedBlocks:  [][]bool{{false, false}, {false, false}},
+		downloadedBlocks: [][]bool{{false, false}, {false, false}},
+		inflight:         make(map[string]map[queue.Block]time.Time),
+		fileLength:       int64(4 * DefaultBlockLength),
+		PieceLength:      2 * DefaultBlockLength,
+	}
+
+	b00 := queue.NewBlock(0, 0, DefaultBlockLength)
+	b01 := queue.NewBlock(0, DefaultBlockLength, DefaultBlockLength)
+	b10 := queue.NewBlock(1, 0, DefaultBlockLength)
+
+	d.Requested(b00, "peer-a")
+	d.Requested(b01, "peer-a")
+	d.Requested(b10, "peer-b")
+
+	if got := d.InFlight("peer-a"); got != 2 {
+		t.Errorf("in flight mismatch, expected: 2, got: %d", got)
+	}
+
+	// b01 is received before peer-a chokes
+	d.Received(b01, "peer-a")
+	d.downloadedBlocks[0][1] = true
+
+	if got := d.ReleasePeer("peer-a"); len(got) != 1 || got[0] != *b00 {
+		t.Errorf("released mismatch, expected: [%v], got: %v", *b00, got)
+	}
+	if got := d.InFlight("peer-a"); got != 0 {
+		t.Errorf("expected nothing in flight after release, got: %d", got)
+	}
+	if d.requestedBlocks[0][0] {
+		t.Errorf("expected released block to not be requested")
+	}
+
+	// released block is picked again for other peers
+	pk := NewPicker(d, 2)
+	if b := pk.Pick("peer-c", func(pieceIdx int) bool { return pieceIdx == 0 }); b == nil || *b != *b00 {
+		t.Errorf("expected released block %v to be picked, got: %v", b00, b)
+	}
+
+	// blocks in flight to other peers are untouched
+	if got := d.InFlight("peer-b"); got != 1 {
+		t.Errorf("in flight mismatch for other peer, expected: 1, got: %d", got)
+	}
+}
+
+func TestDownloadedDuplicate(t *testing.T) {
+	d := &Downloader{
+		downloadedBlocks:     [][]bool{{false, false}},
+		downloadedBlocksData: [][][]byte{{nil, nil}},
+	}
+
+	b := queue.NewBlock(0, 0, 5)
+
+	d.Downloaded(b, []byte("first"))
+	d.Downloaded(b, []byte("again"))
+
+	if got := string(d.downloadedBlocksData[0][0]); got != "first" {
+		t.Errorf("expected first block to be kept, got: %s", got)
+	}
+}
+
+func TestReleaseExpired(t *testing.T) {
+	d := &Downloader{
+		requestedBlocks:  [][]bool{{false, false}},
+		downloadedBlocks: [][]bool{{false, false}},
+	}
+
+	expired := queue.NewBlock(0, 0, DefaultBlockLength)
+	pending := queue.NewBlock(0, DefaultBlockLength, DefaultBlockLength)
+
+	d.Requested(expired, "peer")
+	d.Requested(pending, "peer")
+
+	// deadline of the first request has passed
+	d.inflight["peer"][*expired] = time.Now().Add(-time.Second)
+
+	released := d.ReleaseExpired("peer")
+	if len(released) != 1 || released[0] != *expired {
+		t.Errorf("released mismatch, expected: [%v], got: %v", *expired, released)
+	}
+
+	if d.requestedBlocks[0][0] {
+		t.Errorf("expected expired block to not be requested")
+	}
+	if !d.requestedBlocks[0][1] || d.InFlight("peer") != 1 {
+		t.Errorf("expected block within deadline to stay in flight")
+	}
+}
+
+func TestResetPiece(t *testing.T) {
+	d := &Downloader{
+		requestedBlocks:      [][]bool{{true, true}},
+		downloadedBlocks:     [][]bool{{true, true}},
+		downloadedBlocksData: [][][]byte{{[]byte("a"), []byte("b")}},
+		persistedPieces:      NewBitfield(1),
+	}
+
+	d.ResetPiece(0)
+
+	// blocks of a corrupted piece are picked again
+	for i := range d.downloadedBlocks[0] {
+		if d.downloadedBlocks[0][i] || d.requestedBlocks[0][i] || d.downloadedBlocksData[0][i] != nil {
+			t.Errorf("expected block %d to be reset", i)
+		}
+	}
+}
+
+func TestDownloadedCorruptPiece(t *testing.T) {
+	d := &Downloader{
+		requestedBlocks:      [][]bool{{true}},
+		downloadedBlocks:     [][]bool{{false}},
+		downloadedBlocksData: [][][]byte{{nil}},
+		persistedPieces:      NewBitfield(1),
+		PieceHash:            [][20]byte{{0x01}},
+		PieceLength:          5,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Downloaded(queue.NewBlock(0, 0, 5), []byte("bad!!"))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Downloaded did not return for a corrupted piece")
+	}
+
+	if d.downloadedBlocks[0][0] || d.requestedBlocks[0][0] {
+		t.Errorf("expected corrupted piece to be reset")
+	}
+}
+
+// failingStorage is a memory storage failing to write the given pieces
+type failingStorage struct {
+	Storage
+	failing map[int]bool
+}
+
+func (s *failingStorage) WriteBlock(p []byte, pieceIdx, offset int) error {
+	if s.failing[pieceIdx] {
+		return errors.New("disk full")
+	}
+
+	return s.Storage.WriteBlock(p, pieceIdx, offset)
+}
+
+func TestReceiveWritesError(t *testing.T) {
+	// 2 pieces of 2 blocks each
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4*DefaultBlockLength/16)
+	tr := &Torrent{
+		Name:        "write error",
+		FileLength:  int64(len(data)),
+		PiecesCount: 2,
+		PieceLength: 2 * DefaultBlockLength,
+		PieceHash:   [][20]byte{sha1.Sum(data[:2*DefaultBlockLength]), sha1.Sum(data[2*DefaultBlockLength:])},
+	}
+	tr.Storage = func(t *Torrent) (Storage, error) {
+		s, err := MemoryStorage(t)
+		if err != nil {
+			return nil, err
+		}
+		return &failingStorage{Storage: s, failing: map[int]bool{0: true}}, nil
+	}
+
+	d, err := NewDownloader(tr)
+	if err != nil {
+		t.Fatalf("error creating downloader: %v", err)
+	}
+
+	// piece 0 fails to be written, piece 1 is written
+	for _, b := range []*queue.Block{
+		queue.NewBlock(0, 0, DefaultBlockLength),
+		queue.NewBlock(0, DefaultBlockLength, DefaultBlockLength),
+		queue.NewBlock(1, 0, DefaultBlockLength),
+		queue.NewBlock(1, DefaultBlockLength, DefaultBlockLength),
+	} {
+		d.Requested(b, "peer")
+		off := b.PieceIdx*tr.PieceLength + b.BlockOffset
+		d.Downloaded(b, data[off:off+b.BlockLength])
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("error closing downloader: %v", err)
+	}
+
+	var haves []int
+	for pieceIdx := range d.Haves() {
+		haves = append(haves, pieceIdx)
+	}
+	if !reflect.DeepEqual(haves, []int{1}) {
+		t.Errorf("haves mismatch, expected: [1], got: %v", haves)
+	}
+
+	if d.HasPiece(0) || !d.NeedsPiece(0) {
+		t.Errorf("expected piece failing to be written to be downloaded again")
+	}
+	if d.downloadedBlocks[0][0] || d.requestedBlocks[0][0] {
+		t.Errorf("expected blocks of piece failing to be written to be reset")
+	}
+	if expected := tr.FileLength - int64(tr.PieceLength); d.BytesLeft() != expected {
+		t.Errorf("bytes left mismatch, expected: %d, got: %d", expected, d.BytesLeft())
+	}
+}
+
+// flushCountingStorage is a memory storage counting the flushes
+type flushCountingStorage struct {
+	Storage
+	flushes int
+}
+
+func (s *flushCountingStorage) Flush() error {
+	s.flushes++
+	return s.Storage.Flush()
+}
+
+func TestIsDownloadCompleteFlushesOnce(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	tr := &Torrent{
+		Name:        "flush once",
+		FileLength:  int64(len(data)),
+		PiecesCount: 2,
+		PieceLength: 8,
+		PieceHash:   [][20]byte{sha1.Sum(data[:8]), sha1.Sum(data[8:])},
+	}
+
+	mem, err := MemoryStorage(tr)
+	if err != nil {
+		t.Fatalf("error opening storage: %v", err)
+	}
+	for pieceIdx := 0; pieceIdx < tr.PiecesCount; pieceIdx++ {
+		if err := mem.WriteBlock(data[pieceIdx*8:pieceIdx*8+8], pieceIdx, 0); err != nil {
+			t.Fatalf("error writing piece %d: %v", pieceIdx, err)
+		}
+	}
+	s := &flushCountingStorage{Storage: mem}
+	tr.Storage = func(*Torrent) (Storage, error) {
+		return s, nil
+	}
+
+	d, err := NewDownloader(tr)
+	if err != nil {
+		t.Fatalf("error creating downloader: %v", err)
+	}
+	if _, err := d.Recheck(nil); err != nil {
+		t.Fatalf("error checking data: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if !d.IsDownloadComplete() {
+			t.Fatalf("expected download to be complete")
+		}
+	}
+	if s.flushes != 1 {
+		t.Errorf("flushes mismatch, expected: 1, got: %d", s.flushes)
+	}
+}
@@ -0,0 +1,162 @@
+package torrent
+
+import (
+	"math/rand"
+	"my-bittorrent/queue"
+	"sync"
+	"time"
+)
+
+// randomFirstPieces is the number of pieces picked at random before
+// switching to rarest first, so that there is something to upload to
+// peers as soon as possible
+const randomFirstPieces = 4
+
+// Picker decides which block is requested next from a peer. It keeps count
+// of how many connected peers have each piece, and picks
+//   - pieces of the files with the highest priority first, pieces of
+//     skipped files are never picked
+//   - blocks of partially downloaded pieces first, so that pieces are
+//     completed and can be uploaded
+//   - random pieces until randomFirstPieces pieces are complete
+//   - the rarest pieces otherwise, ties are broken at random
+//   - in endgame, blocks which are in flight to other peers
+type Picker struct {
+	mu           sync.Mutex // To synchronize access to availability and rand
+	availability []int      // Number of connected peers which have each piece
+	rand         *rand.Rand
+	d            *Downloader
+}
+
+func NewPicker(d *Downloader, piecesCount int) *Picker {
+	return &Picker{
+		availability: make([]int, piecesCount),
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		d:            d,
+	}
+}
+
+// PeerHas should be called when a peer announces a piece, in a have or
+// bitfield message
+func (pk *Picker) PeerHas(pieceIdx int) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	if pieceIdx >= 0 && pieceIdx < len(pk.availability) {
+		pk.availability[pieceIdx]++
+	}
+}
+
+// PeerGone should be called when a peer disconnects, pieces are the
+// pieces the peer had
+func (pk *Picker) PeerGone(pieces *Bitfield) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	pieces.ForEach(func(pieceIdx int) {
+		if pieceIdx < len(pk.availability) && pk.availability[pieceIdx] > 0 {
+			pk.availability[pieceIdx]--
+		}
+	})
+}
+
+// Availability returns the number of connected peers which have the piece
+func (pk *Picker) Availability(pieceIdx int) int {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	if pieceIdx < 0 || pieceIdx >= len(pk.availability) {
+		return 0
+	}
+
+	return pk.availability[pieceIdx]
+}
+
+// Pick returns the next block to request from the peer and marks it as
+// requested from the peer. has reports whether the peer has a piece.
+// Returns nil if the peer has no block which is yet to be requested
+func (pk *Picker) Pick(peer string, has func(pieceIdx int) bool) *queue.Block {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	d := pk.d
+
+	d.rbmu.Lock()
+	d.dbmu.Lock()
+	defer d.rbmu.Unlock()
+	defer d.dbmu.Unlock()
+
+	var (
+		best         = -1
+		bestPriority Priority
+		bestPartial  bool
+		bestAvail    int
+		ties         int
+		completed    int
+	)
+
+	for pieceIdx := range d.downloadedBlocks {
+		pending, partial, complete := d.pieceState(pieceIdx)
+		if complete {
+			completed++
+		}
+
+		priority := d.priority(pieceIdx)
+		if !pending || priority == PrioritySkip || !has(pieceIdx) {
+			continue
+		}
+
+		avail := pk.availability[pieceIdx]
+
+		// pieces with a higher priority are preferred, then partial pieces,
+		// and then the rarest
+		samePriority := best != -1 && priority == bestPriority
+		better := best == -1 || priority > bestPriority ||
+			(samePriority && partial && !bestPartial) ||
+			(samePriority && partial == bestPartial && avail < bestAvail)
+		same := samePriority && partial == bestPartial && avail == bestAvail
+
+		switch {
+		case better:
+			best, bestPriority, bestPartial, bestAvail, ties = pieceIdx, priority, partial, avail, 1
+		case same:
+			// reservoir sampling to pick one of the ties at random
+			ties++
+			if pk.rand.Intn(ties) == 0 {
+				best = pieceIdx
+			}
+		}
+	}
+
+	if best == -1 {
+		// Remaining blocks are requested from other peers as well, so that
+		// the download is not held up by the slowest peers
+		if d.inEndgame() {
+			return d.requestEndgameBlock(peer, has)
+		}
+		return nil
+	}
+
+	// Rarity is ignored until the first few pieces are complete
+	if !bestPartial && completed < randomFirstPieces {
+		best = pk.randomPending(has, bestPriority)
+	}
+
+	return d.requestNextBlock(best, peer)
+}
+
+// randomPending returns a random piece of the priority which the peer has
+// and has blocks which are yet to be requested, d.rbmu and d.dbmu must be held
+func (pk *Picker) randomPending(has func(pieceIdx int) bool, priority Priority) int {
+	var candidates []int
+	for pieceIdx := range pk.d.downloadedBlocks {
+		if pk.d.priority(pieceIdx) != priority {
+			continue
+		}
+		if pending, _, _ := pk.d.pieceState(pieceIdx); pending && has(pieceIdx) {
+			candidates = append(candidates, pieceIdx)
+		}
+	}
+
+	return candidates[pk.rand.Intn(len(candidates))]
+}
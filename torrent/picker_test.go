@@ -0,0 +1,227 @@
+package torrent
+
+import (
+	"my-bittorrent/queue"
+	"testing"
+)
+
+// newPickerTestDownloader returns a downloader for piecesCount pieces of 2
+// blocks each, the last piece has a single short block
+func newPickerTestDownloader(piecesCount int) *Downloader {
+	d := &Downloader{
+		PieceLength: 2 * DefaultBlockLength,
+		fileLength:  int64((piecesCount-1)*2*DefaultBlockLength + 100),
+	}
+
+	for i := 0; i < piecesCount; i++ {
+		blocks := 2
+		if i == piecesCount-1 {
+			blocks = 1
+		}
+		d.downloadedBlocks = append(d.downloadedBlocks, make([]bool, blocks))
+		d.requestedBlocks = append(d.requestedBlocks, make([]bool, blocks))
+	}
+
+	return d
+}
+
+func TestPickerPick(t *testing.T) {
+	var testCases = map[string]struct {
+		setup        func(d *Downloader, pk *Picker)
+		peerHas      []int
+		expected     []int // pieces which can be picked
+		expectedNone bool
+	}{
+		"partial piece first": {
+			setup: func(d *Downloader, pk *Picker) {
+				d.downloadedBlocks[3][0] = true
+				pk.availability = []int{1, 1, 1, 5, 1, 1}
+			},
+			peerHas:  []int{0, 1, 2, 3},
+			expected: []int{3},
+		},
+		"random first until few pieces complete": {
+			setup: func(d *Downloader, pk *Picker) {
+				pk.availability = []int{5, 1, 5, 5, 5, 5}
+			},
+			peerHas:  []int{0, 2, 3},
+			expected: []int{0, 2, 3},
+		},
+		"rarest first": {
+			setup: func(d *Downloader, pk *Picker) {
+				for i := 0; i < randomFirstPieces; i++ {
+					d.downloadedBlocks[i] = []bool{true, true}
+				}
+				pk.availability = []int{1, 1, 1, 1, 3, 2}
+			},
+			peerHas:  []int{4, 5},
+			expected: []int{5},
+		},
+		"requested blocks are skipped": {
+			setup: func(d *Downloader, pk *Picker) {
+				d.requestedBlocks[0] = []bool{true, true}
+			},
+			peerHas:  []int{0, 1},
+			expected: []int{1},
+		},
+		"higher priority first": {
+			setup: func(d *Downloader, pk *Picker) {
+				d.downloadedBlocks[0][0] = true
+				d.piecePriority = []Priority{PriorityNormal, PriorityLow, PriorityHigh, PriorityHigh, PriorityNormal, PriorityNormal}
+			},
+			peerHas:  []int{0, 1, 2, 3},
+			expected: []int{2, 3},
+		},
+		"skipped pieces are not picked": {
+			setup: func(d *Downloader, pk *Picker) {
+				d.downloadedBlocks[0][0] = true
+				d.piecePriority = []Priority{PrioritySkip, PrioritySkip, PriorityLow, PrioritySkip, PrioritySkip, PrioritySkip}
+			},
+			peerHas:  []int{0, 1, 2},
+			expected: []int{2},
+		},
+		"peer has only skipped pieces": {
+			setup: func(d *Downloader, pk *Picker) {
+				d.piecePriority = []Priority{PrioritySkip, PrioritySkip, PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal}
+			},
+			peerHas:      []int{0, 1},
+			expectedNone: true,
+		},
+		"peer has nothing needed": {
+			setup: func(d *Downloader, pk *Picker) {
+				d.downloadedBlocks[0] = []bool{true, true}
+				d.requestedBlocks[1] = []bool{true, true}
+			},
+			peerHas:      []int{0, 1},
+			expectedNone: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := newPickerTestDownloader(6)
+			pk := NewPicker(d, 6)
+			test.setup(d, pk)
+
+			has := func(pieceIdx int) bool {
+				for _, idx := range test.peerHas {
+					if idx == pieceIdx {
+						return true
+					}
+				}
+				return false
+			}
+
+			b := pk.Pick("peer", has)
+			if test.expectedNone {
+				if b != nil {
+					t.Fatalf("expected no block, got: %v", b)
+				}
+				return
+			}
+			if b == nil {
+				t.Fatalf("expected a block, got none")
+			}
+
+			found := false
+			for _, idx := range test.expected {
+				if b.PieceIdx == idx {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("picked piece mismatch, expected one of: %v, got: %d", test.expected, b.PieceIdx)
+			}
+
+			if !d.requestedBlocks[b.PieceIdx][d.BlockIdx(b)] {
+				t.Errorf("expected picked block to be marked as requested")
+			}
+			if d.InFlight("peer") != 1 {
+				t.Errorf("expected picked block to be in flight to the peer")
+			}
+		})
+	}
+}
+
+func TestPickerBlockLength(t *testing.T) {
+	d := newPickerTestDownloader(2)
+	pk := NewPicker(d, 2)
+
+	lastPiece := func(pieceIdx int) bool { return pieceIdx == 1 }
+
+	b := pk.Pick("peer", lastPiece)
+	expected := queue.Block{PieceIdx: 1, BlockOffset: 0, BlockLength: 100}
+	if b == nil || *b != expected {
+		t.Errorf("expected block: %v, got: %v", expected, b)
+	}
+
+	// all the blocks of the piece are requested
+	if b := pk.Pick("peer", lastPiece); b != nil {
+		t.Errorf("expected no block, got: %v", b)
+	}
+}
+
+func TestPickerAvailability(t *testing.T) {
+	pk := NewPicker(nil, 3)
+
+	pk.PeerHas(0)
+	pk.PeerHas(0)
+	pk.PeerHas(2)
+	pk.PeerHas(5) // out of range is ignored
+
+	pk.PeerGone(bitfieldOf(3, 0, 2))
+
+	expected := []int{1, 0, 0}
+	for i, avail := range expected {
+		if got := pk.Availability(i); got != avail {
+			t.Errorf("availability of piece %d mismatch, expected: %d, got: %d", i, avail, got)
+		}
+	}
+}
+
+func TestPickerEndgame(t *testing.T) {
+	d := newPickerTestDownloader(2)
+	pk := NewPicker(d, 2)
+
+	all := func(pieceIdx int) bool { return true }
+
+	// peer-a gets all the blocks
+	for pk.Pick("peer-a", all) != nil {
+	}
+	if got := d.InFlight("peer-a"); got != 3 {
+		t.Fatalf("in flight mismatch, expected: 3, got: %d", got)
+	}
+
+	if !d.InEndgame() {
+		t.Fatalf("expected endgame once all blocks are requested")
+	}
+
+	// peer-b is handed the blocks in flight to peer-a
+	b := pk.Pick("peer-b", all)
+	if b == nil {
+		t.Fatalf("expected a block in endgame")
+	}
+	if _, ok := d.inflight["peer-a"][*b]; !ok {
+		t.Errorf("expected a block in flight to peer-a, got: %v", b)
+	}
+
+	// and the block is cancelled from peer-a once peer-b sends it
+	others := d.Received(b, "peer-b")
+	if len(others) != 1 || others[0] != "peer-a" {
+		t.Errorf("expected block to be cancelled from peer-a, got: %v", others)
+	}
+	if got := d.InFlight("peer-a"); got != 2 {
+		t.Errorf("in flight mismatch after cancel, expected: 2, got: %d", got)
+	}
+
+	// blocks in flight to another peer stay requested when a peer chokes
+	pk.Pick("peer-b", all)
+	d.ReleasePeer("peer-b")
+	for pieceIdx := range d.requestedBlocks {
+		for blockIdx, requested := range d.requestedBlocks[pieceIdx] {
+			if !requested && !d.downloadedBlocks[pieceIdx][blockIdx] {
+				t.Errorf("expected block [%d][%d] to stay requested", pieceIdx, blockIdx)
+			}
+		}
+	}
+}
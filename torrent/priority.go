@@ -0,0 +1,137 @@
+package torrent
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Priority is the download priority of a file or a piece, pieces with a
+// higher priority are picked first
+type Priority int
+
+// PrioritySkip files are not downloaded
+const PrioritySkip Priority = -2
+
+// PriorityLow files are downloaded after the other files
+const PriorityLow Priority = -1
+
+// PriorityNormal is the priority of the files by default
+const PriorityNormal Priority = 0
+
+// PriorityHigh files are downloaded before the other files
+const PriorityHigh Priority = 1
+
+// SetFilePriority sets the priority of the file at index fileIdx. It should
+// be called before the download is complete
+func (t *Torrent) SetFilePriority(fileIdx int, p Priority) error {
+	if fileIdx < 0 || fileIdx >= len(t.Files) {
+		return fmt.Errorf("invalid file index %d, exceeds valid range [0, %d]", fileIdx, len(t.Files)-1)
+	}
+
+	t.Files[fileIdx].Priority = p
+	t.updatePiecePriorities()
+
+	return nil
+}
+
+// SelectFiles downloads only the files matching any of the patterns, the
+// other files are skipped. A pattern is either the index of a file, or a glob
+// matched against the path and the name of the file, e.g. "2" or "*.mkv"
+func (t *Torrent) SelectFiles(patterns []string) error {
+	selected := make([]bool, len(t.Files))
+
+	for _, pattern := range patterns {
+		if fileIdx, err := strconv.Atoi(pattern); err == nil {
+			if fileIdx < 0 || fileIdx >= len(t.Files) {
+				return fmt.Errorf("invalid file index %d, exceeds valid range [0, %d]", fileIdx, len(t.Files)-1)
+			}
+			selected[fileIdx] = true
+			continue
+		}
+
+		matched := false
+		for fileIdx := range t.Files {
+			filePath := t.filePath(fileIdx)
+
+			matchPath, err := path.Match(pattern, filePath)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+			matchName, _ := path.Match(pattern, path.Base(filePath))
+
+			if matchPath || matchName {
+				selected[fileIdx] = true
+				matched = true
+			}
+		}
+
+		if !matched {
+			return fmt.Errorf("no file matches %q", pattern)
+		}
+	}
+
+	for fileIdx, file := range t.Files {
+		switch {
+		case !selected[fileIdx]:
+			file.Priority = PrioritySkip
+		case file.Priority == PrioritySkip:
+			file.Priority = PriorityNormal
+		}
+	}
+	t.updatePiecePriorities()
+
+	return nil
+}
+
+// filePath returns the path of the file inside the torrent, separated by
+// slashes. The path of a single file torrent is the name of the torrent
+func (t *Torrent) filePath(fileIdx int) string {
+	if len(t.Files[fileIdx].Path) == 0 {
+		return t.Name
+	}
+
+	return strings.Join(t.Files[fileIdx].Path, "/")
+}
+
+// updatePiecePriorities sets the priorities of the pieces to be picked from
+// the priorities of the files
+func (t *Torrent) updatePiecePriorities() {
+	if t.Downloader != nil {
+		t.Downloader.setPiecePriorities(t.piecePriorities())
+	}
+}
+
+// piecePriorities returns the priority of each piece, which is the highest
+// priority of the files the piece spans. A piece spanning a wanted file and
+// a skipped file is downloaded in full, as it can only be verified in full
+func (t *Torrent) piecePriorities() []Priority {
+	priorities := make([]Priority, t.PiecesCount)
+	if len(t.Files) == 0 || t.PieceLength <= 0 {
+		return priorities
+	}
+
+	for pieceIdx := range priorities {
+		priorities[pieceIdx] = PrioritySkip
+	}
+
+	var fileStart int64
+	for _, file := range t.Files {
+		fileEnd := fileStart + file.Length
+
+		// Pieces overlapping the file
+		if file.Length > 0 {
+			first := int(fileStart / int64(t.PieceLength))
+			last := min(int((fileEnd-1)/int64(t.PieceLength)), t.PiecesCount-1)
+
+			for pieceIdx := first; pieceIdx <= last; pieceIdx++ {
+				priorities[pieceIdx] = max(priorities[pieceIdx], file.Priority)
+			}
+		}
+
+		fileStart = fileEnd
+	}
+
+	return priorities
+}
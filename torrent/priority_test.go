@@ -0,0 +1,154 @@
+package torrent
+
+import (
+	"reflect"
+	"testing"
+)
+
+// newPriorityTestTorrent returns a torrent of 35 bytes in 5 pieces of 8
+// bytes, over files of 10, 20 and 5 bytes
+func newPriorityTestTorrent() *Torrent {
+	return &Torrent{
+		Name: "priority",
+		Files: []*FileMeta{
+			{Path: []string{"a.txt"}, Length: 10},
+			{Path: []string{"video", "b.mkv"}, Length: 20},
+			{Path: []string{"c.mkv"}, Length: 5},
+		},
+		FileLength:  35,
+		PiecesCount: 5,
+		PieceLength: 8,
+	}
+}
+
+func TestPiecePriorities(t *testing.T) {
+	var testCases = map[string]struct {
+		files    []Priority
+		expected []Priority
+	}{
+		"all normal": {
+			files:    []Priority{PriorityNormal, PriorityNormal, PriorityNormal},
+			expected: []Priority{PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal},
+		},
+		"pieces across skipped and wanted files": {
+			files:    []Priority{PrioritySkip, PriorityNormal, PrioritySkip},
+			expected: []Priority{PrioritySkip, PriorityNormal, PriorityNormal, PriorityNormal, PrioritySkip},
+		},
+		"highest priority of the files": {
+			files:    []Priority{PriorityHigh, PriorityLow, PriorityNormal},
+			expected: []Priority{PriorityHigh, PriorityHigh, PriorityLow, PriorityNormal, PriorityNormal},
+		},
+		"all skipped": {
+			files:    []Priority{PrioritySkip, PrioritySkip, PrioritySkip},
+			expected: []Priority{PrioritySkip, PrioritySkip, PrioritySkip, PrioritySkip, PrioritySkip},
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tr := newPriorityTestTorrent()
+			for i, p := range test.files {
+				tr.Files[i].Priority = p
+			}
+
+			if got := tr.piecePriorities(); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("piece priorities mismatch, expected: %v, got: %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestSelectFiles(t *testing.T) {
+	var testCases = map[string]struct {
+		patterns      []string
+		expected      []Priority
+		expectedError bool
+	}{
+		"by index": {
+			patterns: []string{"0", "2"},
+			expected: []Priority{PriorityNormal, PrioritySkip, PriorityNormal},
+		},
+		"by name": {
+			patterns: []string{"*.mkv"},
+			expected: []Priority{PrioritySkip, PriorityNormal, PriorityNormal},
+		},
+		"by path": {
+			patterns: []string{"video/*"},
+			expected: []Priority{PrioritySkip, PriorityNormal, PrioritySkip},
+		},
+		"index out of range": {
+			patterns:      []string{"3"},
+			expectedError: true,
+		},
+		"no match": {
+			patterns:      []string{"*.iso"},
+			expectedError: true,
+		},
+		"invalid pattern": {
+			patterns:      []string{"[a"},
+			expectedError: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tr := newPriorityTestTorrent()
+			tr.Downloader = &Downloader{}
+
+			err := tr.SelectFiles(test.patterns)
+			if (err != nil) != test.expectedError {
+				t.Fatalf("expected error: %v, got: %v", test.expectedError, err)
+			}
+			if err != nil {
+				return
+			}
+
+			for i, file := range tr.Files {
+				if file.Priority != test.expected[i] {
+					t.Errorf("file %d priority mismatch, expected: %d, got: %d", i, test.expected[i], file.Priority)
+				}
+			}
+
+			if !reflect.DeepEqual(tr.Downloader.piecePriority, tr.piecePriorities()) {
+				t.Errorf("expected piece priorities to be updated, got: %v", tr.Downloader.piecePriority)
+			}
+		})
+	}
+}
+
+func TestIsDownloadCompleteSelected(t *testing.T) {
+	tr := newPriorityTestTorrent()
+	tr.Storage = MemoryStorage
+
+	d, err := NewDownloader(tr)
+	if err != nil {
+		t.Fatalf("error creating downloader: %v", err)
+	}
+	defer d.Close()
+	tr.Downloader = d
+
+	// only b.mkv is wanted, which spans pieces 1 to 3
+	if err := tr.SelectFiles([]string{"1"}); err != nil {
+		t.Fatalf("error selecting files: %v", err)
+	}
+	if d.BytesLeft() != 24 {
+		t.Errorf("bytes left mismatch, expected: 24, got: %d", d.BytesLeft())
+	}
+
+	d.markVerified(1)
+	d.markVerified(2)
+	if d.IsDownloadComplete() {
+		t.Fatalf("expected download to be incomplete")
+	}
+	if d.NeedsPiece(0) || d.NeedsPiece(4) {
+		t.Errorf("expected pieces of skipped files not to be needed")
+	}
+
+	d.markVerified(3)
+	if !d.IsDownloadComplete() {
+		t.Errorf("expected download to be complete once the wanted files are")
+	}
+	if d.BytesLeft() != 0 {
+		t.Errorf("bytes left mismatch, expected: 0, got: %d", d.BytesLeft())
+	}
+}
@@ -0,0 +1,150 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// pieceCheck is the result of hash checking a piece
+type pieceCheck struct {
+	pieceIdx int
+	ok       bool
+	err      error
+}
+
+// Recheck hash checks every piece of the data on disk against the piece
+// hashes, reading pieces in parallel across CPU cores. Pieces which match
+// are marked as verified, and pieces which don't are downloaded again.
+// progress, if not nil, is called after every piece is checked. Returns the
+// number of verified pieces. It should be called before the download starts
+func (d *Downloader) Recheck(progress func(checked, total int)) (int, error) {
+	total := min(len(d.downloadedBlocks), len(d.PieceHash))
+
+	pieces := make(chan int)
+	results := make(chan pieceCheck)
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for pieceIdx := range pieces {
+				ok, err := d.checkPiece(pieceIdx)
+				results <- pieceCheck{pieceIdx: pieceIdx, ok: ok, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for pieceIdx := 0; pieceIdx < total; pieceIdx++ {
+			pieces <- pieceIdx
+		}
+		close(pieces)
+
+		wg.Wait()
+		close(results)
+	}()
+
+	var verified, checked int
+	var errs []error
+	for res := range results {
+		checked++
+
+		switch {
+		case res.err != nil:
+			errs = append(errs, res.err)
+		case res.ok:
+			d.markVerified(res.pieceIdx)
+			verified++
+		default:
+			d.markUnverified(res.pieceIdx)
+		}
+
+		if progress != nil {
+			progress(checked, total)
+		}
+	}
+
+	if len(errs) > 0 {
+		return verified, fmt.Errorf("error checking %d pieces: %w", len(errs), errors.Join(errs...))
+	}
+
+	return verified, nil
+}
+
+// checkPiece reads the piece from disk and returns true if it matches the
+// piece hash. Pieces beyond the end of the data are yet to be written
+func (d *Downloader) checkPiece(pieceIdx int) (bool, error) {
+	pieceOffset := int64(pieceIdx) * int64(d.PieceLength)
+	pieceLength := min(int64(d.PieceLength), d.fileLength-pieceOffset)
+
+	data := make([]byte, pieceLength)
+	err := d.storage.ReadBlock(data, pieceIdx, 0)
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error reading piece %d: %v", pieceIdx, err)
+	}
+
+	return sha1.Sum(data) == d.PieceHash[pieceIdx], nil
+}
+
+// markUnverified resets a piece which was marked as verified, so that it is
+// downloaded again
+func (d *Downloader) markUnverified(pieceIdx int) {
+	if !d.HasPiece(pieceIdx) {
+		return
+	}
+
+	d.ResetPiece(pieceIdx)
+
+	pieceLength := min(int64(d.PieceLength), d.fileLength-int64(pieceIdx)*int64(d.PieceLength))
+	d.bytesVerified.Add(-pieceLength)
+}
+
+// FileProgress is the number of verified bytes of a file of the torrent
+type FileProgress struct {
+	File     *FileMeta
+	Verified int64
+}
+
+// FileProgress returns the verified bytes of each of the files, counting
+// the parts of the files which are covered by verified pieces
+func (t *Torrent) FileProgress() []FileProgress {
+	have := t.Downloader.Bitfield()
+
+	progress := make([]FileProgress, len(t.Files))
+
+	var fileStart int64
+	for i, file := range t.Files {
+		progress[i].File = file
+		fileEnd := fileStart + file.Length
+
+		// Pieces overlapping the file
+		if file.Length > 0 {
+			first := int(fileStart / int64(t.PieceLength))
+			last := int((fileEnd - 1) / int64(t.PieceLength))
+
+			for pieceIdx := first; pieceIdx <= last; pieceIdx++ {
+				if !have.Has(pieceIdx) {
+					continue
+				}
+
+				pieceStart := int64(pieceIdx) * int64(t.PieceLength)
+				pieceEnd := pieceStart + int64(t.PieceLength)
+
+				progress[i].Verified += min(pieceEnd, fileEnd) - max(pieceStart, fileStart)
+			}
+		}
+
+		fileStart = fileEnd
+	}
+
+	return progress
+}
@@ -0,0 +1,112 @@
+package torrent
+
+import (
+	"testing"
+)
+
+func TestRecheck(t *testing.T) {
+	tr, data := newResumeTestTorrent("recheck")
+	tr.Storage = MemoryStorage
+
+	d, err := NewDownloader(tr)
+	if err != nil {
+		t.Fatalf("error creating downloader: %v", err)
+	}
+	defer d.Close()
+
+	// piece 1 is corrupted, but was marked verified before
+	corrupted := append([]byte{}, data...)
+	corrupted[tr.PieceLength+5] ^= 0xff
+
+	for pieceIdx := 0; pieceIdx < tr.PiecesCount; pieceIdx++ {
+		end := min((pieceIdx+1)*tr.PieceLength, len(corrupted))
+		if err := d.storage.WriteBlock(corrupted[pieceIdx*tr.PieceLength:end], pieceIdx, 0); err != nil {
+			t.Fatalf("error writing piece %d: %v", pieceIdx, err)
+		}
+	}
+	d.markVerified(1)
+
+	var calls, lastChecked int
+	verified, err := d.Recheck(func(checked, total int) {
+		calls++
+		lastChecked = checked
+		if total != tr.PiecesCount {
+			t.Errorf("total mismatch, expected: %d, got: %d", tr.PiecesCount, total)
+		}
+	})
+	if err != nil {
+		t.Fatalf("error rechecking: %v", err)
+	}
+
+	if verified != 2 {
+		t.Errorf("verified mismatch, expected: 2, got: %d", verified)
+	}
+	if calls != tr.PiecesCount || lastChecked != tr.PiecesCount {
+		t.Errorf("expected progress for every piece, got %d calls, last checked: %d", calls, lastChecked)
+	}
+
+	for pieceIdx, expected := range []bool{true, false, true} {
+		if d.HasPiece(pieceIdx) != expected {
+			t.Errorf("piece %d verified mismatch, expected: %v, got: %v", pieceIdx, expected, d.HasPiece(pieceIdx))
+		}
+	}
+
+	if !d.NeedsPiece(1) {
+		t.Errorf("expected corrupted piece to be needed")
+	}
+	if d.BytesLeft() != int64(tr.PieceLength) {
+		t.Errorf("bytes left mismatch, expected: %d, got: %d", tr.PieceLength, d.BytesLeft())
+	}
+}
+
+func TestFileProgress(t *testing.T) {
+	// 35 bytes in 5 pieces of 8 bytes, over files of 10, 20 and 5 bytes
+	files := []*FileMeta{
+		{Path: []string{"a"}, Length: 10},
+		{Path: []string{"b"}, Length: 20},
+		{Path: []string{"c"}, Length: 5},
+	}
+
+	var testCases = map[string]struct {
+		have     *Bitfield
+		expected []int64
+	}{
+		"no pieces": {
+			have:     NewBitfield(5),
+			expected: []int64{0, 0, 0},
+		},
+		"pieces within files": {
+			have:     bitfieldOf(5, 0, 2),
+			expected: []int64{8, 8, 0},
+		},
+		"piece across files": {
+			have:     bitfieldOf(5, 1, 3),
+			expected: []int64{2, 12, 2},
+		},
+		"all pieces": {
+			have:     bitfieldOf(5, 0, 1, 2, 3, 4),
+			expected: []int64{10, 20, 5},
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tr := &Torrent{
+				Files:       files,
+				FileLength:  35,
+				PiecesCount: 5,
+				PieceLength: 8,
+				Downloader:  &Downloader{persistedPieces: test.have},
+			}
+
+			for i, fp := range tr.FileProgress() {
+				if fp.File != files[i] {
+					t.Errorf("file %d mismatch", i)
+				}
+				if fp.Verified != test.expected[i] {
+					t.Errorf("file %d verified mismatch, expected: %d, got: %d", i, test.expected[i], fp.Verified)
+				}
+			}
+		})
+	}
+}
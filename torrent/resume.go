@@ -0,0 +1,306 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// resumeFileExt is the extension of the resume file, saved next to the
+// torrent folder so that it can't clash with the files of the torrent
+const resumeFileExt string = ".resume"
+
+// resumeData is the state of a download which is saved to the resume file,
+// so that the download continues where it stopped after a restart
+type resumeData struct {
+	InfoHash    string        `bencode:"info-hash"`
+	PieceLength int64         `bencode:"piece-length"`
+	Pieces      string        `bencode:"pieces"`  // Bitfield of the verified pieces
+	Files       []resumeFile  `bencode:"files"`   // To check that the data is unchanged since it was saved
+	Partial     []resumePiece `bencode:"partial"` // Blocks of the pieces which are yet to be completed
+}
+
+// resumeFile is the metadata of a file holding the torrent data
+type resumeFile struct {
+	Path   string `bencode:"path"` // Path relative to the torrent folder
+	Length int64  `bencode:"length"`
+	MTime  int64  `bencode:"mtime"` // Modification time in unix nano
+}
+
+// resumePiece holds the blocks received for a piece which is not complete
+type resumePiece struct {
+	Index  int64    `bencode:"index"`
+	Blocks []int64  `bencode:"blocks"` // Indices of the received blocks
+	Data   []string `bencode:"data"`   // Data of the received blocks, in the order of Blocks
+}
+
+// resumableStorage is implemented by the storages which keep the data in
+// files on disk, the progress of the download is saved to a resume file for
+// them. Downloads to other storages start over after a restart
+type resumableStorage interface {
+	// resumePath returns the path of the resume file for the torrent data
+	resumePath() string
+
+	// dataFiles returns the metadata of the files holding the torrent data
+	dataFiles() ([]resumeFile, error)
+}
+
+// resumePath returns the path of the resume file, next to the torrent folder
+func (s *fileStorage) resumePath() string {
+	return s.dir + resumeFileExt
+}
+
+// dataFiles returns the metadata of the files holding the torrent data
+func (s *fileStorage) dataFiles() ([]resumeFile, error) {
+	files := make([]resumeFile, 0, len(s.files))
+	for _, sf := range s.files {
+		// Files which are not created yet have no data
+		info, err := os.Stat(filepath.Join(s.dir, sf.path))
+		if errors.Is(err, os.ErrNotExist) {
+			files = append(files, resumeFile{Path: filepath.ToSlash(sf.path)})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error getting info of file %s: %v", sf.path, err)
+		}
+
+		files = append(files, resumeFile{
+			Path:   filepath.ToSlash(sf.path),
+			Length: info.Size(),
+			MTime:  info.ModTime().UnixNano(),
+		})
+	}
+
+	return files, nil
+}
+
+// SaveResume saves the verified pieces and the blocks of incomplete pieces
+// to the resume file. The data should be synced to disk before saving, so
+// that the modification times saved are final. Nothing is saved if the
+// storage does not keep the data on disk
+func (d *Downloader) SaveResume() error {
+	rs, ok := d.storage.(resumableStorage)
+	if !ok {
+		return nil
+	}
+
+	files, err := rs.dataFiles()
+	if err != nil {
+		return err
+	}
+
+	rd := resumeData{
+		InfoHash:    string(d.infoHash[:]),
+		PieceLength: int64(d.PieceLength),
+		Files:       files,
+	}
+
+	d.dbmu.Lock()
+	rd.Pieces = string(d.persistedPieces.Bytes())
+	for pieceIdx, blocks := range d.downloadedBlocks {
+		if d.persistedPieces.Has(pieceIdx) {
+			continue
+		}
+
+		// Pieces which are complete but not persisted yet are still to be
+		// written, they can't be restored without their data being verified
+		if !slices.Contains(blocks, false) {
+			continue
+		}
+
+		var partial *resumePiece
+		for blockIdx, downloaded := range blocks {
+			if !downloaded {
+				continue
+			}
+			if partial == nil {
+				partial = &resumePiece{Index: int64(pieceIdx)}
+			}
+
+			partial.Blocks = append(partial.Blocks, int64(blockIdx))
+			partial.Data = append(partial.Data, string(d.downloadedBlocksData[pieceIdx][blockIdx]))
+		}
+
+		if partial != nil {
+			rd.Partial = append(rd.Partial, *partial)
+		}
+	}
+	d.dbmu.Unlock()
+
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, rd); err != nil {
+		return fmt.Errorf("error encoding resume data: %v", err)
+	}
+
+	// Write to a temporary file first, so that a crash while saving does not
+	// leave a truncated resume file behind
+	path := rs.resumePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating folder for resume file: %v", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing resume file: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error replacing resume file: %v", err)
+	}
+
+	return nil
+}
+
+// loadResume restores the state of the download from the resume file. The
+// verified pieces are trusted if the data files are unchanged since the resume
+// file was saved, otherwise the data on disk is hash checked
+func (d *Downloader) loadResume() error {
+	rs, ok := d.storage.(resumableStorage)
+	if !ok {
+		return nil
+	}
+
+	rd, err := d.readResume(rs.resumePath())
+	if err != nil {
+		log.Printf("ignoring resume file: %v\n", err)
+		rd = nil
+	}
+
+	if rd != nil {
+		d.restorePartial(rd.Partial)
+	}
+
+	files, err := rs.dataFiles()
+	if err != nil {
+		return err
+	}
+
+	if rd != nil && filesUnchanged(files, rd.Files) {
+		pieces, err := DecodeBitfield([]byte(rd.Pieces), len(d.downloadedBlocks))
+		if err == nil {
+			pieces.ForEach(d.markVerified)
+			log.Printf("resumed download, verified pieces: %d\n", pieces.Count())
+			return nil
+		}
+
+		log.Printf("invalid pieces in resume file, checking data: %v\n", err)
+	}
+
+	// Nothing to check if there is no data yet
+	var size int64
+	for _, file := range files {
+		size += file.Length
+	}
+	if size == 0 {
+		return nil
+	}
+
+	verified, err := d.Recheck(nil)
+	if err != nil {
+		return fmt.Errorf("error checking pieces: %v", err)
+	}
+	log.Printf("checked data on disk, verified pieces: %d\n", verified)
+	d.checked = true
+
+	return nil
+}
+
+// readResume reads the resume file, it returns nil if there is no resume
+// file or if it is for some other torrent
+func (d *Downloader) readResume(path string) (*resumeData, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading resume file: %v", err)
+	}
+
+	var rd resumeData
+	if err := bencode.Unmarshal(bytes.NewReader(data), &rd); err != nil {
+		return nil, fmt.Errorf("error decoding resume file: %v", err)
+	}
+
+	if rd.InfoHash != string(d.infoHash[:]) || rd.PieceLength != int64(d.PieceLength) {
+		return nil, fmt.Errorf("resume file is for a different torrent")
+	}
+
+	return &rd, nil
+}
+
+// filesUnchanged returns true if the data files have the same size and
+// modification time as when the resume file was saved
+func filesUnchanged(files, saved []resumeFile) bool {
+	if len(files) != len(saved) {
+		return false
+	}
+
+	for i := range files {
+		if files[i] != saved[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// restorePartial restores the blocks of the incomplete pieces, blocks which
+// don't fit the torrent are skipped
+func (d *Downloader) restorePartial(partial []resumePiece) {
+	d.dbmu.Lock()
+	defer d.dbmu.Unlock()
+
+	for _, rp := range partial {
+		pieceIdx := int(rp.Index)
+		if pieceIdx < 0 || pieceIdx >= len(d.downloadedBlocks) || len(rp.Blocks) != len(rp.Data) {
+			continue
+		}
+
+		for i, blockIdx := range rp.Blocks {
+			if blockIdx < 0 || int(blockIdx) >= len(d.downloadedBlocks[pieceIdx]) {
+				continue
+			}
+
+			d.downloadedBlocks[pieceIdx][blockIdx] = true
+			d.downloadedBlocksData[pieceIdx][blockIdx] = []byte(rp.Data[i])
+		}
+
+		// A complete piece would never be verified and written, the piece is
+		// downloaded again instead
+		if !slices.Contains(d.downloadedBlocks[pieceIdx], false) {
+			for blockIdx := range d.downloadedBlocks[pieceIdx] {
+				d.downloadedBlocks[pieceIdx][blockIdx] = false
+				d.downloadedBlocksData[pieceIdx][blockIdx] = nil
+			}
+		}
+	}
+}
+
+// markVerified marks all the blocks of the piece as downloaded, and the
+// piece as verified and persisted on disk
+func (d *Downloader) markVerified(pieceIdx int) {
+	d.rbmu.Lock()
+	d.dbmu.Lock()
+	defer d.rbmu.Unlock()
+	defer d.dbmu.Unlock()
+
+	if d.persistedPieces.Has(pieceIdx) {
+		return
+	}
+
+	for i := range d.downloadedBlocks[pieceIdx] {
+		d.downloadedBlocks[pieceIdx][i] = true
+		d.downloadedBlocksData[pieceIdx][i] = nil
+		d.requestedBlocks[pieceIdx][i] = true
+	}
+
+	d.persistedPieces.Set(pieceIdx)
+
+	pieceLength := min(int64(d.PieceLength), d.fileLength-int64(pieceIdx)*int64(d.PieceLength))
+	d.bytesVerified.Add(pieceLength)
+}
@@ -0,0 +1,215 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"my-bittorrent/queue"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newResumeTestTorrent returns a torrent of 3 pieces of 2 blocks each, the
+// last piece being shorter, along with its data
+func newResumeTestTorrent(name string) (*Torrent, []byte) {
+	pieceLength := 2 * DefaultBlockLength
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*pieceLength+100)/16+1)[:2*pieceLength+100]
+
+	tr := &Torrent{
+		Name:        name,
+		InfoHash:    [20]byte{1, 2, 3},
+		FileLength:  int64(len(data)),
+		PiecesCount: 3,
+		PieceLength: pieceLength,
+	}
+	for i := 0; i < tr.PiecesCount; i++ {
+		end := min((i+1)*pieceLength, len(data))
+		tr.PieceHash = append(tr.PieceHash, sha1.Sum(data[i*pieceLength:end]))
+	}
+
+	return tr, data
+}
+
+func TestResume(t *testing.T) {
+	var testCases = map[string]struct {
+		modify           func(t *testing.T, tr *Torrent, dataPath string)
+		expectedVerified bool // piece 0 is verified
+		expectedPartial  bool // block of piece 1 is restored
+		expectedChecked  bool // data is hash checked while resuming
+	}{
+		"unchanged": {
+			modify:           func(t *testing.T, tr *Torrent, dataPath string) {},
+			expectedVerified: true,
+			expectedPartial:  true,
+		},
+		"data touched, hash checked": {
+			modify: func(t *testing.T, tr *Torrent, dataPath string) {
+				later := time.Now().Add(time.Hour)
+				if err := os.Chtimes(dataPath, later, later); err != nil {
+					t.Fatalf("error changing mtime: %v", err)
+				}
+			},
+			expectedVerified: true,
+			expectedPartial:  true,
+			expectedChecked:  true,
+		},
+		"data corrupted, hash checked": {
+			modify: func(t *testing.T, tr *Torrent, dataPath string) {
+				f, err := os.OpenFile(dataPath, os.O_WRONLY, 0644)
+				if err != nil {
+					t.Fatalf("error opening data: %v", err)
+				}
+				defer f.Close()
+
+				if _, err := f.WriteAt([]byte("corrupt"), 10); err != nil {
+					t.Fatalf("error corrupting data: %v", err)
+				}
+			},
+			expectedVerified: false,
+			expectedPartial:  true,
+			expectedChecked:  true,
+		},
+		"different torrent": {
+			modify: func(t *testing.T, tr *Torrent, dataPath string) {
+				tr.InfoHash = [20]byte{9}
+			},
+			expectedVerified: true, // data still matches the piece hashes
+			expectedPartial:  false,
+			expectedChecked:  true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tr, data := newResumeTestTorrent("resume " + name)
+
+			dir := filepath.Join(downloadFolder, tr.Name)
+			os.RemoveAll(dir)
+			os.Remove(dir + resumeFileExt)
+			t.Cleanup(func() {
+				os.RemoveAll(dir)
+				os.Remove(dir + resumeFileExt)
+			})
+
+			d, err := NewDownloader(tr)
+			if err != nil {
+				t.Fatalf("error creating downloader: %v", err)
+			}
+			d.Start()
+
+			// piece 0 is complete and piece 1 is partial
+			d.Downloaded(queue.NewBlock(0, 0, DefaultBlockLength), data[:DefaultBlockLength])
+			d.Downloaded(queue.NewBlock(0, DefaultBlockLength, DefaultBlockLength), data[DefaultBlockLength:2*DefaultBlockLength])
+			d.Downloaded(queue.NewBlock(1, 0, DefaultBlockLength), data[tr.PieceLength:tr.PieceLength+DefaultBlockLength])
+
+			deadline := time.Now().Add(5 * time.Second)
+			for !d.HasPiece(0) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if !d.HasPiece(0) {
+				t.Fatalf("expected piece 0 to be persisted")
+			}
+
+			if err := d.Close(); err != nil {
+				t.Fatalf("error closing downloader: %v", err)
+			}
+
+			test.modify(t, tr, filepath.Join(dir, tr.Name))
+
+			// download continues after restart
+			d, err = NewDownloader(tr)
+			if err != nil {
+				t.Fatalf("error reopening downloader: %v", err)
+			}
+			defer d.Close()
+
+			if d.HasPiece(0) != test.expectedVerified {
+				t.Errorf("piece 0 verified mismatch, expected: %v, got: %v", test.expectedVerified, d.HasPiece(0))
+			}
+			if d.Checked() != test.expectedChecked {
+				t.Errorf("checked mismatch, expected: %v, got: %v", test.expectedChecked, d.Checked())
+			}
+			if d.HasPiece(1) || d.HasPiece(2) {
+				t.Errorf("expected only piece 0 to be verified")
+			}
+
+			expectedLeft := tr.FileLength
+			if test.expectedVerified {
+				expectedLeft -= int64(tr.PieceLength)
+			}
+			if d.BytesLeft() != expectedLeft {
+				t.Errorf("bytes left mismatch, expected: %d, got: %d", expectedLeft, d.BytesLeft())
+			}
+
+			restored := d.downloadedBlocks[1][0] &&
+				bytes.Equal(d.downloadedBlocksData[1][0], data[tr.PieceLength:tr.PieceLength+DefaultBlockLength])
+			if restored != test.expectedPartial {
+				t.Errorf("partial block restored mismatch, expected: %v, got: %v", test.expectedPartial, restored)
+			}
+			if d.downloadedBlocks[1][1] {
+				t.Errorf("expected block 1 of piece 1 to be needed")
+			}
+		})
+	}
+}
+
+func TestResumeQueuedPiece(t *testing.T) {
+	tr, data := newResumeTestTorrent("resume queued piece")
+
+	dir := filepath.Join(downloadFolder, tr.Name)
+	os.RemoveAll(dir)
+	os.Remove(dir + resumeFileExt)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+		os.Remove(dir + resumeFileExt)
+	})
+
+	d, err := NewDownloader(tr)
+	if err != nil {
+		t.Fatalf("error creating downloader: %v", err)
+	}
+
+	// piece 0 is verified but still queued for writing when closed
+	d.Downloaded(queue.NewBlock(0, 0, DefaultBlockLength), data[:DefaultBlockLength])
+	d.Downloaded(queue.NewBlock(0, DefaultBlockLength, DefaultBlockLength), data[DefaultBlockLength:2*DefaultBlockLength])
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("error closing downloader: %v", err)
+	}
+
+	d, err = NewDownloader(tr)
+	if err != nil {
+		t.Fatalf("error reopening downloader: %v", err)
+	}
+	defer d.Close()
+
+	if !d.HasPiece(0) {
+		t.Errorf("expected queued piece to be written and verified")
+	}
+	if d.BytesLeft() != tr.FileLength-int64(tr.PieceLength) {
+		t.Errorf("bytes left mismatch, expected: %d, got: %d", tr.FileLength-int64(tr.PieceLength), d.BytesLeft())
+	}
+}
+
+func TestRestorePartial(t *testing.T) {
+	d := &Downloader{
+		downloadedBlocks:     [][]bool{{false, false}, {false, false}},
+		downloadedBlocksData: [][][]byte{{nil, nil}, {nil, nil}},
+	}
+
+	d.restorePartial([]resumePiece{
+		{Index: 0, Blocks: []int64{1}, Data: []string{"b"}},
+		{Index: 1, Blocks: []int64{0, 1}, Data: []string{"a", "b"}}, // complete, but never written
+		{Index: 2, Blocks: []int64{0}, Data: []string{"a"}},         // beyond the torrent
+	})
+
+	expected := [][]bool{{false, true}, {false, false}}
+	if !reflect.DeepEqual(d.downloadedBlocks, expected) {
+		t.Errorf("restored blocks mismatch, expected: %v, got: %v", expected, d.downloadedBlocks)
+	}
+	if d.downloadedBlocksData[1][0] != nil || d.downloadedBlocksData[1][1] != nil {
+		t.Errorf("expected data of the complete piece to be dropped")
+	}
+}
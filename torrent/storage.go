@@ -0,0 +1,316 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// torrentSparseFileName is the name of the file holding all the torrent data
+// when it is saved to a single file
+const torrentSparseFileName string = "torrent.data"
+
+// Storage saves the data of a torrent. Data is read and written in blocks
+// at an offset within a piece, a piece is written only once it is verified.
+// Blocks of different pieces can be read and written concurrently
+type Storage interface {
+	// ReadBlock reads len(p) bytes of the piece at offset within the piece.
+	// Data which is not written yet either reads as zeros or returns io.EOF
+	ReadBlock(p []byte, pieceIdx, offset int) error
+
+	// WriteBlock writes p to the piece at offset within the piece
+	WriteBlock(p []byte, pieceIdx, offset int) error
+
+	// MarkComplete is called once the verified piece is written
+	MarkComplete(pieceIdx int) error
+
+	// Flush saves the written data, so that it survives a crash
+	Flush() error
+
+	// Close releases the storage, the written data should be flushed first
+	Close() error
+}
+
+// StorageOpener opens the storage for the data of the torrent
+type StorageOpener func(t *Torrent) (Storage, error)
+
+// DefaultStorage saves the files of the torrent in the downloads folder
+var DefaultStorage StorageOpener = FileTreeStorage(downloadFolder)
+
+// FileTreeStorage saves the torrent data directly into the files of the
+// torrent, inside dir/<name>. A single file torrent is saved as
+// dir/<name>/<name>
+func FileTreeStorage(dir string) StorageOpener {
+	return func(t *Torrent) (Storage, error) {
+		files, err := storageFiles(t)
+		if err != nil {
+			return nil, err
+		}
+
+		return openFileStorage(filepath.Join(dir, t.Name), files, t.PieceLength)
+	}
+}
+
+// SingleFileStorage saves all the torrent data into a single file,
+// dir/<name>/torrent.data
+func SingleFileStorage(dir string) StorageOpener {
+	return func(t *Torrent) (Storage, error) {
+		if !validPathElement(t.Name) {
+			return nil, fmt.Errorf("invalid torrent name: %q", t.Name)
+		}
+
+		files := []*storageFile{{path: torrentSparseFileName, length: t.FileLength}}
+		return openFileStorage(filepath.Join(dir, t.Name), files, t.PieceLength)
+	}
+}
+
+// storageFile is a file of the torrent on disk, it holds the torrent data
+// from offset up to offset+length
+type storageFile struct {
+	path   string   // Path relative to the torrent folder
+	f      *os.File // nil until the file is opened
+	offset int64
+	length int64
+}
+
+// fileStorage saves the torrent data into files on disk, the offsets of the
+// torrent data are mapped onto the files they span. Files are created once
+// data is written to them, so that the files which are skipped are not
+type fileStorage struct {
+	dir         string     // Torrent folder, the files are saved inside it
+	mu          sync.Mutex // To synchronize opening the files
+	files       []*storageFile
+	pieceLength int
+}
+
+// storageFiles returns the files of the torrent, with their paths relative
+// to the torrent folder and their offsets in the torrent data
+func storageFiles(t *Torrent) ([]*storageFile, error) {
+	if !validPathElement(t.Name) {
+		return nil, fmt.Errorf("invalid torrent name: %q", t.Name)
+	}
+
+	files := t.Files
+	if len(files) == 0 {
+		files = []*FileMeta{{Length: t.FileLength}}
+	}
+
+	var offset int64
+	storage := make([]*storageFile, 0, len(files))
+	for i, file := range files {
+		path := file.Path
+		if len(path) == 0 {
+			path = []string{t.Name}
+		}
+
+		for _, elem := range path {
+			if !validPathElement(elem) {
+				return nil, fmt.Errorf("invalid path of file %d: %q", i, path)
+			}
+		}
+
+		storage = append(storage, &storageFile{
+			path:   filepath.Join(path...),
+			offset: offset,
+			length: file.Length,
+		})
+		offset += file.Length
+	}
+
+	return storage, nil
+}
+
+// validPathElement returns true if the file or folder name stays inside the
+// torrent folder
+func validPathElement(elem string) bool {
+	if elem == "" || elem == "." || elem == ".." {
+		return false
+	}
+
+	return !strings.ContainsAny(elem, `/\`) && filepath.IsLocal(elem)
+}
+
+// openFileStorage returns the storage of the files inside dir. Files are
+// opened on first use, existing data is kept so that the download can be
+// resumed
+func openFileStorage(dir string, files []*storageFile, pieceLength int) (*fileStorage, error) {
+	return &fileStorage{dir: dir, files: files, pieceLength: pieceLength}, nil
+}
+
+// file returns the opened file, nil if the file does not exist and create is
+// false. With create set the file and its folders are created if needed
+func (s *fileStorage) file(sf *storageFile, create bool) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sf.f != nil {
+		return sf.f, nil
+	}
+
+	fullPath := filepath.Join(s.dir, sf.path)
+	flag := os.O_RDWR
+	if create {
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			return nil, fmt.Errorf("error creating folder for file %s: %v", sf.path, err)
+		}
+		// Create the file if needed, without truncating it
+		flag |= os.O_CREATE
+	}
+
+	f, err := os.OpenFile(fullPath, flag, 0644)
+	if !create && errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening file %s: %v", sf.path, err)
+	}
+	sf.f = f
+
+	return f, nil
+}
+
+// span calls fn for every part of the data at offset off of length n, with
+// the file holding the part, the offset in the file, and the range of the
+// part in the data
+func (s *fileStorage) span(off int64, n int, fn func(sf *storageFile, fileOff int64, start, end int) error) error {
+	end := off + int64(n)
+
+	for _, sf := range s.files {
+		fileEnd := sf.offset + sf.length
+		if sf.length == 0 || fileEnd <= off {
+			continue
+		}
+		if sf.offset >= end {
+			break
+		}
+
+		partStart := max(off, sf.offset)
+		partEnd := min(end, fileEnd)
+
+		if err := fn(sf, partStart-sf.offset, int(partStart-off), int(partEnd-off)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// length returns the length of the torrent data
+func (s *fileStorage) length() int64 {
+	if len(s.files) == 0 {
+		return 0
+	}
+
+	last := s.files[len(s.files)-1]
+	return last.offset + last.length
+}
+
+// ReadBlock reads the block from the files the block spans, files which
+// do not exist yet hold no data
+func (s *fileStorage) ReadBlock(p []byte, pieceIdx, offset int) error {
+	var read int
+	err := s.span(int64(pieceIdx)*int64(s.pieceLength)+int64(offset), len(p), func(sf *storageFile, fileOff int64, start, end int) error {
+		f, err := s.file(sf, false)
+		if err != nil || f == nil {
+			return err
+		}
+
+		n, err := f.ReadAt(p[start:end], fileOff)
+		read += n
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Beyond the end of the torrent
+	if read < len(p) {
+		return io.EOF
+	}
+
+	return nil
+}
+
+// WriteBlock writes the block to the files the block spans, creating them
+// if needed
+func (s *fileStorage) WriteBlock(p []byte, pieceIdx, offset int) error {
+	off := int64(pieceIdx)*int64(s.pieceLength) + int64(offset)
+	if off < 0 || off+int64(len(p)) > s.length() {
+		return fmt.Errorf("write out of range, piece: %d, offset: %d, length: %d", pieceIdx, offset, len(p))
+	}
+
+	return s.span(off, len(p), func(sf *storageFile, fileOff int64, start, end int) error {
+		f, err := s.file(sf, true)
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.WriteAt(p[start:end], fileOff); err != nil {
+			return fmt.Errorf("error writing to file %s: %v", sf.path, err)
+		}
+		return nil
+	})
+}
+
+// MarkComplete creates the empty files at the offsets of the piece, the data
+// of the piece is already in the files
+func (s *fileStorage) MarkComplete(pieceIdx int) error {
+	for _, sf := range s.files {
+		if sf.length != 0 || s.pieceOf(sf.offset) != pieceIdx {
+			continue
+		}
+
+		if _, err := s.file(sf, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pieceOf returns the index of the piece holding the offset of the torrent
+// data, an offset at the end of the data belongs to the last piece
+func (s *fileStorage) pieceOf(off int64) int {
+	last := max(int((s.length()-1)/int64(s.pieceLength)), 0)
+	return min(int(off/int64(s.pieceLength)), last)
+}
+
+// Flush flushes the opened files to disk
+func (s *fileStorage) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, sf := range s.files {
+		if sf.f == nil {
+			continue
+		}
+		if err := sf.f.Sync(); err != nil {
+			errs = append(errs, fmt.Errorf("error flushing file %s: %v", sf.path, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close closes the opened files
+func (s *fileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, sf := range s.files {
+		if sf.f == nil {
+			continue
+		}
+		if err := sf.f.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error closing file %s: %v", sf.path, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,74 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MemoryStorage keeps the torrent data in memory, the data is lost once the
+// storage is closed. It is meant for tests and for torrents which are small
+// enough to fit in memory
+func MemoryStorage(t *Torrent) (Storage, error) {
+	return &memoryStorage{
+		data:        make([]byte, t.FileLength),
+		written:     NewBitfield(t.PiecesCount),
+		pieceLength: t.PieceLength,
+	}, nil
+}
+
+// memoryStorage keeps the torrent data in a single buffer
+type memoryStorage struct {
+	data        []byte
+	mu          sync.Mutex // To synchronize access to written
+	written     *Bitfield  // Pieces which have been written
+	pieceLength int
+}
+
+// ReadBlock copies the block from memory, returns io.EOF if the piece is
+// not written yet
+func (s *memoryStorage) ReadBlock(p []byte, pieceIdx, offset int) error {
+	s.mu.Lock()
+	written := s.written.Has(pieceIdx)
+	s.mu.Unlock()
+
+	off := int64(pieceIdx)*int64(s.pieceLength) + int64(offset)
+	if !written || off < 0 || off+int64(len(p)) > int64(len(s.data)) {
+		return io.EOF
+	}
+
+	copy(p, s.data[off:])
+	return nil
+}
+
+// WriteBlock copies the block to memory
+func (s *memoryStorage) WriteBlock(p []byte, pieceIdx, offset int) error {
+	off := int64(pieceIdx)*int64(s.pieceLength) + int64(offset)
+	if off < 0 || off+int64(len(p)) > int64(len(s.data)) {
+		return fmt.Errorf("write out of range, piece: %d, offset: %d, length: %d", pieceIdx, offset, len(p))
+	}
+
+	copy(s.data[off:], p)
+
+	s.mu.Lock()
+	s.written.Set(pieceIdx)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// MarkComplete does nothing, the piece is already in memory
+func (s *memoryStorage) MarkComplete(pieceIdx int) error {
+	return nil
+}
+
+// Flush does nothing, there is nothing to save
+func (s *memoryStorage) Flush() error {
+	return nil
+}
+
+// Close releases the data
+func (s *memoryStorage) Close() error {
+	s.data = nil
+	return nil
+}
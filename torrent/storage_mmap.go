@@ -0,0 +1,162 @@
+//go:build linux
+
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// MmapStorage saves the torrent data directly into the files of the torrent
+// like FileTreeStorage, reading and writing the files through memory mappings
+// instead of system calls. The files are extended to their full length when
+// first written, data which is not written yet reads as zeros
+func MmapStorage(dir string) StorageOpener {
+	return func(t *Torrent) (Storage, error) {
+		files, err := storageFiles(t)
+		if err != nil {
+			return nil, err
+		}
+
+		fs, err := openFileStorage(filepath.Join(dir, t.Name), files, t.PieceLength)
+		if err != nil {
+			return nil, err
+		}
+
+		return &mmapStorage{fileStorage: fs, mappings: make(map[*storageFile][]byte)}, nil
+	}
+}
+
+// mmapStorage maps the files of a fileStorage into memory. Flushing the
+// files flushes the pages written through the mappings too
+type mmapStorage struct {
+	*fileStorage
+	mmu      sync.Mutex              // To synchronize access to mappings
+	mappings map[*storageFile][]byte // Memory mapping of each file
+}
+
+// mapping returns the memory mapping of the file, mapping the file on first
+// use. Returns nil if the file does not exist or is not extended to its full
+// length yet and create is false
+func (s *mmapStorage) mapping(sf *storageFile, create bool) ([]byte, error) {
+	s.mmu.Lock()
+	defer s.mmu.Unlock()
+
+	if data, ok := s.mappings[sf]; ok {
+		return data, nil
+	}
+
+	f, err := s.file(sf, create)
+	if err != nil || f == nil {
+		return nil, err
+	}
+
+	data, err := s.mmap(sf, f, create)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	s.mappings[sf] = data
+
+	return data, nil
+}
+
+// mmap maps the file into memory, extending it to its full length if extend
+// is true. Returns nil if the file is shorter and extend is false, so reads
+// don't change the files
+func (s *mmapStorage) mmap(sf *storageFile, f *os.File, extend bool) ([]byte, error) {
+	if sf.length > math.MaxInt {
+		return nil, fmt.Errorf("file %s is too large to be mapped: %d bytes", sf.path, sf.length)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error getting info of file %s: %v", sf.path, err)
+	}
+	if info.Size() < sf.length {
+		if !extend {
+			return nil, nil
+		}
+		if err := f.Truncate(sf.length); err != nil {
+			return nil, fmt.Errorf("error extending file %s: %v", sf.path, err)
+		}
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(sf.length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("error mapping file %s: %v", sf.path, err)
+	}
+
+	return data, nil
+}
+
+// ReadBlock copies the block from the mappings of the files the block spans,
+// files which do not exist or are not extended yet hold no data
+func (s *mmapStorage) ReadBlock(p []byte, pieceIdx, offset int) error {
+	var read int
+	err := s.span(int64(pieceIdx)*int64(s.pieceLength)+int64(offset), len(p), func(sf *storageFile, fileOff int64, start, end int) error {
+		data, err := s.mapping(sf, false)
+		if err != nil {
+			return err
+		}
+
+		if fileOff < int64(len(data)) {
+			read += copy(p[start:end], data[fileOff:])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Beyond the end of the torrent
+	if read < len(p) {
+		return io.EOF
+	}
+
+	return nil
+}
+
+// WriteBlock copies the block to the mappings of the files the block spans,
+// creating the files if needed
+func (s *mmapStorage) WriteBlock(p []byte, pieceIdx, offset int) error {
+	off := int64(pieceIdx)*int64(s.pieceLength) + int64(offset)
+	if off < 0 || off+int64(len(p)) > s.length() {
+		return fmt.Errorf("write out of range, piece: %d, offset: %d, length: %d", pieceIdx, offset, len(p))
+	}
+
+	return s.span(off, len(p), func(sf *storageFile, fileOff int64, start, end int) error {
+		data, err := s.mapping(sf, true)
+		if err != nil {
+			return err
+		}
+
+		copy(data[fileOff:], p[start:end])
+		return nil
+	})
+}
+
+// Close unmaps and closes all the files
+func (s *mmapStorage) Close() error {
+	s.mmu.Lock()
+	defer s.mmu.Unlock()
+
+	var errs []error
+	for sf, data := range s.mappings {
+		if err := syscall.Munmap(data); err != nil {
+			errs = append(errs, fmt.Errorf("error unmapping file %s: %v", sf.path, err))
+		}
+	}
+	s.mappings = nil
+
+	if err := s.fileStorage.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
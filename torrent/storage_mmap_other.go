@@ -0,0 +1,16 @@
+//go:build !linux
+
+package torrent
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// MmapStorage is only supported on linux, opening the storage fails on
+// other platforms
+func MmapStorage(dir string) StorageOpener {
+	return func(t *Torrent) (Storage, error) {
+		return nil, fmt.Errorf("mmap storage is not supported on %s", runtime.GOOS)
+	}
+}
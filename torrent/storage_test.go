@@ -0,0 +1,272 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// newStorageTestTorrent returns a torrent of 18 bytes in 3 pieces of 8 bytes,
+// with the pieces spanning its files, along with its data
+func newStorageTestTorrent() (*Torrent, []byte) {
+	tr := &Torrent{
+		Name: "storage",
+		Files: []*FileMeta{
+			{Path: []string{"a.txt"}, Length: 5},
+			{Path: []string{"empty"}, Length: 0},
+			{Path: []string{"sub", "dir", "b.txt"}, Length: 10},
+			{Path: []string{"c.txt"}, Length: 3},
+		},
+		FileLength:  18,
+		PiecesCount: 3,
+		PieceLength: 8,
+	}
+
+	return tr, []byte("aaaaabbbbbbbbbbccc")
+}
+
+func TestStorage(t *testing.T) {
+	var testCases = map[string]struct {
+		open StorageOpener
+	}{
+		"file tree":   {open: FileTreeStorage(t.TempDir())},
+		"single file": {open: SingleFileStorage(t.TempDir())},
+		"memory":      {open: MemoryStorage},
+		"mmap":        {open: MmapStorage(t.TempDir())},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if name == "mmap" && runtime.GOOS != "linux" {
+				t.Skip("mmap storage is only supported on linux")
+			}
+
+			tr, data := newStorageTestTorrent()
+
+			s, err := test.open(tr)
+			if err != nil {
+				t.Fatalf("error opening storage: %v", err)
+			}
+			defer s.Close()
+
+			// pieces are written in blocks, out of order
+			for _, pieceIdx := range []int{2, 0, 1} {
+				piece := data[pieceIdx*tr.PieceLength : min((pieceIdx+1)*tr.PieceLength, len(data))]
+				for offset := 0; offset < len(piece); offset += 4 {
+					if err := s.WriteBlock(piece[offset:min(offset+4, len(piece))], pieceIdx, offset); err != nil {
+						t.Fatalf("error writing piece %d at offset %d: %v", pieceIdx, offset, err)
+					}
+				}
+
+				if err := s.MarkComplete(pieceIdx); err != nil {
+					t.Fatalf("error completing piece %d: %v", pieceIdx, err)
+				}
+			}
+
+			if err := s.WriteBlock([]byte("x"), 2, 2); err == nil {
+				t.Errorf("expected error writing beyond the end of the torrent")
+			}
+
+			if err := s.Flush(); err != nil {
+				t.Fatalf("error flushing storage: %v", err)
+			}
+
+			// block spanning the files
+			got := make([]byte, 5)
+			if err := s.ReadBlock(got, 0, 3); err != nil {
+				t.Fatalf("error reading block: %v", err)
+			}
+			if !bytes.Equal(got, data[3:8]) {
+				t.Errorf("block mismatch, expected: %s, got: %s", data[3:8], got)
+			}
+
+			// last piece
+			got = make([]byte, 2)
+			if err := s.ReadBlock(got, 2, 0); err != nil {
+				t.Fatalf("error reading block: %v", err)
+			}
+			if !bytes.Equal(got, data[16:]) {
+				t.Errorf("block mismatch, expected: %s, got: %s", data[16:], got)
+			}
+
+			if err := s.ReadBlock(make([]byte, 4), 2, 0); err == nil {
+				t.Errorf("expected error reading beyond the end of the torrent")
+			}
+		})
+	}
+}
+
+func TestFileTreeStorage(t *testing.T) {
+	var testCases = map[string]struct {
+		open func(dir string) StorageOpener
+	}{
+		"file tree": {open: FileTreeStorage},
+		"mmap":      {open: MmapStorage},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if name == "mmap" && runtime.GOOS != "linux" {
+				t.Skip("mmap storage is only supported on linux")
+			}
+
+			dir := t.TempDir()
+			tr, data := newStorageTestTorrent()
+
+			s, err := test.open(dir)(tr)
+			if err != nil {
+				t.Fatalf("error opening storage: %v", err)
+			}
+
+			// files are created once written to
+			if _, err := os.Stat(filepath.Join(dir, tr.Name)); !os.IsNotExist(err) {
+				t.Errorf("expected no files before writing, got: %v", err)
+			}
+			if err := s.ReadBlock(make([]byte, 4), 0, 0); !errors.Is(err, io.EOF) {
+				t.Errorf("expected EOF reading unwritten data, got: %v", err)
+			}
+
+			if err := s.WriteBlock(data[:8], 0, 0); err != nil {
+				t.Fatalf("error writing piece 0: %v", err)
+			}
+			if err := s.WriteBlock(data[8:], 1, 0); err != nil {
+				t.Fatalf("error writing pieces 1 and 2: %v", err)
+			}
+			for pieceIdx := 0; pieceIdx < tr.PiecesCount; pieceIdx++ {
+				if err := s.MarkComplete(pieceIdx); err != nil {
+					t.Fatalf("error completing piece %d: %v", pieceIdx, err)
+				}
+			}
+			if err := s.Flush(); err != nil {
+				t.Fatalf("error flushing storage: %v", err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("error closing storage: %v", err)
+			}
+
+			// files are complete on disk, with the folder structure of the torrent
+			var expectedFiles = map[string][]byte{
+				"a.txt":                              data[:5],
+				"empty":                              {},
+				filepath.Join("sub", "dir", "b.txt"): data[5:15],
+				"c.txt":                              data[15:],
+			}
+			for path, expected := range expectedFiles {
+				content, err := os.ReadFile(filepath.Join(dir, tr.Name, path))
+				if err != nil {
+					t.Fatalf("error reading file %s: %v", path, err)
+				}
+				if !bytes.Equal(content, expected) {
+					t.Errorf("file %s mismatch, expected: %s, got: %s", path, expected, content)
+				}
+			}
+
+			// reading a short file does not extend it
+			path := filepath.Join(dir, tr.Name, "a.txt")
+			if err := os.WriteFile(path, data[:2], 0644); err != nil {
+				t.Fatalf("error truncating file: %v", err)
+			}
+			s, err = test.open(dir)(tr)
+			if err != nil {
+				t.Fatalf("error reopening storage: %v", err)
+			}
+			defer s.Close()
+
+			if err := s.ReadBlock(make([]byte, 4), 0, 0); !errors.Is(err, io.EOF) {
+				t.Errorf("expected EOF reading short file, got: %v", err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("error getting info of file: %v", err)
+			}
+			if info.Size() != 2 {
+				t.Errorf("file size mismatch after read, expected: 2, got: %d", info.Size())
+			}
+		})
+	}
+}
+
+func TestStorageFiles(t *testing.T) {
+	var testCases = map[string]struct {
+		torrent       *Torrent
+		expectedPaths []string
+		expectedError bool
+	}{
+		"single file": {
+			torrent: &Torrent{
+				Name:       "single.iso",
+				Files:      []*FileMeta{{Path: nil, Length: 10}},
+				FileLength: 10,
+			},
+			expectedPaths: []string{"single.iso"},
+		},
+		"no files": {
+			torrent: &Torrent{
+				Name:       "data",
+				FileLength: 10,
+			},
+			expectedPaths: []string{"data"},
+		},
+		"multiple files": {
+			torrent: &Torrent{
+				Name: "multi",
+				Files: []*FileMeta{
+					{Path: []string{"a"}, Length: 1},
+					{Path: []string{"b", "c"}, Length: 1},
+				},
+			},
+			expectedPaths: []string{"a", filepath.Join("b", "c")},
+		},
+		"invalid name": {
+			torrent:       &Torrent{Name: ".."},
+			expectedError: true,
+		},
+		"empty name": {
+			torrent:       &Torrent{Name: ""},
+			expectedError: true,
+		},
+		"parent folder in path": {
+			torrent: &Torrent{
+				Name:  "escape",
+				Files: []*FileMeta{{Path: []string{"..", "a"}, Length: 1}},
+			},
+			expectedError: true,
+		},
+		"separator in path": {
+			torrent: &Torrent{
+				Name:  "escape",
+				Files: []*FileMeta{{Path: []string{"a/../../b"}, Length: 1}},
+			},
+			expectedError: true,
+		},
+		"absolute path": {
+			torrent: &Torrent{
+				Name:  "escape",
+				Files: []*FileMeta{{Path: []string{"/etc", "passwd"}, Length: 1}},
+			},
+			expectedError: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			files, err := storageFiles(test.torrent)
+			if (err != nil) != test.expectedError {
+				t.Fatalf("expected error: %v, got: %v", test.expectedError, err)
+			}
+
+			if len(files) != len(test.expectedPaths) {
+				t.Fatalf("files count mismatch, expected: %d, got: %d", len(test.expectedPaths), len(files))
+			}
+			for i, sf := range files {
+				if sf.path != test.expectedPaths[i] {
+					t.Errorf("file %d path mismatch, expected: %s, got: %s", i, test.expectedPaths[i], sf.path)
+				}
+			}
+		})
+	}
+}
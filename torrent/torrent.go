@@ -5,10 +5,8 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
-	"io"
 	"log"
 	"math"
-	"os"
 
 	"github.com/jackpal/bencode-go"
 )
@@ -23,11 +21,16 @@ type Torrent struct {
 	PieceLength int
 	PieceHash   [][20]byte // sha-1 hash for all the pieces
 	Downloader  *Downloader
+	Picker      *Picker       // Picks the blocks to request from peers
+	Storage     StorageOpener // Opens the storage for the torrent data, DefaultStorage if nil
 }
 
-func NewTorrent(decoded interface{}) (t *Torrent, err error) {
+// NewTorrent creates the torrent from the decoded torrent file, its data is
+// saved to the storage opened by storage
+func NewTorrent(decoded interface{}, storage StorageOpener) (t *Torrent, err error) {
 	t = &Torrent{
 		Decoded: decoded,
+		Storage: storage,
 	}
 
 	// Check validity of torrent by per-calculating fields
@@ -69,6 +72,8 @@ func NewTorrent(decoded interface{}) (t *Torrent, err error) {
 		return nil, fmt.Errorf("error creating new downloader: %v", err)
 	}
 
+	t.Picker = NewPicker(t.Downloader, t.PiecesCount)
+
 	return t, nil
 }
 
@@ -81,6 +86,10 @@ type FileMeta struct {
 
 	// Length is file size in bytes
 	Length int64
+
+	// Priority is the download priority of the file, files are not
+	// downloaded if it is PrioritySkip
+	Priority Priority
 }
 
 // GetAnnounceUrl extracts and returns annouce url (tracker url)
@@ -107,6 +116,56 @@ func (t *Torrent) GetAnnounceUrl() (string, error) {
 	return announceUrl, nil
 }
 
+// GetAnnounceList returns the tiers of tracker urls from the 'announce-list'
+// field of the torrent. If the torrent does not have an announce list, the
+// 'announce' url is returned as the only tier
+// Multitracker metadata extension - https://www.bittorrent.org/beps/bep_0012.html
+func (t *Torrent) GetAnnounceList() ([][]string, error) {
+	// type assert to map[string]interface{}
+	torrentMap, ok := t.Decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("decoded data is not a map")
+	}
+
+	var tiers [][]string
+
+	announceList, ok := torrentMap["announce-list"].([]interface{})
+	if ok {
+		for i, tier := range announceList {
+			tierList, ok := tier.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("'announce-list[%d]' field is not a list", i)
+			}
+
+			var urls []string
+			for j, u := range tierList {
+				urlStr, ok := u.(string)
+				if !ok {
+					return nil, fmt.Errorf("'announce-list[%d][%d]' field is not a string", i, j)
+				}
+				urls = append(urls, urlStr)
+			}
+
+			// skip empty tiers
+			if len(urls) > 0 {
+				tiers = append(tiers, urls)
+			}
+		}
+	}
+
+	if len(tiers) > 0 {
+		return tiers, nil
+	}
+
+	// fallback to the single announce url
+	announceUrl, err := t.GetAnnounceUrl()
+	if err != nil {
+		return nil, err
+	}
+
+	return [][]string{{announceUrl}}, nil
+}
+
 func getName(decoded interface{}) (string, error) {
 	// type assert to map[string]interface{}
 	torrentMap, ok := decoded.(map[string]interface{})
@@ -494,47 +553,3 @@ func (t *Torrent) GetBlockLength(pieceIdx, blockIdx int) (int, error) {
 
 	return DefaultBlockLength, nil
 }
-
-// SplitTorrentDataIntoFiles splits the downloaded torrent.data files
-// into respective files as defined in FileMeta
-func (t *Torrent) SplitTorrentDataIntoFiles() error {
-	if !t.Downloader.IsDownloadComplete() {
-		return fmt.Errorf("download incomplete")
-	}
-
-	src := t.Downloader.f
-	defer src.Close()
-
-	// Global offset tracks the position in the sparse file
-	globalOffset := int64(0)
-
-	for _, file := range t.Files {
-		filename := file.Path[len(file.Path)-1]
-
-		// Open the target file for writing
-		dst, err := os.Create(filename)
-		if err != nil {
-			return fmt.Errorf("error creating file %s: %v", filename, err)
-		}
-		defer dst.Close()
-
-		// Copy the file's data from the sparse file
-		_, err = src.Seek(globalOffset, io.SeekStart)
-		if err != nil {
-			return fmt.Errorf("error seeking in sparse file: %v", err)
-		}
-
-		// Limit the reader to the file's size
-		_, err = io.CopyN(dst, src, file.Length)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("error copying data to file %s: %v", filename, err)
-		}
-
-		// Update the global offset
-		globalOffset += file.Length
-	}
-
-	// todo: Delete the sparse file
-
-	return nil
-}
@@ -1,79 +1,53 @@
 package torrent
 
 import (
-	"bytes"
-	"os"
-	"path/filepath"
+	"reflect"
 	"testing"
 )
 
-func TestSplitTorrentDataIntoFiles(t *testing.T) {
-	// Create a temporary sparse file for testing
-	tempDir := t.TempDir()
-	srcFilePath := filepath.Join(tempDir, "sparse_file")
-	src, err := os.Create(srcFilePath)
-	if err != nil {
-		t.Fatalf("Failed to create sparse file: %v", err)
-	}
-	defer src.Close()
-
-	// Write dummy data to the sparse file
-	data := []byte("File1ContentFile2Content")
-	_, err = src.Write(data)
-	if err != nil {
-		t.Fatalf("Failed to write to sparse file: %v", err)
-	}
-
-	// Define FileMeta for two files
-	files := []*FileMeta{
-		{
-			Path:   []string{"file1.txt"},
-			Length: int64(len("File1Content")),
+func TestGetAnnounceList(t *testing.T) {
+	var testCases = map[string]struct {
+		decoded       interface{}
+		expectedTiers [][]string
+		expectedError bool
+	}{
+		"announce list": {
+			decoded: map[string]interface{}{
+				"announce": "udp://a:80",
+				"announce-list": []interface{}{
+					[]interface{}{"udp://a:80", "http://b/announce"},
+					[]interface{}{},
+					[]interface{}{"udp://c:80"},
+				},
+			},
+			expectedTiers: [][]string{{"udp://a:80", "http://b/announce"}, {"udp://c:80"}},
 		},
-		{
-			Path:   []string{"file2.txt"},
-			Length: int64(len("File2Content")),
+		"announce only": {
+			decoded: map[string]interface{}{
+				"announce": "udp://a:80",
+			},
+			expectedTiers: [][]string{{"udp://a:80"}},
 		},
-	}
-
-	torr := &Torrent{
-		Downloader: &Downloader{
-			f:                 src,
-			writesCh:          make(chan *Piece),
-			writesCompletedCh: make(chan struct{}),
+		"invalid tier": {
+			decoded: map[string]interface{}{
+				"announce-list": []interface{}{"udp://a:80"},
+			},
+			expectedError: true,
 		},
-		Files: files,
 	}
 
-	// Call the function to test
-	err = torr.SplitTorrentDataIntoFiles()
-	if err != nil {
-		t.Fatalf("SplitTorrentDataIntoFiles failed: %v", err)
-	}
-
-	// Validate the created files
-	for i, file := range torr.Files {
-		expectedContent := data[int64(i)*file.Length : int64(i+1)*file.Length]
-		content, err := os.ReadFile(file.Path[len(file.Path)-1])
-		if err != nil {
-			t.Fatalf("Failed to read output file %s: %v", file.Path[len(file.Path)-1], err)
-		}
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			torr := &Torrent{Decoded: test.decoded}
 
-		// Ensure file cleanup after test
-		filename := file.Path[len(file.Path)-1]
-		defer os.Remove(filename)
+			tiers, err := torr.GetAnnounceList()
+			if (err != nil) != test.expectedError {
+				t.Fatalf("expected error: %v, got: %v", test.expectedError, err)
+			}
 
-		if !bytes.Equal(content, expectedContent) {
-			t.Errorf("Content mismatch in file %s, expected %s, got %s",
-				file.Path[len(file.Path)-1], string(expectedContent), string(content))
-		}
+			if !reflect.DeepEqual(tiers, test.expectedTiers) {
+				t.Errorf("tiers mismatch, expected: %v, got: %v", test.expectedTiers, tiers)
+			}
+		})
 	}
-
-	// Check if the sparse file still exists (optional)
-	_, err = os.Stat(srcFilePath)
-	if err != nil {
-		t.Errorf("Sparse file was unexpectedly deleted: %v", err)
-	}
-
-	//
 }
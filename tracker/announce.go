@@ -9,6 +9,26 @@ import (
 	"net"
 )
 
+// Announce events, values are as defined for UDP trackers in BEP 15
+const (
+	EventNone      int32 = 0
+	EventCompleted int32 = 1
+	EventStarted   int32 = 2
+	EventStopped   int32 = 3
+)
+
+// announceParams holds the values sent to a tracker in an announce,
+// independent of the protocol used to talk to the tracker
+type announceParams struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Downloaded int64 // bytes
+	Left       int64 // bytes
+	Uploaded   int64 // bytes
+	Event      int32
+	Port       uint16
+}
+
 type announceRequest struct {
 	ConnectionID  int64    // Has to be the same obtained in connectResponse
 	Action        int32    // default 1
@@ -22,7 +42,7 @@ type announceRequest struct {
 	IPAddress     int32 // default 0
 	Key           int32
 	NumWant       int32
-	Port          int16
+	Port          uint16
 }
 
 func (req *announceRequest) toBytes() ([]byte, error) {
@@ -34,21 +54,21 @@ func (req *announceRequest) toBytes() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func buildAnnounceRequest(connectionID int64, infoHash, peerID [20]byte, downloaded, left, uploaded int64, port int16) *announceRequest {
+func buildAnnounceRequest(connectionID int64, params *announceParams) *announceRequest {
 	req := &announceRequest{
 		ConnectionID:  connectionID,
 		Action:        1, // Announce
 		TransactionID: randInt32(),
-		InfoHash:      infoHash,
-		PeerID:        peerID,
-		Downloaded:    downloaded,
-		Left:          left,
-		Uploaded:      uploaded,
-		Event:         0, // None (0)
+		InfoHash:      params.InfoHash,
+		PeerID:        params.PeerID,
+		Downloaded:    params.Downloaded,
+		Left:          params.Left,
+		Uploaded:      params.Uploaded,
+		Event:         params.Event,
 		IPAddress:     0, // Default (0)
 		Key:           randInt32(),
 		NumWant:       -1, // Default (-1)
-		Port:          port,
+		Port:          params.Port,
 	}
 
 	log.Printf("Announce request: %+v\n", req)
@@ -56,7 +76,10 @@ func buildAnnounceRequest(connectionID int64, infoHash, peerID [20]byte, downloa
 	return req
 }
 
-type IPv4AnnounceResponse struct {
+// UDPAnnounceResponse defines format of response to announce request to a
+// UDP tracker. Peers are IPv4 or IPv6 depending on the address family over
+// which the tracker was contacted
+type UDPAnnounceResponse struct {
 	Action        int32
 	TransactionID int32
 	Interval      int32 // time interval before which announce request should not be re-triggered
@@ -65,12 +88,12 @@ type IPv4AnnounceResponse struct {
 	Peers         []*peer.Peer
 }
 
-func parseAnnounceResponse(data []byte) (*IPv4AnnounceResponse, error) {
+func parseAnnounceResponse(data []byte, ipv6 bool) (*UDPAnnounceResponse, error) {
 	if len(data) < 20 {
 		return nil, fmt.Errorf("invalid response: too short, expected > 20 bytes, got: %d", len(data))
 	}
 
-	resp := &IPv4AnnounceResponse{}
+	resp := &UDPAnnounceResponse{}
 	buf := bytes.NewReader(data)
 
 	// Parse fixed-size fields
@@ -100,17 +123,20 @@ func parseAnnounceResponse(data []byte) (*IPv4AnnounceResponse, error) {
 	}
 
 	// Parse Peers
-	peerData := data[20:]
-	for len(peerData) >= 6 {
-		// Extract ip and port
-		ip := net.IP(peerData[:4])
-		port := binary.BigEndian.Uint16(peerData[4:6])
+	// IPv6 trackers return 18 bytes per peer (16 for ip, 2 for port)
+	// instead of 6 - https://www.bittorrent.org/beps/bep_0015.html#ipv6
+	ipLen := net.IPv4len
+	if ipv6 {
+		ipLen = net.IPv6len
+	}
 
-		// Append to the list of peers
-		resp.Peers = append(resp.Peers, peer.NewPeer(ip, port))
+	// ignore trailing bytes which do not make up a complete peer
+	peerData := data[20:]
+	peerData = peerData[:len(peerData)-len(peerData)%(ipLen+2)]
 
-		// Slice peerData to process next peers
-		peerData = peerData[6:]
+	resp.Peers, err = parseCompactPeers(peerData, ipLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peers: %v", err)
 	}
 
 	log.Printf("Announce response: %+v\n", resp)
@@ -0,0 +1,168 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"my-bittorrent/peer"
+	"my-bittorrent/torrent"
+	"time"
+)
+
+// defaultAnnounceInterval is used when trackers do not return an interval
+const defaultAnnounceInterval = 30 * time.Minute
+
+// minAnnounceInterval protects trackers from being hammered by a small interval
+const minAnnounceInterval = 1 * time.Minute
+
+// announceRetryInterval is the delay before retrying when no tracker answered
+const announceRetryInterval = 1 * time.Minute
+
+// stopAnnounceTimeout limits the announces sent on shutdown, so that an
+// unresponsive tracker does not hold up the exit
+const stopAnnounceTimeout = 10 * time.Second
+
+// Announcer periodically announces a torrent to its trackers for as long as
+// the torrent is active, and delivers the peers received on Peers()
+type Announcer struct {
+	t       *torrent.Torrent
+	tiers   *trackerTiers
+	peersCh chan []*peer.Peer
+}
+
+func NewAnnouncer(t *torrent.Torrent) (*Announcer, error) {
+	tiers, err := t.GetAnnounceList()
+	if err != nil {
+		return nil, fmt.Errorf("error getting announce list: %v", err)
+	}
+
+	log.Printf("tracker tiers: %v\n", tiers)
+
+	return &Announcer{
+		t:       t,
+		tiers:   newTrackerTiers(tiers),
+		peersCh: make(chan []*peer.Peer, 1),
+	}, nil
+}
+
+// Peers returns the channel on which peers received from trackers are
+// delivered after every successful announce. The channel is closed when Run
+// returns
+func (a *Announcer) Peers() <-chan []*peer.Peer {
+	return a.peersCh
+}
+
+// Run sends 'started' and then re-announces every interval returned by the
+// trackers. 'completed' is sent as soon as the download completes and
+// 'stopped' is sent when ctx is cancelled
+func (a *Announcer) Run(ctx context.Context) {
+	defer close(a.peersCh)
+
+	event := EventStarted
+	completedSent := false
+	completedCh := a.t.Downloader.Completed()
+
+	// Torrent which is already complete at start, e.g. resumed or rechecked,
+	// does not send 'completed'
+	if a.t.Downloader.IsDownloadComplete() {
+		completedSent = true
+		completedCh = nil
+	}
+
+	for {
+		wait := announceRetryInterval
+
+		res, err := a.announce(ctx, event)
+		if err != nil {
+			log.Printf("error announcing, event: %d, error: %v\n", event, err)
+		} else {
+			if event == EventCompleted {
+				completedSent = true
+			}
+			event = EventNone
+			wait = announceWait(res)
+
+			log.Printf("announce successful, peers: %d, seeders: %d, leechers: %d, next announce in: %v\n",
+				len(res.Peers), res.Seeders, res.Leechers, wait)
+
+			select {
+			case a.peersCh <- res.Peers:
+			case <-ctx.Done():
+			}
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			a.stop(completedSent)
+			return
+		case <-completedCh:
+			timer.Stop()
+			// stop listening to the closed channel
+			completedCh = nil
+			event = EventCompleted
+		case <-timer.C:
+			// A failed 'completed' announce is retried with the next announce
+			if !completedSent && completedCh == nil {
+				event = EventCompleted
+			}
+		}
+	}
+}
+
+// stop sends 'stopped' to the trackers, preceded by 'completed' if the
+// download completed but it could not be announced yet. The announces are
+// given up after stopAnnounceTimeout
+func (a *Announcer) stop(completedSent bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), stopAnnounceTimeout)
+	defer cancel()
+
+	if !completedSent && a.t.Downloader.IsDownloadComplete() {
+		if _, err := a.announce(ctx, EventCompleted); err != nil {
+			log.Printf("error announcing completed: %v\n", err)
+		}
+	}
+
+	if _, err := a.announce(ctx, EventStopped); err != nil {
+		log.Printf("error announcing stopped: %v\n", err)
+	}
+}
+
+// announce walks the tracker tiers with the current transfer stats, until
+// ctx is done
+func (a *Announcer) announce(ctx context.Context, event int32) (*announceResult, error) {
+	params := &announceParams{
+		InfoHash:   a.t.InfoHash,
+		PeerID:     peer.PeerID,
+		Downloaded: a.t.Downloader.BytesDownloaded(),
+		Left:       a.t.Downloader.BytesLeft(),
+		Uploaded:   a.t.Downloader.BytesUploaded(),
+		Event:      event,
+		Port:       AnnounceReqPort,
+	}
+
+	return a.tiers.announce(func(trackerUrl string) (*announceResult, error) {
+		return announce(ctx, trackerUrl, params)
+	})
+}
+
+// announceWait returns the time to wait before the next announce, based on
+// interval and min interval returned by the trackers
+func announceWait(res *announceResult) time.Duration {
+	wait := time.Duration(res.Interval) * time.Second
+	if wait <= 0 {
+		wait = defaultAnnounceInterval
+	}
+
+	if minInterval := time.Duration(res.MinInterval) * time.Second; wait < minInterval {
+		wait = minInterval
+	}
+
+	if wait < minAnnounceInterval {
+		wait = minAnnounceInterval
+	}
+
+	return wait
+}
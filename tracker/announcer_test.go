@@ -0,0 +1,174 @@
+package tracker
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"my-bittorrent/peer"
+	"my-bittorrent/queue"
+	"my-bittorrent/torrent"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAnnounceWait(t *testing.T) {
+	var testCases = map[string]struct {
+		res          *announceResult
+		expectedWait time.Duration
+	}{
+		"interval": {
+			res:          &announceResult{Interval: 1800},
+			expectedWait: 30 * time.Minute,
+		},
+		"no interval": {
+			res:          &announceResult{},
+			expectedWait: defaultAnnounceInterval,
+		},
+		"min interval larger than interval": {
+			res:          &announceResult{Interval: 120, MinInterval: 300},
+			expectedWait: 5 * time.Minute,
+		},
+		"interval too small": {
+			res:          &announceResult{Interval: 5},
+			expectedWait: minAnnounceInterval,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			wait := announceWait(test.res)
+			if wait != test.expectedWait {
+				t.Errorf("wait mismatch, expected: %v, got: %v", test.expectedWait, wait)
+			}
+		})
+	}
+}
+
+func TestAnnouncerRun(t *testing.T) {
+	var testCases = map[string]struct {
+		completeAtStart bool
+		expected        []string // event, uploaded, downloaded and left of every announce
+	}{
+		"download completes": {
+			expected: []string{
+				"started 0 0 8",
+				"completed 3 8 0",
+				"stopped 3 8 0",
+			},
+		},
+		"complete at start": {
+			completeAtStart: true,
+			expected: []string{
+				"started 0 0 0",
+				"stopped 0 0 0",
+			},
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			announces := make(chan string, 10)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				q := r.URL.Query()
+				announces <- fmt.Sprintf("%s %s %s %s", q.Get("event"), q.Get("uploaded"), q.Get("downloaded"), q.Get("left"))
+				w.Write([]byte("d8:intervali1800e5:peers0:e"))
+			}))
+			defer server.Close()
+
+			// 2 pieces of 4 bytes
+			data := []byte("aaaabbbb")
+			tr := &torrent.Torrent{
+				Name:        name,
+				PiecesCount: 2,
+				PieceLength: 4,
+				FileLength:  int64(len(data)),
+				PieceHash:   [][20]byte{sha1.Sum(data[:4]), sha1.Sum(data[4:])},
+			}
+
+			storage, err := torrent.MemoryStorage(tr)
+			if err != nil {
+				t.Fatalf("error opening storage: %v", err)
+			}
+			if test.completeAtStart {
+				for pieceIdx := 0; pieceIdx < tr.PiecesCount; pieceIdx++ {
+					if err := storage.WriteBlock(data[pieceIdx*4:pieceIdx*4+4], pieceIdx, 0); err != nil {
+						t.Fatalf("error writing piece %d: %v", pieceIdx, err)
+					}
+				}
+			}
+			tr.Storage = func(*torrent.Torrent) (torrent.Storage, error) {
+				return storage, nil
+			}
+
+			tr.Downloader, err = torrent.NewDownloader(tr)
+			if err != nil {
+				t.Fatalf("error creating downloader: %v", err)
+			}
+			defer tr.Downloader.Close()
+			if _, err := tr.Downloader.Recheck(nil); err != nil {
+				t.Fatalf("error checking data: %v", err)
+			}
+			tr.Downloader.Start()
+
+			a := &Announcer{
+				t:       tr,
+				tiers:   newTrackerTiers([][]string{{server.URL + "/announce"}}),
+				peersCh: make(chan []*peer.Peer, 1),
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				a.Run(ctx)
+			}()
+
+			var got []string
+			next := func() {
+				select {
+				case ann := <-announces:
+					got = append(got, ann)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("announce not received, got: %v", got)
+				}
+			}
+			// peers are delivered once the announce is handled
+			handled := func() {
+				select {
+				case <-a.Peers():
+				case <-time.After(5 * time.Second):
+					t.Fatalf("announce not handled")
+				}
+			}
+
+			next()
+			handled()
+
+			if !test.completeAtStart {
+				for pieceIdx := 0; pieceIdx < tr.PiecesCount; pieceIdx++ {
+					tr.Downloader.Downloaded(queue.NewBlock(pieceIdx, 0, 4), data[pieceIdx*4:pieceIdx*4+4])
+				}
+				tr.Downloader.AddUploaded(3)
+
+				deadline := time.Now().Add(5 * time.Second)
+				for !tr.Downloader.IsDownloadComplete() && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+
+				next()
+				handled()
+			}
+
+			cancel()
+			<-done
+			next()
+
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("announces mismatch, expected: %v, got: %v", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"my-bittorrent/decoder"
+	"my-bittorrent/peer"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const httpTimeout = 15 * time.Second
+
+// maxHTTPResponseSize limits how much of a tracker response is read
+const maxHTTPResponseSize = 1 << 20 // 1 MB
+
+var httpClient = &http.Client{Timeout: httpTimeout}
+
+// HTTPAnnounceResponse defines the decoded response of a HTTP tracker to an
+// announce request
+// HTTP tracker protocol definition - https://www.bittorrent.org/beps/bep_0003.html#trackers
+type HTTPAnnounceResponse struct {
+	Interval    int32 // seconds to wait before re-announcing
+	MinInterval int32 // optional, seconds before which re-announce is not allowed
+	TrackerID   string
+	Seeders     int32 // 'complete' in response
+	Leechers    int32 // 'incomplete' in response
+	Warning     string
+	Peers       []*peer.Peer
+}
+
+// httpEvents maps announce events to the values expected by HTTP trackers
+var httpEvents = map[int32]string{
+	EventCompleted: "completed",
+	EventStarted:   "started",
+	EventStopped:   "stopped",
+}
+
+// buildAnnounceUrl adds announce parameters to the query of the tracker url
+func buildAnnounceUrl(announceUrl string, params *announceParams) (string, error) {
+	u, err := url.Parse(announceUrl)
+	if err != nil {
+		return "", fmt.Errorf("error parsing announce url: %v", err)
+	}
+
+	// Keep the query parameters already present in the url (e.g. passkey)
+	q := u.Query()
+	q.Set("info_hash", string(params.InfoHash[:]))
+	q.Set("peer_id", string(params.PeerID[:]))
+	q.Set("port", strconv.Itoa(int(params.Port)))
+	q.Set("uploaded", strconv.FormatInt(params.Uploaded, 10))
+	q.Set("downloaded", strconv.FormatInt(params.Downloaded, 10))
+	q.Set("left", strconv.FormatInt(params.Left, 10))
+	q.Set("compact", "1")
+
+	if event, ok := httpEvents[params.Event]; ok {
+		q.Set("event", event)
+	}
+
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// announceHTTP sends an announce request to a HTTP tracker
+func announceHTTP(ctx context.Context, announceUrl string, params *announceParams) (*HTTPAnnounceResponse, error) {
+	reqUrl, err := buildAnnounceUrl(announceUrl, params)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("HTTP announce request: %s\n", reqUrl)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating announce request: %v", err)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending announce request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from tracker: %s", res.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxHTTPResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("error reading announce response: %v", err)
+	}
+
+	resp, err := parseHTTPAnnounceResponse(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Warning != "" {
+		log.Printf("Warning from tracker %s: %s\n", announceUrl, resp.Warning)
+	}
+
+	log.Printf("HTTP announce response: %+v\n", resp)
+
+	return resp, nil
+}
+
+// parseHTTPAnnounceResponse parses the bencoded response of a HTTP tracker,
+// ctx bounds the lookups of the peers given by DNS name
+func parseHTTPAnnounceResponse(ctx context.Context, data []byte) (*HTTPAnnounceResponse, error) {
+	decoded, err := decoder.DecodeBencode(data)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding announce response: %v", err)
+	}
+
+	respMap, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("announce response is not a dictionary")
+	}
+
+	// If 'failure reason' is present, no other keys are expected
+	if reason, ok := respMap["failure reason"]; ok {
+		return nil, &TrackerError{Message: fmt.Sprint(reason)}
+	}
+
+	resp := &HTTPAnnounceResponse{}
+
+	resp.Interval = int32(getInt(respMap, "interval"))
+	resp.MinInterval = int32(getInt(respMap, "min interval"))
+	resp.Seeders = int32(getInt(respMap, "complete"))
+	resp.Leechers = int32(getInt(respMap, "incomplete"))
+
+	if trackerID, ok := respMap["tracker id"].(string); ok {
+		resp.TrackerID = trackerID
+	}
+
+	if warning, ok := respMap["warning message"].(string); ok {
+		resp.Warning = warning
+	}
+
+	switch peers := respMap["peers"].(type) {
+	case string:
+		// Compact peer list - https://www.bittorrent.org/beps/bep_0023.html
+		resp.Peers, err = parseCompactPeers([]byte(peers), net.IPv4len)
+	case []interface{}:
+		resp.Peers, err = parseDictPeers(ctx, peers)
+	case nil:
+		// no peers
+	default:
+		err = fmt.Errorf("'peers' field is neither a string nor a list")
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error parsing peers: %v", err)
+	}
+
+	// IPv6 peers in compact form - https://www.bittorrent.org/beps/bep_0007.html
+	if peers6, ok := respMap["peers6"].(string); ok {
+		ipv6Peers, err := parseCompactPeers([]byte(peers6), net.IPv6len)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing peers6: %v", err)
+		}
+		resp.Peers = append(resp.Peers, ipv6Peers...)
+	}
+
+	return resp, nil
+}
+
+// parseCompactPeers parses peers where each peer is represented by the ip
+// address (4 bytes for IPv4, 16 bytes for IPv6) followed by 2 bytes of port
+func parseCompactPeers(data []byte, ipLen int) ([]*peer.Peer, error) {
+	entryLen := ipLen + 2
+	if len(data)%entryLen != 0 {
+		return nil, fmt.Errorf("invalid compact peers length: %d, not a multiple of %d", len(data), entryLen)
+	}
+
+	var peers []*peer.Peer
+	for i := 0; i < len(data); i += entryLen {
+		ip := net.IP(append([]byte{}, data[i:i+ipLen]...))
+		port := binary.BigEndian.Uint16(data[i+ipLen : i+entryLen])
+		peers = append(peers, peer.NewPeer(ip, port))
+	}
+
+	return peers, nil
+}
+
+// parseDictPeers parses peers where each peer is a dictionary with keys
+// 'peer id', 'ip' and 'port'
+func parseDictPeers(ctx context.Context, list []interface{}) ([]*peer.Peer, error) {
+	var peers []*peer.Peer
+
+	for i, item := range list {
+		peerMap, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("peers[%d] is not a dictionary", i)
+		}
+
+		ipStr, ok := peerMap["ip"].(string)
+		if !ok {
+			return nil, fmt.Errorf("peers[%d].ip is not a string", i)
+		}
+
+		// ip can be an IPv4, IPv6 address or a DNS name
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, ipStr)
+			if err != nil || len(addrs) == 0 {
+				log.Printf("skipping peer, could not resolve ip: %s\n", ipStr)
+				continue
+			}
+			ip = addrs[0].IP
+		}
+
+		port, ok := peerMap["port"].(int64)
+		if !ok {
+			return nil, fmt.Errorf("peers[%d].port is not an integer", i)
+		}
+
+		p := peer.NewPeer(ip, uint16(port))
+
+		if peerID, ok := peerMap["peer id"].(string); ok && len(peerID) == 20 {
+			copy(p.ID[:], peerID)
+		}
+
+		peers = append(peers, p)
+	}
+
+	return peers, nil
+}
+
+// getInt returns the integer value for key in a decoded dictionary,
+// 0 if the key does not exist or is not an integer
+func getInt(m map[string]interface{}, key string) int64 {
+	v, ok := m[key].(int64)
+	if !ok {
+		return 0
+	}
+	return v
+}
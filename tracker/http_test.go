@@ -0,0 +1,141 @@
+package tracker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseHTTPAnnounceResponse(t *testing.T) {
+	var testCases = map[string]struct {
+		response      string
+		expectedPeers []string
+		interval      int32
+		warning       string
+		expectedError bool
+	}{
+		"compact peers": {
+			response:      "d8:intervali1800e5:peers12:" + "\x0a\x00\x00\x01\x1a\xe1" + "\xc0\xa8\x01\x02\x1a\xe2" + "e",
+			expectedPeers: []string{"10.0.0.1:6881", "192.168.1.2:6882"},
+			interval:      1800,
+		},
+		"dictionary peers": {
+			response:      "d8:intervali900e5:peersld2:ip8:10.0.0.17:peer id20:-AT0001-1234567890124:porti6881eeee",
+			expectedPeers: []string{"10.0.0.1:6881"},
+			interval:      900,
+		},
+		"compact ipv6 peers": {
+			response:      "d8:intervali1800e5:peers6:" + "\x0a\x00\x00\x01\x1a\xe1" + "6:peers618:" + "\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01\x1a\xe1" + "e",
+			expectedPeers: []string{"10.0.0.1:6881", "[2001:db8::1]:6881"},
+			interval:      1800,
+		},
+		"warning message": {
+			response:      "d8:intervali60e5:peers0:15:warning message4:slowe",
+			expectedPeers: []string{},
+			interval:      60,
+			warning:       "slow",
+		},
+		"failure reason": {
+			response:      "d14:failure reason12:unregisterede",
+			expectedError: true,
+		},
+		"invalid compact peers": {
+			response:      "d8:intervali60e5:peers5:abcdee",
+			expectedError: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			resp, err := parseHTTPAnnounceResponse(context.Background(), []byte(test.response))
+			if (err != nil) != test.expectedError {
+				t.Fatalf("expected error: %v, got: %v", test.expectedError, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if resp.Interval != test.interval {
+				t.Errorf("interval mismatch, expected: %d, got: %d", test.interval, resp.Interval)
+			}
+
+			if resp.Warning != test.warning {
+				t.Errorf("warning mismatch, expected: %q, got: %q", test.warning, resp.Warning)
+			}
+
+			if len(resp.Peers) != len(test.expectedPeers) {
+				t.Fatalf("peers count mismatch, expected: %d, got: %d", len(test.expectedPeers), len(resp.Peers))
+			}
+
+			for i, p := range resp.Peers {
+				if p.String() != test.expectedPeers[i] {
+					t.Errorf("peer[%d] mismatch, expected: %s, got: %s", i, test.expectedPeers[i], p.String())
+				}
+			}
+		})
+	}
+}
+
+func TestAnnounceHTTP(t *testing.T) {
+	params := &announceParams{
+		InfoHash: [20]byte{0xc9, 0xe1, 0x57, 0x63},
+		PeerID:   [20]byte{'-', 'A', 'T', '0', '0', '0', '1', '-'},
+		Left:     1024,
+		Event:    EventStarted,
+		Port:     51413, // above the int16 range
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		if q.Get("info_hash") != string(params.InfoHash[:]) {
+			t.Errorf("info_hash mismatch, got: %x", q.Get("info_hash"))
+		}
+		if q.Get("peer_id") != string(params.PeerID[:]) {
+			t.Errorf("peer_id mismatch, got: %x", q.Get("peer_id"))
+		}
+		if q.Get("passkey") != "secret" {
+			t.Errorf("existing query parameter dropped, got: %s", r.URL.RawQuery)
+		}
+
+		expected := map[string]string{
+			"port":       "51413",
+			"uploaded":   "0",
+			"downloaded": "0",
+			"left":       "1024",
+			"compact":    "1",
+			"event":      "started",
+		}
+		for k, v := range expected {
+			if q.Get(k) != v {
+				t.Errorf("query param %s mismatch, expected: %s, got: %s", k, v, q.Get(k))
+			}
+		}
+
+		w.Write([]byte("d8:intervali1800e5:peers6:" + "\x7f\x00\x00\x01\x1a\xe1" + "e"))
+	}))
+	defer server.Close()
+
+	resp, err := announceHTTP(context.Background(), server.URL+"/announce?passkey=secret", params)
+	if err != nil {
+		t.Fatalf("error announcing: %v", err)
+	}
+
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "127.0.0.1:6881" {
+		t.Errorf("unexpected peers: %v", resp.Peers)
+	}
+}
+
+func TestAnnounceHTTPFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason17:torrent not founde"))
+	}))
+	defer server.Close()
+
+	_, err := announceHTTP(context.Background(), server.URL+"/announce", &announceParams{})
+	if err == nil || !strings.Contains(err.Error(), "torrent not found") {
+		t.Errorf("expected failure reason in error, got: %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"my-bittorrent/decoder"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxUDPScrapeInfoHashes is the max number of info hashes which fit in a
+// single UDP scrape request
+const maxUDPScrapeInfoHashes = 74
+
+// ScrapeResult holds the swarm stats of a torrent reported by a tracker
+type ScrapeResult struct {
+	InfoHash  [20]byte
+	Seeders   int32 // peers with the complete torrent
+	Completed int32 // number of times the torrent has been downloaded
+	Leechers  int32 // peers with an incomplete torrent
+}
+
+// ScrapeTracker fetches the swarm stats of the given info hashes from a tracker.
+// The protocol used depends on the scheme of the tracker url, the scrape is
+// given up once ctx is done
+func ScrapeTracker(ctx context.Context, trackerUrl string, infoHashes [][20]byte) ([]*ScrapeResult, error) {
+	parsedUrl, err := url.Parse(trackerUrl)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing tracker url: %v", err)
+	}
+
+	switch parsedUrl.Scheme {
+	case "udp":
+		return scrapeUDP(ctx, trackerUrl, infoHashes)
+	case "http", "https":
+		return scrapeHTTP(ctx, trackerUrl, infoHashes)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme: %q", parsedUrl.Scheme)
+	}
+}
+
+// scrapeUDP sends scrape requests to a UDP tracker, info hashes are sent
+// in batches which fit in a single packet
+// UDP tracker protocol definition - https://www.bittorrent.org/beps/bep_0015.html
+func scrapeUDP(ctx context.Context, trackerUrl string, infoHashes [][20]byte) ([]*ScrapeResult, error) {
+	conn, err := connectUDP(trackerUrl)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to server address: %v", err)
+	}
+	defer conn.Close()
+
+	host := conn.RemoteAddr().String()
+
+	var results []*ScrapeResult
+
+	for start := 0; start < len(infoHashes); start += maxUDPScrapeInfoHashes {
+		end := min(start+maxUDPScrapeInfoHashes, len(infoHashes))
+		batch := infoHashes[start:end]
+
+		resp, err := udpRoundTrip(ctx, conn, Scrape, func() ([]byte, int32, error) {
+			connectionID, err := getConnectionID(ctx, conn, host)
+			if err != nil {
+				return nil, 0, fmt.Errorf("error getting connection ID: %w", err)
+			}
+
+			transactionID := randInt32()
+			return buildScrapeRequest(connectionID, transactionID, batch), transactionID, nil
+		})
+		if err != nil {
+			forgetConnectionID(host)
+			return nil, fmt.Errorf("error scraping: %w", err)
+		}
+
+		batchResults, err := parseScrapeResponse(resp, batch)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing scrape response: %v", err)
+		}
+
+		results = append(results, batchResults...)
+	}
+
+	return results, nil
+}
+
+// buildScrapeRequest builds a UDP scrape request
+// Format: <connection_id><action=2><transaction_id><info_hash>...
+func buildScrapeRequest(connectionID int64, transactionID int32, infoHashes [][20]byte) []byte {
+	buf := new(bytes.Buffer)
+
+	binary.Write(buf, binary.BigEndian, connectionID)
+	binary.Write(buf, binary.BigEndian, int32(Scrape))
+	binary.Write(buf, binary.BigEndian, transactionID)
+
+	for _, infoHash := range infoHashes {
+		buf.Write(infoHash[:])
+	}
+
+	log.Printf("Scrape request for %d info hashes", len(infoHashes))
+
+	return buf.Bytes()
+}
+
+// parseScrapeResponse parses a UDP scrape response, stats are in the same
+// order as the info hashes in the request
+// Format: <action=2><transaction_id>[<seeders><completed><leechers>]...
+func parseScrapeResponse(data []byte, infoHashes [][20]byte) ([]*ScrapeResult, error) {
+	expectedLen := 8 + 12*len(infoHashes)
+	if len(data) < expectedLen {
+		return nil, fmt.Errorf("response too short, expected %d bytes, got: %d", expectedLen, len(data))
+	}
+
+	results := make([]*ScrapeResult, len(infoHashes))
+
+	for i, infoHash := range infoHashes {
+		offset := 8 + 12*i
+		results[i] = &ScrapeResult{
+			InfoHash:  infoHash,
+			Seeders:   int32(binary.BigEndian.Uint32(data[offset : offset+4])),
+			Completed: int32(binary.BigEndian.Uint32(data[offset+4 : offset+8])),
+			Leechers:  int32(binary.BigEndian.Uint32(data[offset+8 : offset+12])),
+		}
+	}
+
+	return results, nil
+}
+
+// scrapeHTTP sends a scrape request to a HTTP tracker
+// Scrape convention - https://wiki.theory.org/BitTorrentSpecification#Tracker_.27scrape.27_Convention
+func scrapeHTTP(ctx context.Context, trackerUrl string, infoHashes [][20]byte) ([]*ScrapeResult, error) {
+	reqUrl, err := buildScrapeUrl(trackerUrl, infoHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("HTTP scrape request: %s\n", reqUrl)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating scrape request: %v", err)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending scrape request: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from tracker: %s", res.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxHTTPResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("error reading scrape response: %v", err)
+	}
+
+	return parseHTTPScrapeResponse(body, infoHashes)
+}
+
+// buildScrapeUrl derives the scrape url from the announce url by replacing
+// 'announce' in the last path segment with 'scrape', and adds the info hashes
+func buildScrapeUrl(announceUrl string, infoHashes [][20]byte) (string, error) {
+	u, err := url.Parse(announceUrl)
+	if err != nil {
+		return "", fmt.Errorf("error parsing announce url: %v", err)
+	}
+
+	idx := strings.LastIndex(u.Path, "/")
+	lastSegment := u.Path[idx+1:]
+	if !strings.HasPrefix(lastSegment, "announce") {
+		return "", fmt.Errorf("tracker does not support scrape, announce url: %s", announceUrl)
+	}
+
+	u.Path = u.Path[:idx+1] + "scrape" + strings.TrimPrefix(lastSegment, "announce")
+
+	q := u.Query()
+	for _, infoHash := range infoHashes {
+		q.Add("info_hash", string(infoHash[:]))
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// parseHTTPScrapeResponse parses the bencoded response of a HTTP tracker to a
+// scrape request. Info hashes missing in the response have zero stats
+func parseHTTPScrapeResponse(data []byte, infoHashes [][20]byte) ([]*ScrapeResult, error) {
+	decoded, err := decoder.DecodeBencode(data)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding scrape response: %v", err)
+	}
+
+	respMap, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("scrape response is not a dictionary")
+	}
+
+	if reason, ok := respMap["failure reason"]; ok {
+		return nil, &TrackerError{Message: fmt.Sprint(reason)}
+	}
+
+	files, ok := respMap["files"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'files' field is not a dictionary")
+	}
+
+	results := make([]*ScrapeResult, len(infoHashes))
+
+	for i, infoHash := range infoHashes {
+		results[i] = &ScrapeResult{InfoHash: infoHash}
+
+		stats, ok := files[string(infoHash[:])].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		results[i].Seeders = int32(getInt(stats, "complete"))
+		results[i].Completed = int32(getInt(stats, "downloaded"))
+		results[i].Leechers = int32(getInt(stats, "incomplete"))
+	}
+
+	return results, nil
+}
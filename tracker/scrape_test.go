@@ -0,0 +1,122 @@
+package tracker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBuildScrapeUrl(t *testing.T) {
+	var testCases = map[string]struct {
+		announceUrl   string
+		expectedUrl   string
+		expectedError bool
+	}{
+		"announce": {
+			announceUrl: "http://example.com/announce",
+			expectedUrl: "http://example.com/scrape",
+		},
+		"announce with suffix": {
+			announceUrl: "http://example.com/x/announce.php",
+			expectedUrl: "http://example.com/x/scrape.php",
+		},
+		"announce with query": {
+			announceUrl: "http://example.com/announce?passkey=secret",
+			expectedUrl: "http://example.com/scrape?passkey=secret",
+		},
+		"scrape not supported": {
+			announceUrl:   "http://example.com/a",
+			expectedError: true,
+		},
+		"announce not in last segment": {
+			announceUrl:   "http://example.com/announce/x",
+			expectedError: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			scrapeUrl, err := buildScrapeUrl(test.announceUrl, nil)
+			if (err != nil) != test.expectedError {
+				t.Fatalf("expected error: %v, got: %v", test.expectedError, err)
+			}
+
+			if scrapeUrl != test.expectedUrl {
+				t.Errorf("scrape url mismatch, expected: %s, got: %s", test.expectedUrl, scrapeUrl)
+			}
+		})
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	infoHashes := [][20]byte{{1}, {2}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			t.Errorf("path mismatch, expected: /scrape, got: %s", r.URL.Path)
+		}
+
+		if got := r.URL.Query()["info_hash"]; len(got) != len(infoHashes) {
+			t.Errorf("info hashes mismatch, expected: %d, got: %d", len(infoHashes), len(got))
+		}
+
+		// stats only for the first info hash
+		key := string(infoHashes[0][:])
+		w.Write([]byte("d5:filesd20:" + key + "d8:completei5e10:downloadedi50e10:incompletei10eeee"))
+	}))
+	defer server.Close()
+
+	results, err := ScrapeTracker(context.Background(), server.URL+"/announce", infoHashes)
+	if err != nil {
+		t.Fatalf("error scraping: %v", err)
+	}
+
+	expected := []ScrapeResult{
+		{InfoHash: infoHashes[0], Seeders: 5, Completed: 50, Leechers: 10},
+		{InfoHash: infoHashes[1]},
+	}
+
+	if len(results) != len(expected) {
+		t.Fatalf("results count mismatch, expected: %d, got: %d", len(expected), len(results))
+	}
+
+	for i, res := range results {
+		if *res != expected[i] {
+			t.Errorf("result[%d] mismatch, expected: %+v, got: %+v", i, expected[i], *res)
+		}
+	}
+}
+
+func TestScrapeUDP(t *testing.T) {
+	withFastRetries(t)
+	ft := newFakeUDPTracker(t)
+
+	// more info hashes than fit in a single packet
+	infoHashes := make([][20]byte, maxUDPScrapeInfoHashes+6)
+	for i := range infoHashes {
+		infoHashes[i][0] = byte(i)
+	}
+
+	results, err := ScrapeTracker(context.Background(), ft.url(), infoHashes)
+	if err != nil {
+		t.Fatalf("error scraping: %v", err)
+	}
+
+	if len(results) != len(infoHashes) {
+		t.Fatalf("results count mismatch, expected: %d, got: %d", len(infoHashes), len(results))
+	}
+
+	// first result of the second batch
+	res := results[maxUDPScrapeInfoHashes]
+	expected := ScrapeResult{InfoHash: infoHashes[maxUDPScrapeInfoHashes], Seeders: 1, Completed: 2, Leechers: 3}
+	if *res != expected {
+		t.Errorf("result mismatch, expected: %+v, got: %+v", expected, *res)
+	}
+
+	// connect, followed by one scrape per batch
+	expectedActions := []int32{0, 2, 2}
+	if got := ft.actions(); len(got) != len(expectedActions) {
+		t.Errorf("requests mismatch, expected actions: %v, got: %v", expectedActions, got)
+	}
+}
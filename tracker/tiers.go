@@ -0,0 +1,108 @@
+package tracker
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+)
+
+// trackerTiers holds the tiers of tracker urls for a torrent
+// Multitracker metadata extension - https://www.bittorrent.org/beps/bep_0012.html
+type trackerTiers struct {
+	mu    sync.Mutex // To synchronize access to tiers
+	tiers [][]string
+}
+
+// newTrackerTiers copies the tiers and shuffles the urls within each tier
+// as required by BEP 12
+func newTrackerTiers(tiers [][]string) *trackerTiers {
+	tt := &trackerTiers{
+		tiers: make([][]string, len(tiers)),
+	}
+
+	for i, tier := range tiers {
+		tt.tiers[i] = append([]string{}, tier...)
+		rand.Shuffle(len(tt.tiers[i]), func(a, b int) {
+			tt.tiers[i][a], tt.tiers[i][b] = tt.tiers[i][b], tt.tiers[i][a]
+		})
+	}
+
+	return tt
+}
+
+// promote moves the tracker url at idx to the front of its tier, the order
+// of the remaining urls is retained
+func (tt *trackerTiers) promote(tierIdx, idx int) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	tier := tt.tiers[tierIdx]
+	if idx <= 0 || idx >= len(tier) {
+		return
+	}
+
+	u := tier[idx]
+	copy(tier[1:idx+1], tier[:idx])
+	tier[0] = u
+}
+
+// snapshot returns a copy of the tiers, so that they can be walked without
+// holding the lock during network calls
+func (tt *trackerTiers) snapshot() [][]string {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	tiers := make([][]string, len(tt.tiers))
+	for i, tier := range tt.tiers {
+		tiers[i] = append([]string{}, tier...)
+	}
+
+	return tiers
+}
+
+// announce walks the tiers in order. Within a tier trackers are tried in
+// order until one of them answers, which is then promoted to the front of
+// its tier. A tier in which no tracker answers falls through to the next one.
+// Peers from every tracker that answered are merged and de-duplicated, the
+// largest interval and swarm counts reported are kept
+func (tt *trackerTiers) announce(fn func(trackerUrl string) (*announceResult, error)) (*announceResult, error) {
+	merged := &announceResult{}
+	seen := make(map[string]bool)
+	answered := 0
+
+	for tierIdx, tier := range tt.snapshot() {
+		for idx, trackerUrl := range tier {
+			res, err := fn(trackerUrl)
+			if err != nil {
+				log.Printf("tracker %s failed: %v\n", trackerUrl, err)
+				continue
+			}
+
+			tt.promote(tierIdx, idx)
+			answered++
+
+			merged.Interval = max(merged.Interval, res.Interval)
+			merged.MinInterval = max(merged.MinInterval, res.MinInterval)
+			merged.Leechers = max(merged.Leechers, res.Leechers)
+			merged.Seeders = max(merged.Seeders, res.Seeders)
+
+			for _, p := range res.Peers {
+				if seen[p.String()] {
+					continue
+				}
+				seen[p.String()] = true
+				merged.Peers = append(merged.Peers, p)
+			}
+
+			// tracker in this tier answered, move to next tier
+			break
+		}
+	}
+
+	if answered == 0 {
+		return nil, fmt.Errorf("no tracker answered the announce")
+	}
+
+	return merged, nil
+}
@@ -0,0 +1,107 @@
+package tracker
+
+import (
+	"fmt"
+	"my-bittorrent/peer"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestTrackerTiersPromote(t *testing.T) {
+	tt := &trackerTiers{
+		tiers: [][]string{{"a", "b", "c", "d"}},
+	}
+
+	tt.promote(0, 2)
+
+	expected := []string{"c", "a", "b", "d"}
+	if !reflect.DeepEqual(tt.tiers[0], expected) {
+		t.Errorf("tier mismatch after promote, expected: %v, got: %v", expected, tt.tiers[0])
+	}
+}
+
+func TestTrackerTiersAnnounce(t *testing.T) {
+	var testCases = map[string]struct {
+		tiers         [][]string
+		answers       map[string][]string // tracker url -> peer addresses, missing trackers fail
+		expectedPeers []string
+		expectedTiers [][]string
+		expectedError bool
+	}{
+		"working tracker promoted": {
+			tiers: [][]string{{"dead", "alive"}},
+			answers: map[string][]string{
+				"alive": {"10.0.0.1"},
+			},
+			expectedPeers: []string{"10.0.0.1:6881"},
+			expectedTiers: [][]string{{"alive", "dead"}},
+		},
+		"fall through to next tier": {
+			tiers: [][]string{{"dead1"}, {"dead2", "alive"}},
+			answers: map[string][]string{
+				"alive": {"10.0.0.1"},
+			},
+			expectedPeers: []string{"10.0.0.1:6881"},
+			expectedTiers: [][]string{{"dead1"}, {"alive", "dead2"}},
+		},
+		"peers merged across tiers": {
+			tiers: [][]string{{"a"}, {"b"}},
+			answers: map[string][]string{
+				"a": {"10.0.0.1", "10.0.0.2"},
+				"b": {"10.0.0.2", "10.0.0.3"},
+			},
+			expectedPeers: []string{"10.0.0.1:6881", "10.0.0.2:6881", "10.0.0.3:6881"},
+			expectedTiers: [][]string{{"a"}, {"b"}},
+		},
+		"all trackers dead": {
+			tiers:         [][]string{{"dead1"}, {"dead2"}},
+			answers:       map[string][]string{},
+			expectedError: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// tiers are not shuffled, to make the order deterministic
+			tt := &trackerTiers{tiers: test.tiers}
+
+			res, err := tt.announce(func(trackerUrl string) (*announceResult, error) {
+				ips, ok := test.answers[trackerUrl]
+				if !ok {
+					return nil, fmt.Errorf("tracker %s is dead", trackerUrl)
+				}
+
+				var peers []*peer.Peer
+				for _, ip := range ips {
+					peers = append(peers, peer.NewPeer(net.ParseIP(ip), 6881))
+				}
+				return &announceResult{Interval: 1800, Peers: peers}, nil
+			})
+
+			if (err != nil) != test.expectedError {
+				t.Fatalf("expected error: %v, got: %v", test.expectedError, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if res.Interval != 1800 {
+				t.Errorf("interval mismatch, expected: %d, got: %d", 1800, res.Interval)
+			}
+
+			var gotPeers []string
+			for _, p := range res.Peers {
+				gotPeers = append(gotPeers, p.String())
+			}
+
+			if !reflect.DeepEqual(gotPeers, test.expectedPeers) {
+				t.Errorf("peers mismatch, expected: %v, got: %v", test.expectedPeers, gotPeers)
+			}
+
+			if !reflect.DeepEqual(tt.tiers, test.expectedTiers) {
+				t.Errorf("tiers mismatch, expected: %v, got: %v", test.expectedTiers, tt.tiers)
+			}
+		})
+	}
+}
@@ -1,40 +1,78 @@
 package tracker
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
 	"fmt"
 	"log"
 	"my-bittorrent/peer"
-	"my-bittorrent/torrent"
 	"net"
-	"time"
+	"net/url"
 )
 
-const AnnounceReqPort int16 = 6881
+const AnnounceReqPort uint16 = 6881
 
 type TrackerResponse int
 
 const (
 	Connect  TrackerResponse = 0
 	Announce TrackerResponse = 1
+	Scrape   TrackerResponse = 2
+	Error    TrackerResponse = 3
 )
 
-const readTimeout = 10 * time.Second
+// announceResult is the protocol independent result of an announce
+type announceResult struct {
+	Interval    int32 // seconds to wait before re-announcing
+	MinInterval int32 // seconds before which re-announce is not allowed, 0 if not set
+	Leechers    int32
+	Seeders     int32
+	Peers       []*peer.Peer
+}
+
+// announce sends an announce request to a single tracker. The protocol used
+// depends on the scheme of the tracker url. The announce is given up once ctx
+// is done
+func announce(ctx context.Context, announceUrl string, params *announceParams) (*announceResult, error) {
+	log.Printf("announceUrl: %s\n", announceUrl)
 
-func GetPeers(t *torrent.Torrent) ([]*peer.Peer, error) {
-	announceUrl, err := t.GetAnnounceUrl()
+	parsedUrl, err := url.Parse(announceUrl)
 	if err != nil {
-		log.Printf("Error getting announce url: %v", err)
+		return nil, fmt.Errorf("error parsing announce url: %v", err)
 	}
 
-	// hardcoded since primary announceUrl for torrent used for testing is not
-	// returning any response
-	announceUrl = "udp://tracker.opentrackr.org:1337"
+	switch parsedUrl.Scheme {
+	case "udp":
+		resp, err := announceUDP(ctx, announceUrl, params)
+		if err != nil {
+			return nil, err
+		}
 
-	log.Printf("announceUrl: %s\n", announceUrl)
+		return &announceResult{
+			Interval: resp.Interval,
+			Leechers: resp.Leechers,
+			Seeders:  resp.Seeders,
+			Peers:    resp.Peers,
+		}, nil
+	case "http", "https":
+		resp, err := announceHTTP(ctx, announceUrl, params)
+		if err != nil {
+			return nil, err
+		}
 
+		return &announceResult{
+			Interval:    resp.Interval,
+			MinInterval: resp.MinInterval,
+			Leechers:    resp.Leechers,
+			Seeders:     resp.Seeders,
+			Peers:       resp.Peers,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme: %q", parsedUrl.Scheme)
+	}
+}
+
+// announceUDP sends an announce request to a UDP tracker
+func announceUDP(ctx context.Context, announceUrl string, params *announceParams) (*UDPAnnounceResponse, error) {
 	// UDP conn
 	conn, err := connectUDP(announceUrl)
 	if err != nil {
@@ -42,48 +80,34 @@ func GetPeers(t *torrent.Torrent) ([]*peer.Peer, error) {
 	}
 	defer conn.Close()
 
-	// Send connection request
-	req := buildConnectRequest()
-	connReqBytes, err := req.toBytes()
-	if err != nil {
-		return nil, err
-	}
-
-	err = sendMessage(conn, connReqBytes)
-	if err != nil {
-		log.Printf("Error sending message: %v\n", err)
-	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// Channels for results and errors
-	peersCh := make(chan []*peer.Peer)
-	errCh := make(chan error)
+	host := conn.RemoteAddr().String()
 
-	go func() {
-		defer close(peersCh)
-		defer close(errCh)
-
-		err := receiveMessage(ctx, conn, req, t, peersCh)
+	resp, err := udpRoundTrip(ctx, conn, Announce, func() ([]byte, int32, error) {
+		// connection ID is fetched before every attempt, since it may
+		// expire while retrying
+		connectionID, err := getConnectionID(ctx, conn, host)
 		if err != nil {
-			errCh <- err
+			return nil, 0, fmt.Errorf("error getting connection ID: %w", err)
 		}
-	}()
-
-	for {
-		select {
-		case peers := <-peersCh:
-			// Successfully receveid peers
-			return peers, nil
-		case err := <-errCh:
-			// Error received, stop processing
-			return nil, err
-		case <-ctx.Done():
-			// Context cancellation
-			return nil, ctx.Err()
+
+		req := buildAnnounceRequest(connectionID, params)
+		reqBytes, err := req.toBytes()
+		if err != nil {
+			return nil, 0, fmt.Errorf("error converting announce request to bytes: %v", err)
 		}
+
+		return reqBytes, req.TransactionID, nil
+	})
+	if err != nil {
+		// connection ID might have been rejected by the tracker
+		forgetConnectionID(host)
+		return nil, fmt.Errorf("error announcing: %w", err)
 	}
+
+	// peers are of the same address family as the tracker
+	ipv6 := conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil
+
+	return parseAnnounceResponse(resp, ipv6)
 }
 
 // sendMessage sends message on the given udp connection
@@ -98,122 +122,3 @@ func sendMessage(conn *net.UDPConn, message []byte) error {
 
 	return nil
 }
-
-// receiveMessage listens on the udp connection for incoming messages
-func receiveMessage(
-	ctx context.Context,
-	conn *net.UDPConn,
-	connReq *connectRequest,
-	t *torrent.Torrent,
-	peersCh chan<- []*peer.Peer) error {
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Stopping receiveMessage due to context cancellation")
-			return nil
-		default:
-			// receive response from tracker
-			log.Printf("waiting for message...")
-
-			bufferSize := 1024 // can set to 65535 (Max UDP payload size)
-			buffer := make([]byte, bufferSize)
-
-			conn.SetReadDeadline(time.Now().Add(readTimeout))
-			n, addr, err := conn.ReadFromUDP(buffer)
-			if err != nil {
-				return fmt.Errorf("error reading response %v", err)
-			}
-
-			if n >= bufferSize {
-				log.Printf("Warning: data might have been truncated\n")
-			}
-
-			resp := buffer[:n]
-			log.Printf("Received response from %s, response: %v \n", addr, resp)
-
-			responseType, err := getResponseType(resp)
-			if err != nil {
-				return fmt.Errorf("error reading response type: %v", err)
-			}
-
-			log.Printf("Response type: %d\n", responseType)
-
-			switch responseType {
-			case Connect:
-				connResp, err := parseConnectResponse(resp)
-				if err != nil {
-					return fmt.Errorf("error parsing connect response: %v", err)
-				}
-
-				// validate response
-
-				if connResp.TransactionID != connReq.TransactionID {
-					return fmt.Errorf("error Transaction ID mismatch: expected: %d, got %d",
-						connResp.TransactionID, connReq.TransactionID)
-				}
-
-				if connResp.Action != connReq.Action {
-					return fmt.Errorf("error Action mismatch: expected: %d, got %d",
-						connResp.Action, connReq.Action)
-				}
-
-				log.Printf("Successfully received connection ID: %d", connResp.ConnectionID)
-
-				// build announce request
-
-				// send announce request
-				announceReq := buildAnnounceRequest(
-					connResp.ConnectionID,
-					t.InfoHash,
-					peer.PeerID,
-					0,
-					t.FileLength,
-					0,
-					AnnounceReqPort,
-				)
-
-				announceReqBytes, err := announceReq.toBytes()
-				if err != nil {
-					return fmt.Errorf("error converting announce request to bytes: %v", err)
-				}
-
-				sendMessage(conn, announceReqBytes)
-
-			case Announce:
-				announceRes, err := parseAnnounceResponse(resp)
-				if err != nil {
-					return fmt.Errorf("error parsing announce response: %v", err)
-				}
-
-				peersCh <- announceRes.Peers
-
-				return nil // we don't need to wait for any more messages
-
-			default:
-				return fmt.Errorf("error invalid response type: %s", resp)
-			}
-		}
-	}
-}
-
-// getResponseType returns the type of response received
-// UDP tracker protocol definition - https://www.bittorrent.org/beps/bep_0015.html
-func getResponseType(data []byte) (TrackerResponse, error) {
-	// both connect and announce response have int32 at offset 0 which denote action
-	// 0 refers to connect and 1 refers to announce
-	var action int32
-	buf := bytes.NewReader(data)
-
-	err := binary.Read(buf, binary.BigEndian, &action)
-	if err != nil {
-		return -1, err
-	}
-
-	if action == 0 {
-		return Connect, nil
-	} else if action == 1 {
-		return Announce, nil
-	} else {
-		return -1, nil
-	}
-}
@@ -0,0 +1,197 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Retransmission schedule for UDP trackers, the n-th attempt waits for
+// udpBaseTimeout * 2^n for a response before retransmitting, up to
+// udpMaxRetries retransmissions. Retransmissions stop early once the context
+// of the request is done
+// UDP tracker protocol definition - https://www.bittorrent.org/beps/bep_0015.html#time-outs
+var (
+	udpBaseTimeout = 15 * time.Second
+	udpMaxRetries  = 8
+)
+
+// connectionIDTTL is the duration for which a connection ID can be reused
+const connectionIDTTL = 1 * time.Minute
+
+// maxUDPResponseSize is the max payload size of a UDP packet
+const maxUDPResponseSize = 65535
+
+// TrackerError is an error reported by a tracker, either as an error (action 3)
+// response by a UDP tracker or as 'failure reason' by a HTTP tracker
+type TrackerError struct {
+	Message string
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("tracker error: %s", e.Message)
+}
+
+type connectionID struct {
+	id         int64
+	obtainedAt time.Time
+}
+
+// connectionIDs caches connection IDs by tracker address
+var connectionIDs = struct {
+	mu  sync.Mutex
+	ids map[string]connectionID
+}{
+	ids: make(map[string]connectionID),
+}
+
+// getConnectionID returns the cached connection ID for the tracker if it has
+// not expired, otherwise a new one is obtained with a connect request
+func getConnectionID(ctx context.Context, conn *net.UDPConn, host string) (int64, error) {
+	connectionIDs.mu.Lock()
+	cached, ok := connectionIDs.ids[host]
+	connectionIDs.mu.Unlock()
+
+	if ok && time.Since(cached.obtainedAt) < connectionIDTTL {
+		return cached.id, nil
+	}
+
+	resp, err := udpRoundTrip(ctx, conn, Connect, func() ([]byte, int32, error) {
+		req := buildConnectRequest()
+		reqBytes, err := req.toBytes()
+		if err != nil {
+			return nil, 0, err
+		}
+		return reqBytes, req.TransactionID, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	connResp, err := parseConnectResponse(resp)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing connect response: %v", err)
+	}
+
+	log.Printf("Successfully received connection ID: %d", connResp.ConnectionID)
+
+	connectionIDs.mu.Lock()
+	connectionIDs.ids[host] = connectionID{id: connResp.ConnectionID, obtainedAt: time.Now()}
+	connectionIDs.mu.Unlock()
+
+	return connResp.ConnectionID, nil
+}
+
+// forgetConnectionID removes the cached connection ID for the tracker
+func forgetConnectionID(host string) {
+	connectionIDs.mu.Lock()
+	defer connectionIDs.mu.Unlock()
+
+	delete(connectionIDs.ids, host)
+}
+
+// udpRoundTrip sends the request returned by build and waits for the response
+// with the same transaction ID, retransmitting as per the BEP 15 schedule.
+// build is called for every attempt so that each one can use a fresh
+// transaction ID and connection ID. Returns the error of ctx once it is done
+func udpRoundTrip(
+	ctx context.Context,
+	conn *net.UDPConn,
+	action TrackerResponse,
+	build func() (req []byte, transactionID int32, err error)) ([]byte, error) {
+	for n := 0; n <= udpMaxRetries; n++ {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("error waiting for tracker: %w", err)
+		}
+
+		req, transactionID, err := build()
+		if err != nil {
+			return nil, err
+		}
+
+		err = sendMessage(conn, req)
+		if err != nil {
+			return nil, err
+		}
+
+		timeout := udpBaseTimeout * time.Duration(1<<n)
+
+		resp, err := receiveResponse(ctx, conn, action, transactionID, time.Now().Add(timeout))
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("error waiting for tracker: %w", ctx.Err())
+		}
+
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return nil, err
+		}
+
+		log.Printf("no response from tracker %s in %v, attempt: %d\n", conn.RemoteAddr(), timeout, n+1)
+	}
+
+	return nil, fmt.Errorf("no response from tracker after %d retries", udpMaxRetries)
+}
+
+// receiveResponse reads responses until one with the expected transaction ID
+// is received, the deadline is reached or ctx is done. Responses with other
+// transaction IDs (e.g. late responses to earlier attempts) are discarded
+func receiveResponse(ctx context.Context, conn *net.UDPConn, action TrackerResponse, transactionID int32, deadline time.Time) ([]byte, error) {
+	conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(time.Time{})
+
+	// Deadline in the past unblocks the read once ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	buffer := make([]byte, maxUDPResponseSize)
+
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("error reading response: %w", err)
+		}
+
+		resp := buffer[:n]
+
+		// both action and transaction ID are present at the start of every response
+		if len(resp) < 8 {
+			log.Printf("discarding response, too short: %d bytes\n", len(resp))
+			continue
+		}
+
+		respAction := TrackerResponse(binary.BigEndian.Uint32(resp[0:4]))
+		respTransactionID := int32(binary.BigEndian.Uint32(resp[4:8]))
+
+		if respTransactionID != transactionID {
+			log.Printf("discarding response, transaction ID mismatch: expected: %d, got %d\n",
+				transactionID, respTransactionID)
+			continue
+		}
+
+		if respAction == Error {
+			return nil, parseErrorResponse(resp)
+		}
+
+		if respAction != action {
+			return nil, fmt.Errorf("error Action mismatch: expected: %d, got %d", action, respAction)
+		}
+
+		return append([]byte{}, resp...), nil
+	}
+}
+
+// parseErrorResponse parses an error response to a TrackerError
+// Format: <action=3><transaction_id><message>
+func parseErrorResponse(data []byte) error {
+	return &TrackerError{Message: string(data[8:])}
+}
@@ -0,0 +1,282 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker is a UDP tracker which answers connect and announce requests,
+// handle can be used to drop or alter responses
+type fakeUDPTracker struct {
+	conn     *net.UDPConn
+	mu       sync.Mutex
+	received []int32 // actions of the requests received
+	handle   func(action int32, req []byte, resp []byte) [][]byte
+}
+
+func newFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+
+	ft := &fakeUDPTracker{conn: conn}
+	go ft.serve()
+
+	t.Cleanup(func() { conn.Close() })
+
+	return ft
+}
+
+func (ft *fakeUDPTracker) url() string {
+	return "udp://" + ft.conn.LocalAddr().String() + "/announce"
+}
+
+func (ft *fakeUDPTracker) setHandle(handle func(action int32, req []byte, resp []byte) [][]byte) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.handle = handle
+}
+
+func (ft *fakeUDPTracker) actions() []int32 {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return append([]int32{}, ft.received...)
+}
+
+func (ft *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := ft.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		req := buf[:n]
+		action := int32(binary.BigEndian.Uint32(req[8:12]))
+		transactionID := req[12:16]
+
+		var resp []byte
+		switch action {
+		case 0:
+			// <action><transaction_id><connection_id>
+			resp = make([]byte, 16)
+			copy(resp[4:8], transactionID)
+			binary.BigEndian.PutUint64(resp[8:16], 42)
+		case 1:
+			// <action><transaction_id><interval><leechers><seeders><peers>
+			resp = make([]byte, 26)
+			binary.BigEndian.PutUint32(resp[0:4], 1)
+			copy(resp[4:8], transactionID)
+			binary.BigEndian.PutUint32(resp[8:12], 1800)
+			copy(resp[20:26], []byte{10, 0, 0, 1, 0x1a, 0xe1})
+		case 2:
+			// <action><transaction_id>[<seeders><completed><leechers>]...
+			// stats of the n-th info hash are n+1, n+2, n+3
+			hashes := (n - 16) / 20
+			resp = make([]byte, 8+12*hashes)
+			binary.BigEndian.PutUint32(resp[0:4], 2)
+			copy(resp[4:8], transactionID)
+			for i := 0; i < hashes; i++ {
+				binary.BigEndian.PutUint32(resp[8+12*i:], uint32(i+1))
+				binary.BigEndian.PutUint32(resp[12+12*i:], uint32(i+2))
+				binary.BigEndian.PutUint32(resp[16+12*i:], uint32(i+3))
+			}
+		}
+
+		ft.mu.Lock()
+		ft.received = append(ft.received, action)
+		handle := ft.handle
+		ft.mu.Unlock()
+
+		responses := [][]byte{resp}
+		if handle != nil {
+			responses = handle(action, req, resp)
+		}
+
+		for _, r := range responses {
+			ft.conn.WriteToUDP(r, addr)
+		}
+	}
+}
+
+// withFastRetries shortens the retransmission schedule for the test
+func withFastRetries(t *testing.T) {
+	base, retries := udpBaseTimeout, udpMaxRetries
+	udpBaseTimeout, udpMaxRetries = 50*time.Millisecond, 2
+
+	t.Cleanup(func() {
+		udpBaseTimeout, udpMaxRetries = base, retries
+	})
+}
+
+func TestAnnounceUDP(t *testing.T) {
+	withFastRetries(t)
+	ft := newFakeUDPTracker(t)
+
+	resp, err := announceUDP(context.Background(), ft.url(), &announceParams{Left: 1024})
+	if err != nil {
+		t.Fatalf("error announcing: %v", err)
+	}
+
+	if resp.Interval != 1800 {
+		t.Errorf("interval mismatch, expected: %d, got: %d", 1800, resp.Interval)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "10.0.0.1:6881" {
+		t.Errorf("unexpected peers: %v", resp.Peers)
+	}
+
+	// connection ID is reused for the second announce
+	_, err = announceUDP(context.Background(), ft.url(), &announceParams{Left: 1024})
+	if err != nil {
+		t.Fatalf("error announcing: %v", err)
+	}
+
+	expected := []int32{0, 1, 1}
+	if got := ft.actions(); len(got) != len(expected) {
+		t.Errorf("requests mismatch, expected actions: %v, got: %v", expected, got)
+	}
+}
+
+func TestAnnounceUDPRetransmit(t *testing.T) {
+	withFastRetries(t)
+	ft := newFakeUDPTracker(t)
+
+	dropped := map[int32]bool{}
+	ft.setHandle(func(action int32, req []byte, resp []byte) [][]byte {
+		// drop the first request of every kind
+		if !dropped[action] {
+			dropped[action] = true
+			return nil
+		}
+		return [][]byte{resp}
+	})
+
+	resp, err := announceUDP(context.Background(), ft.url(), &announceParams{})
+	if err != nil {
+		t.Fatalf("error announcing: %v", err)
+	}
+
+	if len(resp.Peers) != 1 {
+		t.Errorf("unexpected peers: %v", resp.Peers)
+	}
+}
+
+func TestAnnounceUDPTransactionIDMismatch(t *testing.T) {
+	withFastRetries(t)
+	ft := newFakeUDPTracker(t)
+
+	ft.setHandle(func(action int32, req []byte, resp []byte) [][]byte {
+		if action != 1 {
+			return [][]byte{resp}
+		}
+
+		// a response to another transaction arrives first and is discarded
+		other := append([]byte{}, resp...)
+		other[7] ^= 0xff
+		other[21] = 99
+		return [][]byte{other, resp}
+	})
+
+	resp, err := announceUDP(context.Background(), ft.url(), &announceParams{})
+	if err != nil {
+		t.Fatalf("error announcing: %v", err)
+	}
+
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "10.0.0.1:6881" {
+		t.Errorf("unexpected peers: %v", resp.Peers)
+	}
+}
+
+func TestAnnounceUDPErrorResponse(t *testing.T) {
+	withFastRetries(t)
+	ft := newFakeUDPTracker(t)
+
+	ft.setHandle(func(action int32, req []byte, resp []byte) [][]byte {
+		if action != 1 {
+			return [][]byte{resp}
+		}
+
+		// <action=3><transaction_id><message>
+		errResp := make([]byte, 8)
+		binary.BigEndian.PutUint32(errResp[0:4], 3)
+		copy(errResp[4:8], req[12:16])
+		return [][]byte{append(errResp, "torrent not registered"...)}
+	})
+
+	_, err := announceUDP(context.Background(), ft.url(), &announceParams{})
+
+	var trackerErr *TrackerError
+	if !errors.As(err, &trackerErr) {
+		t.Fatalf("expected TrackerError, got: %v", err)
+	}
+	if trackerErr.Message != "torrent not registered" {
+		t.Errorf("message mismatch, got: %s", trackerErr.Message)
+	}
+}
+
+func TestAnnounceUDPNoResponse(t *testing.T) {
+	withFastRetries(t)
+	ft := newFakeUDPTracker(t)
+
+	ft.setHandle(func(action int32, req []byte, resp []byte) [][]byte {
+		return nil
+	})
+
+	_, err := announceUDP(context.Background(), ft.url(), &announceParams{})
+	if err == nil {
+		t.Fatal("expected error when tracker does not respond")
+	}
+
+	// initial attempt followed by udpMaxRetries retransmissions
+	if got := len(ft.actions()); got != udpMaxRetries+1 {
+		t.Errorf("attempts mismatch, expected: %d, got: %d", udpMaxRetries+1, got)
+	}
+}
+
+func TestParseAnnounceResponseIPv6(t *testing.T) {
+	// <action><transaction_id><interval><leechers><seeders><peers>
+	data := make([]byte, 20)
+	binary.BigEndian.PutUint32(data[0:4], 1)
+	binary.BigEndian.PutUint32(data[8:12], 1800)
+
+	ip := net.ParseIP("2001:db8::1")
+	data = append(data, ip...)
+	data = append(data, 0x1a, 0xe1)
+
+	resp, err := parseAnnounceResponse(data, true)
+	if err != nil {
+		t.Fatalf("error parsing announce response: %v", err)
+	}
+
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "[2001:db8::1]:6881" {
+		t.Errorf("unexpected peers: %v", resp.Peers)
+	}
+}
+
+func TestAnnounceUDPContextDone(t *testing.T) {
+	ft := newFakeUDPTracker(t)
+
+	ft.setHandle(func(action int32, req []byte, resp []byte) [][]byte {
+		return nil
+	})
+
+	// with the default retransmission schedule the announce would wait for
+	// hours, it is cut short once the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := announceUDP(ctx, ft.url(), &announceParams{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context error, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected announce to stop with the context, took: %v", elapsed)
+	}
+}
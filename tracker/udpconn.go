@@ -22,14 +22,19 @@ func connectUDP(serverUrl string) (*net.UDPConn, error) {
 
 	log.Printf("Tracker Host: %s\n", host)
 
-	// resolve host
-	serverAddr, err := net.ResolveUDPAddr("udp4", host)
+	// resolve host, it can resolve to an IPv4 or IPv6 address
+	serverAddr, err := net.ResolveUDPAddr("udp", host)
 	if err != nil {
 		return nil, fmt.Errorf("error resolving server address: %v", err)
 	}
 
 	log.Printf("Resolved address: %v\n", serverAddr)
 
+	network := "udp4"
+	if serverAddr.IP.To4() == nil {
+		network = "udp6"
+	}
+
 	// connect to tracker client
-	return net.DialUDP("udp4", nil, serverAddr)
+	return net.DialUDP(network, nil, serverAddr)
 }